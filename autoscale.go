@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// autoScaleInterval is how often -auto-workers samples the queue
+	autoScaleInterval = 500 * time.Millisecond
+
+	// Consecutive samples with a full or empty queue before workers are
+	// added or retired, so a single burst doesn't move the count
+	autoScaleUpSamples   = 2
+	autoScaleDownSamples = 6
+)
+
+// workerScaler is the -auto-workers supervisor. It adds workers while the
+// domain queue stays full, meaning the workers can't keep up, and retires
+// them while it stays empty, keeping the count within min and max.
+// Workers are retired through the pipeline's retire channel, so one only
+// exits between domains.
+type workerScaler struct {
+	pipeline *queryPipeline
+	min      int
+	max      int
+	active   int
+	logger   *Logger
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// startWorkerScaler starts the supervisor for a pipeline already running
+// active workers
+func startWorkerScaler(ctx context.Context, pipeline *queryPipeline, active, min, max int, logger *Logger) *workerScaler {
+	s := &workerScaler{
+		pipeline: pipeline,
+		min:      min,
+		max:      max,
+		active:   active,
+		logger:   logger,
+		stop:     make(chan struct{}),
+	}
+
+	s.done.Add(1)
+	go s.run(ctx)
+	return s
+}
+
+// run samples the queue depth until the scaler is stopped or ctx is done
+func (s *workerScaler) run(ctx context.Context) {
+	defer s.done.Done()
+
+	ticker := time.NewTicker(autoScaleInterval)
+	defer ticker.Stop()
+
+	full, idle := 0, 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		switch depth := len(s.pipeline.domainChan); {
+		case depth >= cap(s.pipeline.domainChan):
+			full, idle = full+1, 0
+		case depth == 0:
+			full, idle = 0, idle+1
+		default:
+			full, idle = 0, 0
+		}
+
+		if full >= autoScaleUpSamples && s.active < s.max {
+			s.grow(ctx)
+			full = 0
+		} else if idle >= autoScaleDownSamples && s.active > s.min {
+			s.shrink(ctx)
+			idle = 0
+		}
+	}
+}
+
+// grow adds a quarter of the active workers, at least one
+func (s *workerScaler) grow(ctx context.Context) {
+	add := s.active / 4
+	if add < 1 {
+		add = 1
+	}
+	if s.active+add > s.max {
+		add = s.max - s.active
+	}
+
+	for i := 0; i < add; i++ {
+		s.pipeline.workers.Add(1)
+		go s.pipeline.worker(ctx)
+	}
+	s.active += add
+	s.logger.Debugf("Queue full, scaled workers up to %d", s.active)
+}
+
+// shrink retires an eighth of the active workers, at least one. Workers
+// busy with a domain pick up the request when they finish it.
+func (s *workerScaler) shrink(ctx context.Context) {
+	retire := s.active / 8
+	if retire < 1 {
+		retire = 1
+	}
+	if s.active-retire < s.min {
+		retire = s.active - s.min
+	}
+
+	for i := 0; i < retire; i++ {
+		select {
+		case s.pipeline.retire <- struct{}{}:
+			s.active--
+		case <-s.stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+	s.logger.Debugf("Queue idle, scaled workers down to %d", s.active)
+}
+
+// Stop ends scaling and waits for the supervisor, so no worker is added
+// after it returns. A nil scaler does nothing.
+func (s *workerScaler) Stop() {
+	if s == nil {
+		return
+	}
+
+	close(s.stop)
+	s.done.Wait()
+}
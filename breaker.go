@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// errorBreaker aborts a run whose recent queries almost all fail, which
+// usually means every resolver is dead or the network is down. It keeps
+// the outcome of the last window results and trips once the window is
+// full and the failed share reaches the threshold. A nil breaker never
+// trips.
+type errorBreaker struct {
+	threshold float64
+	outcomes  []bool
+	next      int
+	filled    int
+	failed    int
+	abort     func()
+	err       error
+	mutex     sync.Mutex
+}
+
+// newErrorBreaker creates a breaker that calls abort when it trips, or
+// nil when threshold is 0
+func newErrorBreaker(threshold float64, window int, abort func()) *errorBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &errorBreaker{
+		threshold: threshold,
+		outcomes:  make([]bool, window),
+		abort:     abort,
+	}
+}
+
+// Record adds the outcome of one query
+func (b *errorBreaker) Record(failed bool) {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.err != nil {
+		return
+	}
+
+	if b.filled == len(b.outcomes) {
+		if b.outcomes[b.next] {
+			b.failed--
+		}
+	} else {
+		b.filled++
+	}
+	b.outcomes[b.next] = failed
+	if failed {
+		b.failed++
+	}
+	b.next = (b.next + 1) % len(b.outcomes)
+
+	if b.filled < len(b.outcomes) {
+		return
+	}
+
+	if rate := float64(b.failed) / float64(b.filled); rate >= b.threshold {
+		b.err = fmt.Errorf("%d of the last %d queries failed (%.0f%%, -abort-on-error-rate %.0f%%); check that the resolvers are reachable",
+			b.failed, b.filled, rate*100, b.threshold*100)
+		b.abort()
+	}
+}
+
+// Err returns the diagnostic once the breaker has tripped, or nil
+func (b *errorBreaker) Err() error {
+	if b == nil {
+		return nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.err
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ResponseCache caches DNS responses for the duration of a run
+type ResponseCache struct {
+	entries map[string]*cacheEntry
+	mutex   sync.RWMutex
+}
+
+// cacheEntry is a cached response and when it stops being valid
+type cacheEntry struct {
+	response *dns.Msg
+	resolver string
+	expires  time.Time
+	negative bool
+}
+
+// NewResponseCache creates a new response cache
+func NewResponseCache() *ResponseCache {
+	return &ResponseCache{
+		entries: make(map[string]*cacheEntry),
+	}
+}
+
+// Lookup returns a cached result for the domain and type, if still valid.
+// The second return value reports whether the hit was a negative answer.
+func (c *ResponseCache) Lookup(domain string, qtype uint16) (*DNSResult, bool) {
+	key := cacheKey(domain, qtype)
+
+	c.mutex.RLock()
+	entry, exists := c.entries[key]
+	c.mutex.RUnlock()
+
+	if !exists {
+		return nil, false
+	}
+
+	if time.Now().After(entry.expires) {
+		c.mutex.Lock()
+		delete(c.entries, key)
+		c.mutex.Unlock()
+		return nil, false
+	}
+
+	return &DNSResult{
+		Domain:   domain,
+		Type:     qtype,
+		Response: entry.response.Copy(),
+		Resolver: entry.resolver,
+	}, entry.negative
+}
+
+// Store caches a successful result. Positive answers are kept for the
+// lowest answer TTL and never cached when that TTL is zero. NXDOMAIN and
+// NODATA answers are cached for the SOA minimum from the authority
+// section (RFC 2308) and not at all without one.
+func (c *ResponseCache) Store(result *DNSResult) {
+	if result.Error != nil || result.Response == nil {
+		return
+	}
+
+	var ttl uint32
+	negative := false
+
+	switch {
+	case result.Response.Rcode == dns.RcodeSuccess && len(result.Response.Answer) > 0:
+		ttl = minAnswerTTL(result.Response.Answer)
+	case result.Response.Rcode == dns.RcodeNameError || result.Response.Rcode == dns.RcodeSuccess:
+		var ok bool
+		if ttl, ok = negativeTTL(result.Response); !ok {
+			return
+		}
+		negative = true
+	default:
+		return
+	}
+
+	if ttl == 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries[cacheKey(result.Domain, result.Type)] = &cacheEntry{
+		response: result.Response.Copy(),
+		resolver: result.Resolver,
+		expires:  time.Now().Add(time.Duration(ttl) * time.Second),
+		negative: negative,
+	}
+}
+
+// Size returns the number of cached entries
+func (c *ResponseCache) Size() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return len(c.entries)
+}
+
+// minAnswerTTL returns the lowest TTL among the answer records
+func minAnswerTTL(answers []dns.RR) uint32 {
+	ttl := answers[0].Header().Ttl
+	for _, rr := range answers[1:] {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
+
+// negativeTTL extracts the negative caching TTL from the SOA record in the
+// authority section, which is the lower of the SOA TTL and its minimum field
+func negativeTTL(response *dns.Msg) (uint32, bool) {
+	for _, rr := range response.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Minttl
+			if soa.Hdr.Ttl < ttl {
+				ttl = soa.Hdr.Ttl
+			}
+			return ttl, true
+		}
+	}
+	return 0, false
+}
+
+// cacheKey builds the cache key for a domain and query type
+func cacheKey(domain string, qtype uint16) string {
+	return fmt.Sprintf("%s/%d", strings.ToLower(dns.Fqdn(domain)), qtype)
+}
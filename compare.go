@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// Comparison is a lookup whose answers differ between the two resolver
+// sets of -compare-resolvers
+type Comparison struct {
+	Domain   string   `json:"domain"`
+	Type     string   `json:"type"`
+	RcodeA   string   `json:"rcode_a"`
+	RcodeB   string   `json:"rcode_b"`
+	AnswersA []string `json:"answers_a"`
+	AnswersB []string `json:"answers_b"`
+	OnlyA    []string `json:"only_a,omitempty"`
+	OnlyB    []string `json:"only_b,omitempty"`
+}
+
+// parseCompareFiles splits the -compare-resolvers value into its two
+// resolver files
+func parseCompareFiles(value string) ([2]string, error) {
+	var files [2]string
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return files, fmt.Errorf("expected two comma-separated resolver files, got %q", value)
+	}
+	for i, part := range parts {
+		files[i] = strings.TrimSpace(part)
+		if files[i] == "" {
+			return files, fmt.Errorf("empty resolver file in %q", value)
+		}
+	}
+	return files, nil
+}
+
+// newComparePool builds a resolver pool from one -compare-resolvers file
+// alone, ignoring -r, -rf and the other resolver sources. A file that
+// cannot be read is an error rather than a fall back to the defaults,
+// which would make the two sides meaningless.
+func newComparePool(ctx context.Context, file string, config *Config, logger *Logger) (*ResolverPool, error) {
+	addresses, err := loadResolversFromFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("%s contains no resolvers", file)
+	}
+
+	side := *config
+	side.Resolvers = strings.Join(addresses, ",")
+	side.ResolversFile = ""
+	side.SystemResolvers = false
+	side.UseDoHDefaults = false
+	side.NSMapFile = ""
+
+	pool, err := NewResolverPool(ctx, &side, logger)
+	if err != nil {
+		return nil, err
+	}
+	if pool.GetResolverCount() == 0 {
+		pool.Close()
+		return nil, fmt.Errorf("no working resolvers in %s", file)
+	}
+	return pool, nil
+}
+
+// runCompare queries every input domain against both resolver sets and
+// writes a record for each lookup whose rcode or answer data differ.
+// Lookups that fail on either side are logged and not compared.
+func runCompare(ctx context.Context, config *Config, outputHandler *OutputHandler, logger *Logger) error {
+	queryTypes, err := parseQueryTypes(config.QueryTypes)
+	if err != nil {
+		return fmt.Errorf("invalid query types: %v", err)
+	}
+	queryTypes = withoutTypes(queryTypes, config.excludedTypes)
+
+	var pools [2]*ResolverPool
+	for i, file := range config.compareFiles {
+		pool, err := newComparePool(ctx, file, config, logger)
+		if err != nil {
+			return fmt.Errorf("resolver set %s: %v", file, err)
+		}
+		defer pool.Close()
+		pools[i] = pool
+	}
+
+	input, err := setupInputReader(ctx, config.InputFile, config.FetchTimeout)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	reader := NewInputReader(input)
+	reader.logger = logger
+	domains, err := reader.ReadDomains()
+	if err != nil {
+		return err
+	}
+	domains = FilterDomains(domains, reader.validator)
+
+	rateLimiter := NewRateLimiter(config.QPS, config.Burst)
+
+	type lookup struct {
+		domain string
+		qtype  uint16
+	}
+	jobs := make(chan lookup, config.QueueSize)
+
+	var compared, diverged, failed int64
+	var workers sync.WaitGroup
+	for i := 0; i < config.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				var results [2]*DNSResult
+				for side, pool := range pools {
+					rateLimiter.Wait(ctx)
+					results[side] = performDNSQuery(ctx, job.domain, job.qtype, pool, config, logger)
+				}
+
+				if ctx.Err() != nil {
+					continue
+				}
+				if results[0].Error != nil || results[1].Error != nil {
+					atomic.AddInt64(&failed, 1)
+					logger.Warnf("Cannot compare %s %s: A: %v, B: %v", job.domain,
+						dns.TypeToString[job.qtype], results[0].Error, results[1].Error)
+					continue
+				}
+
+				atomic.AddInt64(&compared, 1)
+				if diff := compareResults(results[0], results[1]); diff != nil {
+					atomic.AddInt64(&diverged, 1)
+					outputHandler.WriteComparison(diff)
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, domain := range domains {
+		for _, qtype := range queryTypes {
+			select {
+			case jobs <- lookup{domain, qtype}:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+	}
+	close(jobs)
+	workers.Wait()
+
+	logger.Printf("Compared %d lookups: %d differ, %d failed", compared, diverged, failed)
+	return ctx.Err()
+}
+
+// compareResults returns the differences between two successful lookups
+// of the same name, or nil if both sides agree. Answers are compared by
+// record data only, so differing TTLs or record order don't count.
+func compareResults(a, b *DNSResult) *Comparison {
+	answersA := answerValues(a.Response, a.Type)
+	answersB := answerValues(b.Response, b.Type)
+	if a.Response.Rcode == b.Response.Rcode && sliceEqual(answersA, answersB) {
+		return nil
+	}
+
+	// Empty sides are written as [] rather than null
+	if answersA == nil {
+		answersA = []string{}
+	}
+	if answersB == nil {
+		answersB = []string{}
+	}
+
+	return &Comparison{
+		Domain:   a.Domain,
+		Type:     dns.TypeToString[a.Type],
+		RcodeA:   dns.RcodeToString[a.Response.Rcode],
+		RcodeB:   dns.RcodeToString[b.Response.Rcode],
+		AnswersA: answersA,
+		AnswersB: answersB,
+		OnlyA:    missingFrom(answersA, answersB),
+		OnlyB:    missingFrom(answersB, answersA),
+	}
+}
+
+// missingFrom returns the values of a that are not in b
+func missingFrom(a, b []string) []string {
+	present := make(map[string]bool, len(b))
+	for _, value := range b {
+		present[value] = true
+	}
+
+	var missing []string
+	for _, value := range a {
+		if !present[value] {
+			missing = append(missing, value)
+		}
+	}
+	return missing
+}
@@ -1,32 +1,251 @@
 package main
 
-import "github.com/miekg/dns"
+import (
+        "fmt"
+        "io"
+        "strings"
+        "time"
+
+        "github.com/miekg/dns"
+)
 
 // Config holds all configuration options for the DNS resolver
 type Config struct {
         // Input/Output options
-        InputFile    string
-        OutputFile   string
-        LogFile      string
-        OutputFormat string
+        InputFile         string        `json:"input_file"`
+        OutputFile        string        `json:"output_file"`
+        LogFile           string        `json:"log_file"`
+        LogLevel          string        `json:"log_level"`
+        LogJSON           bool          `json:"log_json"`
+        OutputFormat      string        `json:"output_format"`
+        SyslogAddr        string        `json:"syslog_addr"`
+        ESURL             string        `json:"es_url"`
+        ESIndex           string        `json:"es_index"`
+        ESBatchSize       int           `json:"es_batch_size"`
+        ESFlushInterval   time.Duration `json:"es_flush_interval"`
+        BatchSize         int           `json:"batch_size"`
+        CSVDelimiter      string        `json:"csv_delimiter"`
+        ProgressFD        int           `json:"progress_fd"`
+        RotateSize        string        `json:"rotate_size"`
+        RotateCount       int           `json:"rotate_count"`
+        ResolverStatsFile string        `json:"resolver_stats_file"`
+        Fields            string        `json:"fields"`
+        RawOutputDir      string        `json:"raw_output_dir"`
+        FetchTimeout      time.Duration `json:"fetch_timeout"`
+        QueryLog          string        `json:"query_log"`
+        Manifest          string        `json:"manifest"`
         
         // DNS resolver options
-        Resolvers     string
-        ResolversFile string
-        QueryTypes    string
+        Resolvers          string     `json:"resolvers"`
+        ResolversFile      string     `json:"resolvers_file"`
+        QueryTypes         string     `json:"query_types"`
+        ExcludeTypes       string     `json:"exclude_types"`
+        TypeStrategy       string     `json:"type_strategy"`
+        EDNSOptions        stringList `json:"edns_options"`
+        EDNSVersion        int        `json:"edns_version"`
+        EDNSZ              int        `json:"edns_z"`
+        TestDomain         string     `json:"test_domain"`
+        Proxy              string     `json:"proxy"`
+        Port               int        `json:"port"`
+        TransportOrder     string     `json:"transport_order"`
+        RetryOn            string     `json:"retry_on"`
+        UseDoHDefaults     bool       `json:"use_doh_defaults"`
+        SystemResolvers    bool       `json:"system_resolvers"`
+        NoDefaultResolvers bool       `json:"no_default_resolvers"`
+        NSMapFile          string     `json:"ns_map_file"`
+        CompareResolvers   string     `json:"compare_resolvers"`
+        Search             string     `json:"search"`
+        
+        // Brute-force options
+        Wordlist       string `json:"wordlist"`
+        Brute          bool   `json:"brute"`
+        RecursiveBrute int    `json:"recursive_brute"`
+        MaxQueries     int    `json:"max_queries"`
+        
+        // Scope options
+        AllowlistFile string `json:"allowlist_file"`
+        DenylistFile  string `json:"denylist_file"`
         
         // Performance options
-        QPS      int
-        Timeout  int
-        Retries  int
-        Workers  int
+        QPS                 int           `json:"qps"`
+        MaxBPS              string        `json:"max_bps"`
+        Burst               int           `json:"burst"`
+        Timeout             int           `json:"timeout"`
+        ResolverTestTimeout int           `json:"resolver_test_timeout"`
+        Retries             int           `json:"retries"`
+        AbortErrorRate      float64       `json:"abort_error_rate"`
+        AbortSample         int           `json:"abort_sample"`
+        Workers             int           `json:"workers"`
+        AutoWorkers         bool          `json:"auto_workers"`
+        MinWorkers          int           `json:"min_workers"`
+        MaxWorkers          int           `json:"max_workers"`
+        PerResolverConc     int           `json:"per_resolver_conc"`
+        QueueSize           int           `json:"queue_size"`
+        ResultBuffer        int           `json:"result_buffer"`
+        MaxRuntime          time.Duration `json:"max_runtime"`
+        RandomizeWindow     int           `json:"randomize_window"`
+        Sample              int           `json:"sample"`
+        SpillAfter          int           `json:"spill_after"`
+        HedgeDelay          time.Duration `json:"hedge_delay"`
+        Jitter              time.Duration `json:"jitter"`
+        ProbeCount          int           `json:"probe_count"`
+        FastFluxThreshold   float64       `json:"fast_flux_threshold"`
+        DomainDeadline      time.Duration `json:"domain_deadline"`
+        Warmup              time.Duration `json:"warmup"`
+        InconsistencyWindow time.Duration `json:"inconsistency_window"`
+        RefusedCooldown     time.Duration `json:"refused_cooldown"`
+        LowMemory           bool          `json:"low_memory"`
         
         // Feature flags
-        WildcardDetection bool
-        Verbose           bool
-        Help              bool
-        Version           bool
-        Quiet             bool
+        WildcardDetection   bool `json:"wildcard_detection"`
+        WildcardStrict      bool `json:"wildcard_strict"`
+        InlineWildcard      bool `json:"inline_wildcard"`
+        FastFlux            bool `json:"fast_flux"`
+        Verbose             bool `json:"verbose"`
+        Help                bool `json:"help"`
+        Version             bool `json:"version"`
+        Quiet               bool `json:"quiet"`
+        SkipResolverTest    bool `json:"skip_resolver_test"`
+        ShuffleResolvers    bool `json:"shuffle_resolvers"`
+        NoRecurse           bool `json:"no_recurse"`
+        QnameMinimization   bool `json:"qname_minimization"`
+        Cache               bool `json:"cache"`
+        FirstMatch          bool `json:"first_match"`
+        Syslog              bool `json:"syslog"`
+        DetectDangling      bool `json:"detect_dangling"`
+        CheckLame           bool `json:"check_lame"`
+        DetectInconsistency bool `json:"detect_inconsistency"`
+        Normalize           bool `json:"normalize"`
+        Cookies             bool `json:"cookies"`
+        ShowResolver        bool `json:"show_resolver"`
+        Prefilter           bool `json:"prefilter"`
+        Count               bool `json:"count"`
+        GroupByAnswer       bool `json:"group_by_answer"`
+        ASN                 bool `json:"asn"`
+        ValidateOnly        bool `json:"validate_only"`
+        CheckOpen           bool `json:"check_open"`
+        REPL                bool `json:"repl"`
+        RandomizeInput      bool `json:"randomize_input"`
+        MergeFamilies       bool `json:"merge_families"`
+        CSVRecordCount      bool `json:"csv_record_count"`
+        ResolverStats       bool `json:"resolver_stats"`
+        TXTConcat           bool `json:"txt_concat"`
+        JSONPretty          bool `json:"json_pretty"`
+        EmitNXDomain        bool `json:"emit_nxdomain"`
+        Timestamp           bool `json:"timestamp"`
+        SortAnswers         bool `json:"sort_answers"`
+        PTRAddress          bool `json:"ptr_address"`
+        RequireFinalType    bool `json:"require_final_type"`
+        CheckingDisabled    bool `json:"checking_disabled"`
+        
+        // Parsed at startup from the string and numeric options above
+        ednsOptions       []dns.EDNS0
+        csvComma          rune
+        progressOut       io.Writer
+        transportOrder    []string
+        retryOn           map[string]bool
+        
+        // plainQuery is set on the copy used to retry without EDNS
+        plainQuery bool
+        rotateBytes       int64
+        outputFields      []outputField
+        logLevel          logLevel
+        maxBytesPerSecond int64
+        compareFiles      [2]string
+        searchDomains     []string
+        excludedTypes     []uint16
+        outputSinks       []outputSink
+        queryLog          *queryLog
+}
+
+// Outcomes that -retry-on can retry
+const (
+        retryOnTimeout  = "timeout"
+        retryOnError    = "error"
+        retryOnServfail = "servfail"
+        retryOnRefused  = "refused"
+        retryOnEmpty    = "empty"
+)
+
+// defaultRetryOn retries failed exchanges only, not answers
+const defaultRetryOn = retryOnTimeout + "," + retryOnError
+
+// Values of -type-strategy
+const (
+        typeStrategyAll          = "all"
+        typeStrategyFirstSuccess = "first-success"
+        typeStrategyPriority     = "priority"
+)
+
+// outputFormats lists the formats accepted by -f and -o format:path
+var outputFormats = []string{"simple", "json", "json-grouped", "csv", "hosts"}
+
+// outputSink is one format:path pair given to -o. An empty path is stdout.
+type outputSink struct {
+        format string
+        path   string
+}
+
+// parseOutputSinks parses a comma-separated list of format:path pairs,
+// with - as the path for stdout
+func parseOutputSinks(value string) ([]outputSink, error) {
+        var sinks []outputSink
+        for _, pair := range strings.Split(value, ",") {
+                format, path, ok := strings.Cut(strings.TrimSpace(pair), ":")
+                if !ok || !isOutputFormat(format) || path == "" {
+                        return nil, fmt.Errorf("%q is not a format:path pair (formats: %s)", pair, strings.Join(outputFormats, ", "))
+                }
+                if path == "-" {
+                        path = ""
+                }
+                sinks = append(sinks, outputSink{format: format, path: path})
+        }
+        return sinks, nil
+}
+
+// isOutputSinkList reports whether an -o value is a list of format:path
+// pairs rather than a single file name
+func isOutputSinkList(value string) bool {
+        format, _, ok := strings.Cut(value, ":")
+        return ok && isOutputFormat(format)
+}
+
+// isOutputFormat reports whether format is a known output format
+func isOutputFormat(format string) bool {
+        for _, known := range outputFormats {
+                if format == known {
+                        return true
+                }
+        }
+        return false
+}
+
+// writesFormat reports whether any output is written in format, counting
+// every -o format:path pair
+func (c *Config) writesFormat(format string) bool {
+        if len(c.outputSinks) == 0 {
+                return c.OutputFormat == format
+        }
+        for _, sink := range c.outputSinks {
+                if sink.format == format {
+                        return true
+                }
+        }
+        return false
+}
+
+// stringList is a flag value that collects every occurrence of a repeatable flag
+type stringList []string
+
+// String returns the collected values joined by commas
+func (s *stringList) String() string {
+        return strings.Join(*s, ",")
+}
+
+// Set appends a value each time the flag is given
+func (s *stringList) Set(value string) error {
+        *s = append(*s, value)
+        return nil
 }
 
 // DNSResult represents the result of a DNS query
@@ -36,6 +255,33 @@ type DNSResult struct {
         Response *dns.Msg
         Error    error
         Resolver string
+        Latency  time.Duration
+        Dangling bool
+        Wildcard bool
+        EDE      *ExtendedError
+        
+        // Lame maps each nameserver of an NS answer, lowercased and fully
+        // qualified, to whether it failed the -check-lame SOA query
+        Lame map[string]bool
+        
+        // CNAMEOnly is set with -require-final-type when the answer has
+        // aliases but no record of the queried type
+        CNAMEOnly bool
+        
+        // Inconsistent is set with -detect-inconsistency when the resolver
+        // answered the same lookup differently shortly before
+        Inconsistent bool
+        
+        // EDNSFallback is set when the server rejected EDNS with FORMERR
+        // and the answer came from a retry without an OPT record
+        EDNSFallback bool
+        
+        // Answer churn across -probe-count queries, set with -fastflux
+        FastFluxScore *float64
+        FastFlux      bool
+        
+        // Annotations holds enrichment added by result processors
+        Annotations map[string]string
 }
 
 // GetDefaultResolvers returns a list of popular public DNS resolvers
@@ -57,3 +303,12 @@ func GetDefaultResolvers() []string {
                 "94.140.15.15:53",   // AdGuard DNS
         }
 }
+
+// GetDefaultDoHResolvers returns a list of popular public DNS over HTTPS endpoints
+func GetDefaultDoHResolvers() []string {
+        return []string{
+                "https://cloudflare-dns.com/dns-query", // Cloudflare DNS
+                "https://dns.google/dns-query",         // Google DNS
+                "https://dns.quad9.net/dns-query",      // Quad9 DNS
+        }
+}
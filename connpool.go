@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxIdleConns bounds the idle TCP connections kept per resolver
+	maxIdleConns = 4
+	// defaultTCPIdleTimeout is how long an idle connection is kept when the
+	// server does not announce an EDNS TCP keepalive timeout
+	defaultTCPIdleTimeout = 10 * time.Second
+)
+
+// idleConn is a TCP or TLS connection waiting to be reused
+type idleConn struct {
+	conn    *dns.Conn
+	expires time.Time
+}
+
+// connPool keeps idle TCP and TLS connections to one resolver so following
+// queries can reuse them (RFC 7766), honouring the server's EDNS TCP
+// keepalive timeout (RFC 7828)
+type connPool struct {
+	idle  []*idleConn
+	mutex sync.Mutex
+
+	opened int64
+	reused int64
+}
+
+// get returns an idle connection that has not expired, or nil
+func (p *connPool) get() *dns.Conn {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	for len(p.idle) > 0 {
+		last := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+
+		if now.Before(last.expires) {
+			return last.conn
+		}
+		last.conn.Close()
+	}
+
+	return nil
+}
+
+// put keeps a connection for reuse for the idle timeout the server asked
+// for in response, closing it if the server wants it closed or the pool is full
+func (p *connPool) put(conn *dns.Conn, response *dns.Msg) {
+	timeout := keepaliveTimeout(response)
+	if timeout <= 0 {
+		conn.Close()
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.idle) >= maxIdleConns {
+		conn.Close()
+		return
+	}
+
+	p.idle = append(p.idle, &idleConn{
+		conn:    conn,
+		expires: time.Now().Add(timeout),
+	})
+}
+
+// close closes every idle connection
+func (p *connPool) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, idle := range p.idle {
+		idle.conn.Close()
+	}
+	p.idle = nil
+}
+
+// keepaliveTimeout returns the idle timeout announced by the server in an
+// EDNS TCP keepalive option, or the default when there is none
+func keepaliveTimeout(response *dns.Msg) time.Duration {
+	opt := response.IsEdns0()
+	if opt == nil {
+		return defaultTCPIdleTimeout
+	}
+
+	for _, option := range opt.Option {
+		if keepalive, ok := option.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+			// Sent in units of 100 milliseconds; zero asks us to close
+			return time.Duration(keepalive.Timeout) * 100 * time.Millisecond
+		}
+	}
+
+	return defaultTCPIdleTimeout
+}
+
+// requestKeepalive adds an empty EDNS TCP keepalive option to msg so the
+// server tells us how long it will keep the connection open
+func requestKeepalive(msg *dns.Msg) {
+	opt := ednsOPT(msg)
+	for _, option := range opt.Option {
+		if option.Option() == dns.EDNS0TCPKEEPALIVE {
+			return
+		}
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+}
+
+// plainQueryKey marks a context whose queries must go out without an OPT
+// record, so no keepalive option is added to them
+type plainQueryKey struct{}
+
+// withoutKeepalive returns ctx marked so exchangeTCP leaves msg as it is
+func withoutKeepalive(ctx context.Context) context.Context {
+	return context.WithValue(ctx, plainQueryKey{}, true)
+}
+
+// exchangeTCP sends msg over a reused or new TCP/TLS connection. A reused
+// connection the server has since closed is retried once on a fresh one.
+func (r *DNSResolver) exchangeTCP(ctx context.Context, msg *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	if ctx.Value(plainQueryKey{}) == nil {
+		requestKeepalive(msg)
+	}
+
+	if conn := r.conns.get(); conn != nil {
+		response, rtt, err := r.exchangeConn(ctx, msg, conn)
+		if err == nil {
+			atomic.AddInt64(&r.conns.reused, 1)
+			r.conns.put(conn, response)
+			return response, rtt, nil
+		}
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, rtt, err
+		}
+	}
+
+	conn, err := r.dial(ctx, address)
+	if err != nil {
+		return nil, 0, err
+	}
+	atomic.AddInt64(&r.conns.opened, 1)
+
+	response, rtt, err := r.exchangeConn(ctx, msg, conn)
+	if err != nil {
+		conn.Close()
+		return nil, rtt, err
+	}
+
+	r.conns.put(conn, response)
+	return response, rtt, nil
+}
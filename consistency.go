@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultInconsistencyWindow is how long -detect-inconsistency compares a
+// resolver's answer against the one it gave before
+const defaultInconsistencyWindow = time.Minute
+
+// consistencyTracker remembers the last answer each resolver gave for a
+// name and type, for -detect-inconsistency. Unlike -compare-resolvers it
+// compares a resolver only against itself, which catches load-balanced
+// backends serving different data and answers changed by cache poisoning.
+type consistencyTracker struct {
+	window    time.Duration
+	entries   map[string]*observedAnswer
+	lastSweep time.Time
+	mutex     sync.Mutex
+	logger    *Logger
+}
+
+// observedAnswer is the last answer seen from one resolver for one lookup
+type observedAnswer struct {
+	answer string
+	seen   time.Time
+}
+
+// newConsistencyTracker creates a tracker comparing answers seen within window
+func newConsistencyTracker(window time.Duration, logger *Logger) *consistencyTracker {
+	return &consistencyTracker{
+		window:    window,
+		entries:   make(map[string]*observedAnswer),
+		lastSweep: time.Now(),
+		logger:    logger,
+	}
+}
+
+// Observe records the answer in result and sets result.Inconsistent when
+// the same resolver answered the same lookup differently within the
+// window. Failed queries are not recorded, and a nil tracker does nothing.
+func (t *consistencyTracker) Observe(result *DNSResult) {
+	if t == nil || result.Error != nil || result.Response == nil {
+		return
+	}
+
+	key := result.Resolver + "|" + cacheKey(result.Domain, result.Type)
+	answer := answerSignature(result.Response)
+	now := time.Now()
+
+	t.mutex.Lock()
+	previous := t.entries[key]
+	t.entries[key] = &observedAnswer{answer: answer, seen: now}
+	if now.Sub(t.lastSweep) > t.window {
+		t.sweep(now)
+	}
+	t.mutex.Unlock()
+
+	if previous == nil || now.Sub(previous.seen) > t.window || previous.answer == answer {
+		return
+	}
+
+	result.Inconsistent = true
+	if t.logger != nil {
+		t.logger.Warnf("Inconsistent answers from %s for %s %s within %v: [%s] then [%s]",
+			result.Resolver, result.Domain, dns.TypeToString[result.Type],
+			now.Sub(previous.seen).Truncate(time.Millisecond), previous.answer, answer)
+	}
+}
+
+// sweep forgets the answers too old to be compared against, so the tracker
+// holds no more than a window's worth of lookups. It is called at most once
+// per window, with the mutex held.
+func (t *consistencyTracker) sweep(now time.Time) {
+	for key, entry := range t.entries {
+		if now.Sub(entry.seen) > t.window {
+			delete(t.entries, key)
+		}
+	}
+	t.lastSweep = now
+}
+
+// answerSignature describes a response by its rcode and the sorted data of
+// its answer records, ignoring TTLs and record order
+func answerSignature(response *dns.Msg) string {
+	values := make([]string, 0, len(response.Answer))
+	for _, rr := range response.Answer {
+		data := strings.TrimPrefix(rr.String(), rr.Header().String())
+		values = append(values, fmt.Sprintf("%s %s", dns.TypeToString[rr.Header().Rrtype], data))
+	}
+	sort.Strings(values)
+
+	return dns.RcodeToString[response.Rcode] + " " + strings.Join(values, ", ")
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestConsistencyTrackerSweeps(t *testing.T) {
+	tracker := newConsistencyTracker(10*time.Millisecond, nil)
+	for i := 0; i < 100; i++ {
+		domain := fmt.Sprintf("%d.example", i)
+		tracker.Observe(answerResult(t, domain, dns.TypeA, domain+". 300 IN A 192.0.2.1"))
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	tracker.Observe(answerResult(t, "new.example", dns.TypeA, "new.example. 300 IN A 192.0.2.1"))
+
+	if n := len(tracker.entries); n != 1 {
+		t.Errorf("tracker holds %d entries after the window, want 1", n)
+	}
+}
+
+func TestConsistencyTrackerFlagsChange(t *testing.T) {
+	tracker := newConsistencyTracker(time.Minute, nil)
+	tracker.Observe(answerResult(t, "example.com", dns.TypeA, "example.com. 300 IN A 192.0.2.1"))
+
+	result := answerResult(t, "example.com", dns.TypeA, "example.com. 300 IN A 192.0.2.2")
+	tracker.Observe(result)
+	if !result.Inconsistent {
+		t.Errorf("changed answer not flagged as inconsistent")
+	}
+}
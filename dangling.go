@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// takeoverProneSuffixes lists hosting services where a CNAME to an
+// unclaimed resource can be registered by a third party
+var takeoverProneSuffixes = []string{
+	".amazonaws.com.",
+	".azurewebsites.net.",
+	".blob.core.windows.net.",
+	".cloudapp.net.",
+	".cloudapp.azure.com.",
+	".trafficmanager.net.",
+	".azureedge.net.",
+	".herokuapp.com.",
+	".herokudns.com.",
+	".github.io.",
+	".bitbucket.io.",
+	".pantheonsite.io.",
+	".ghost.io.",
+	".myshopify.com.",
+	".zendesk.com.",
+	".surge.sh.",
+	".netlify.app.",
+	".fly.dev.",
+	".readme.io.",
+	".wordpress.com.",
+	".unbouncepages.com.",
+	".helpscoutdocs.com.",
+}
+
+// checkDangling flags a result whose CNAME chain ends at a name that does
+// not exist, or at a takeover-prone service that has nothing behind it.
+// lookup is used to resolve the target when the response doesn't settle it.
+func checkDangling(result *DNSResult, lookup func(string, uint16) *DNSResult, logger *Logger) {
+	if result.Error != nil || result.Response == nil {
+		return
+	}
+
+	target := cnameTarget(result.Response)
+	if target == "" {
+		return
+	}
+
+	switch {
+	case result.Response.Rcode == dns.RcodeNameError:
+		// The resolver already followed the chain into NXDOMAIN
+		result.Dangling = true
+	case hasAddressRecord(result.Response.Answer):
+		return
+	default:
+		check := lookup(target, dns.TypeA)
+		if check.Error != nil || check.Response == nil {
+			return
+		}
+
+		switch {
+		case check.Response.Rcode == dns.RcodeNameError:
+			result.Dangling = true
+		case isTakeoverProne(target) && len(check.Response.Answer) == 0:
+			result.Dangling = true
+		}
+	}
+
+	if result.Dangling && logger != nil {
+		logger.Printf("Dangling CNAME detected: %s -> %s", result.Domain, target)
+	}
+}
+
+// cnameTarget returns the final target of the CNAME chain in a response
+func cnameTarget(response *dns.Msg) string {
+	target := ""
+	for _, rr := range response.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			target = strings.ToLower(cname.Target)
+		}
+	}
+	return target
+}
+
+// hasAddressRecord reports whether any record is an A or AAAA record
+func hasAddressRecord(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		switch rr.(type) {
+		case *dns.A, *dns.AAAA:
+			return true
+		}
+	}
+	return false
+}
+
+// isTakeoverProne reports whether a name belongs to a takeover-prone service
+func isTakeoverProne(name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	for _, suffix := range takeoverProneSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
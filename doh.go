@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/proxy"
+)
+
+// dohMediaType is the wire-format media type for DNS over HTTPS (RFC 8484)
+const dohMediaType = "application/dns-message"
+
+// maxDoHResponseSize bounds how much of a DoH response body is read
+const maxDoHResponseSize = 65535
+
+// newDoHClient creates the HTTP client used for a DNS over HTTPS resolver,
+// dialing through the SOCKS5 proxy when one is configured
+func newDoHClient(timeout time.Duration, dialer proxy.ContextDialer) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if dialer != nil {
+		transport.Proxy = nil
+		transport.DialContext = dialer.DialContext
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
+}
+
+// parseDoHAddress validates a DoH endpoint URL, defaulting the path to
+// /dns-query when none is given
+func parseDoHAddress(address string) (string, error) {
+	u, err := url.Parse("https://" + address)
+	if err != nil {
+		return "", err
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("missing host")
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/dns-query"
+	}
+	return u.String(), nil
+}
+
+// exchangeDoH sends msg as an HTTP POST to a DoH endpoint. The message ID is
+// zeroed on the wire as RFC 8484 recommends and restored on the response.
+func (r *DNSResolver) exchangeDoH(ctx context.Context, msg *dns.Msg, endpoint string) (*dns.Msg, time.Duration, error) {
+	id := msg.Id
+	msg.Id = 0
+	packed, err := msg.Pack()
+	msg.Id = id
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+
+	start := time.Now()
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDoHResponseSize))
+	rtt := time.Since(start)
+	if err != nil {
+		return nil, rtt, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, rtt, fmt.Errorf("DoH server returned HTTP %d", resp.StatusCode)
+	}
+
+	response := &dns.Msg{}
+	if err := response.Unpack(body); err != nil {
+		return nil, rtt, fmt.Errorf("invalid DoH response: %v", err)
+	}
+	response.Id = id
+
+	return response, rtt, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// ExtendedError is an Extended DNS Error returned by a resolver (RFC 8914)
+type ExtendedError struct {
+	Code uint16 `json:"code"`
+	Name string `json:"name"`
+	Text string `json:"text,omitempty"`
+}
+
+// String formats the error as "15 (Blocked): text"
+func (e *ExtendedError) String() string {
+	if e.Text == "" {
+		return fmt.Sprintf("%d (%s)", e.Code, e.Name)
+	}
+	return fmt.Sprintf("%d (%s): %s", e.Code, e.Name, e.Text)
+}
+
+// extractEDE returns the first Extended DNS Error option in response, or nil
+func extractEDE(response *dns.Msg) *ExtendedError {
+	if response == nil {
+		return nil
+	}
+
+	opt := response.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, option := range opt.Option {
+		if ede, ok := option.(*dns.EDNS0_EDE); ok {
+			name, known := dns.ExtendedErrorCodeToString[ede.InfoCode]
+			if !known {
+				name = "Unknown"
+			}
+			return &ExtendedError{
+				Code: ede.InfoCode,
+				Name: name,
+				Text: ede.ExtraText,
+			}
+		}
+	}
+
+	return nil
+}
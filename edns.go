@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ednsOPT returns the OPT record of msg, adding one if it has none
+func ednsOPT(msg *dns.Msg) *dns.OPT {
+	if opt := msg.IsEdns0(); opt != nil {
+		return opt
+	}
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	return msg.IsEdns0()
+}
+
+// withoutEDNS returns a copy of config whose queries carry no OPT record,
+// not even the TCP keepalive option, for retrying servers that reject EDNS
+func withoutEDNS(config *Config) *Config {
+	plain := *config
+	plain.ednsOptions = nil
+	plain.EDNSVersion = 0
+	plain.EDNSZ = 0
+	plain.Cookies = false
+	plain.plainQuery = true
+	return &plain
+}
+
+// parseEDNSOptions parses CODE:HEXDATA specifications into EDNS0 options
+func parseEDNSOptions(specs []string) ([]dns.EDNS0, error) {
+	var options []dns.EDNS0
+
+	for _, spec := range specs {
+		codeStr, dataStr, found := strings.Cut(spec, ":")
+		if !found {
+			return nil, fmt.Errorf("%q is not in CODE:HEXDATA form", spec)
+		}
+
+		code, err := strconv.ParseUint(strings.TrimSpace(codeStr), 10, 16)
+		if err != nil || code == 0 {
+			return nil, fmt.Errorf("option code %q must be between 1 and 65535", codeStr)
+		}
+
+		dataStr = strings.TrimPrefix(strings.TrimSpace(dataStr), "0x")
+		data, err := hex.DecodeString(dataStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex data for option %d: %v", code, err)
+		}
+
+		options = append(options, &dns.EDNS0_LOCAL{
+			Code: uint16(code),
+			Data: data,
+		})
+	}
+
+	return options, nil
+}
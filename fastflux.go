@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+
+	"github.com/miekg/dns"
+)
+
+// fastFluxScore measures how much the address set of a name changes
+// between consecutive probes. For each pair of consecutive probes it takes
+// the Jaccard similarity of the two sets (shared addresses divided by all
+// addresses seen in either), and the score is one minus the mean of those
+// similarities:
+//
+//	0    every probe returned the same set, in any order
+//	0.5  consecutive probes share about half their addresses
+//	1    no probe shared any address with the one before it
+//
+// Plain round-robin that reorders a fixed set scores 0. Load balancers
+// that hand out a small slice of a large pool also score high, so the
+// score is a heuristic to triage, not proof of fast-flux.
+func fastFluxScore(sets []map[string]bool) float64 {
+	if len(sets) < 2 {
+		return 0
+	}
+
+	total := 0.0
+	for i := 1; i < len(sets); i++ {
+		total += jaccard(sets[i-1], sets[i])
+	}
+	score := 1 - total/float64(len(sets)-1)
+
+	// Three decimals are plenty for a threshold and keep the output stable
+	return math.Round(score*1000) / 1000
+}
+
+// jaccard returns the Jaccard similarity of two address sets, treating two
+// empty sets as identical
+func jaccard(a, b map[string]bool) float64 {
+	shared := 0
+	for address := range a {
+		if b[address] {
+			shared++
+		}
+	}
+
+	union := len(a) + len(b) - shared
+	if union == 0 {
+		return 1
+	}
+	return float64(shared) / float64(union)
+}
+
+// addressSet returns the canonical A and AAAA addresses in a response
+func addressSet(response *dns.Msg) map[string]bool {
+	set := make(map[string]bool)
+	for _, rr := range response.Answer {
+		switch r := rr.(type) {
+		case *dns.A:
+			set[r.A.String()] = true
+		case *dns.AAAA:
+			set[r.AAAA.String()] = true
+		}
+	}
+	return set
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// isURL reports whether an input or wordlist name is an http(s) URL
+func isURL(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// openURL starts a GET of a domain or word list and returns the response
+// body for streaming. timeout bounds connecting and receiving the headers
+// only, so a long list can be read as slowly as the queries consume it;
+// reading stops when ctx is cancelled. Redirects are followed.
+func openURL(ctx context.Context, url string, timeout time.Duration) (io.ReadCloser, error) {
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: timeout}).DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+	}
+	client := &http.Client{Transport: transport}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	if err := checkListContentType(resp.Header.Get("Content-Type")); err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %v", url, err)
+	}
+
+	return resp.Body, nil
+}
+
+// checkListContentType loosely accepts anything that could be a plain
+// list: no type, any text type but HTML, or generic binary. HTML is
+// rejected since it is almost always an error or login page.
+func checkListContentType(contentType string) error {
+	if contentType == "" {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+
+	switch {
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		return fmt.Errorf("content type %s looks like a web page, not a list", mediaType)
+	case strings.HasPrefix(mediaType, "text/"), mediaType == "application/octet-stream":
+		return nil
+	default:
+		return fmt.Errorf("unexpected content type %s", mediaType)
+	}
+}
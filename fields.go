@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// outputField is a selectable OutputRecord column for -fields
+type outputField struct {
+	name   string
+	header string
+	value  func(record *OutputRecord) interface{}
+}
+
+// outputFields lists the selectable fields in their default order
+var outputFields = []outputField{
+	{"domain", "Domain", func(r *OutputRecord) interface{} { return r.Domain }},
+	{"type", "Type", func(r *OutputRecord) interface{} { return r.Type }},
+	{"query_type", "QueryType", func(r *OutputRecord) interface{} { return r.QueryType }},
+	{"record", "Record", func(r *OutputRecord) interface{} { return r.Record }},
+	{"value", "Value", func(r *OutputRecord) interface{} { return r.Value }},
+	{"ttl", "TTL", func(r *OutputRecord) interface{} { return r.TTL }},
+	{"resolver", "Resolver", func(r *OutputRecord) interface{} { return r.Resolver }},
+	{"status", "Status", func(r *OutputRecord) interface{} { return r.Status }},
+	{"observed_at", "ObservedAt", func(r *OutputRecord) interface{} { return r.ObservedAt }},
+}
+
+// parseOutputFields parses a comma-separated -fields list, keeping the
+// given order and rejecting unknown or repeated names
+func parseOutputFields(spec string) ([]outputField, error) {
+	var fields []outputField
+	seen := make(map[string]bool)
+
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("field %q given more than once", name)
+		}
+
+		found := false
+		for _, field := range outputFields {
+			if field.name == name {
+				fields = append(fields, field)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown field %q (valid: %s)", name, outputFieldNames())
+		}
+		seen[name] = true
+	}
+
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no fields given")
+	}
+	return fields, nil
+}
+
+// outputFieldNames returns the valid -fields names for error messages
+func outputFieldNames() string {
+	names := make([]string, len(outputFields))
+	for i, field := range outputFields {
+		names[i] = field.name
+	}
+	return strings.Join(names, ",")
+}
+
+// fieldHeaders returns the CSV header for the selected fields
+func fieldHeaders(fields []outputField) []string {
+	headers := make([]string, len(fields))
+	for i, field := range fields {
+		headers[i] = field.header
+	}
+	return headers
+}
+
+// fieldRow returns a CSV row with the selected fields of record
+func fieldRow(fields []outputField, record *OutputRecord) []string {
+	row := make([]string, len(fields))
+	for i, field := range fields {
+		row[i] = fmt.Sprint(field.value(record))
+	}
+	return row
+}
+
+// marshalFields encodes the selected fields of record as a JSON object,
+// with keys in the order they were selected. schema_version always comes
+// first so consumers can tell the layout of any record.
+func marshalFields(fields []outputField, record *OutputRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "{\"schema_version\":%d", record.SchemaVersion)
+	for _, field := range fields {
+		buf.WriteByte(',')
+		value, err := json.Marshal(field.value(record))
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "%q:%s", field.name, value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
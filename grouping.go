@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// answerGroups collects the domains that resolved to each distinct address
+// set, so subdomains served by the same infrastructure can be reported
+// together. Memberships go through a spillSorter, so memory stays bounded
+// by the largest group rather than the number of domains.
+type answerGroups struct {
+	members *spillSorter
+	limit   int
+	mutex   sync.Mutex
+}
+
+// answerGroup is one address set and the domains that share it
+type answerGroup struct {
+	Type      string
+	Addresses []string
+	Domains   []string
+}
+
+// newAnswerGroups creates an empty answer grouping holding up to limit
+// memberships in memory
+func newAnswerGroups(limit int) *answerGroups {
+	return &answerGroups{
+		members: newSpillSorter(limit),
+		limit:   limit,
+	}
+}
+
+// Add records the address set of a result under its domain. Results without
+// A or AAAA answers are ignored.
+func (g *answerGroups) Add(result *DNSResult) error {
+	var addresses []string
+	for _, rr := range result.Response.Answer {
+		switch r := rr.(type) {
+		case *dns.A:
+			addresses = append(addresses, r.A.String())
+		case *dns.AAAA:
+			addresses = append(addresses, r.AAAA.String())
+		}
+	}
+	if len(addresses) == 0 {
+		return nil
+	}
+	sort.Strings(addresses)
+
+	key := dns.TypeToString[result.Type] + " " + strings.Join(addresses, ",")
+	domain := strings.ToLower(strings.TrimSuffix(result.Domain, "."))
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.members.Add(key + "\t" + domain)
+}
+
+// Each calls fn for every address set shared by at least two domains,
+// largest first, and empties the grouping
+func (g *answerGroups) Each(fn func(answerGroup)) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	// Memberships sort by address set and then domain, so each group is a
+	// run of lines and repeated domains are adjacent. Shared groups are
+	// re-sorted by size, larger first, then by address.
+	shared := newSpillSorter(g.limit)
+	defer shared.Close()
+
+	var key string
+	var domains []string
+	flush := func() error {
+		if len(domains) < 2 {
+			return nil
+		}
+		qtype, addresses, _ := strings.Cut(key, " ")
+		return shared.Add(fmt.Sprintf("%020d\t%s\t%s\t%s",
+			math.MaxInt64-int64(len(domains)), addresses, qtype, strings.Join(domains, ",")))
+	}
+
+	err := g.members.Each(func(line string) error {
+		lineKey, domain, _ := strings.Cut(line, "\t")
+		if lineKey != key {
+			if err := flush(); err != nil {
+				return err
+			}
+			key, domains = lineKey, nil
+		}
+		if len(domains) == 0 || domains[len(domains)-1] != domain {
+			domains = append(domains, domain)
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	return shared.Each(func(line string) error {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 {
+			return fmt.Errorf("malformed answer group %q", line)
+		}
+		fn(answerGroup{
+			Type:      fields[2],
+			Addresses: strings.Split(fields[1], ","),
+			Domains:   strings.Split(fields[3], ","),
+		})
+		return nil
+	})
+}
+
+// PrintReport logs every shared address set with the domains behind it
+func (g *answerGroups) PrintReport(logger *Logger) {
+	logger.Infof("=== Shared Answer Sets ===")
+
+	shared := 0
+	err := g.Each(func(group answerGroup) {
+		shared++
+		logger.Infof("%s %s (%d domains): %s", group.Type, strings.Join(group.Addresses, ","),
+			len(group.Domains), strings.Join(group.Domains, ", "))
+	})
+	if err != nil {
+		logger.Errorf("Failed to group answers: %v", err)
+		return
+	}
+	if shared == 0 {
+		logger.Infof("No address sets are shared by more than one domain")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
+)
+
+// checkInlineWildcard flags a result as a wildcard answer when a random
+// sibling name in the same zone resolves to the same records. Unlike the
+// WildcardDetector, which caches one verdict per base domain, this checks
+// every name against its own parent zone. lookup sends the control query.
+func checkInlineWildcard(result *DNSResult, lookup func(string, uint16) *DNSResult) {
+	if !hasAnswer(result) {
+		return
+	}
+
+	control := controlName(result.Domain)
+	if control == "" {
+		return
+	}
+
+	check := lookup(control, result.Type)
+	if !hasAnswer(check) {
+		return
+	}
+
+	answer := answerValues(result.Response, result.Type)
+	if len(answer) > 0 && sliceEqual(answer, answerValues(check.Response, result.Type)) {
+		result.Wildcard = true
+	}
+}
+
+// controlName returns a random sibling of domain, or "" when domain has no
+// parent below the public suffix for a wildcard to live in
+func controlName(domain string) string {
+	domain = strings.TrimSuffix(domain, ".")
+
+	dot := strings.Index(domain, ".")
+	if dot < 0 {
+		return ""
+	}
+	parent := domain[dot+1:]
+
+	base, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil || len(parent) < len(base) {
+		return ""
+	}
+
+	const charset = "abcdefghijklmnopqrstuvwxyz0123456789"
+	label := make([]byte, 12)
+	for i := range label {
+		label[i] = charset[rand.Intn(len(charset))]
+	}
+
+	return string(label) + "." + parent
+}
+
+// answerValues returns the sorted record data of the answers of type qtype,
+// ignoring owner names and TTLs so the two names can be compared
+func answerValues(response *dns.Msg, qtype uint16) []string {
+	var values []string
+	for _, rr := range response.Answer {
+		if rr.Header().Rrtype != qtype {
+			continue
+		}
+		values = append(values, strings.TrimPrefix(rr.String(), rr.Header().String()))
+	}
+	sort.Strings(values)
+	return values
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"bufio"
+	"context"
+	_ "embed"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"regexp"
 	"strings"
+	"time"
 )
 
 // InputReader handles reading and validating domain names from input
@@ -15,21 +18,26 @@ type InputReader struct {
 	reader   io.Reader
 	scanner  *bufio.Scanner
 	validator *DomainValidator
+	// logger receives warnings about invalid lines; stderr is used if nil
+	logger   *Logger
+	// invalid counts the lines ReadDomains skipped as invalid
+	invalid  int
 }
 
 // DomainValidator validates domain names
 type DomainValidator struct {
 	domainRegex *regexp.Regexp
 	ipv4Regex   *regexp.Regexp
-	ipv6Regex   *regexp.Regexp
 }
 
 // NewInputReader creates a new input reader
 func NewInputReader(reader io.Reader) *InputReader {
 	validator := &DomainValidator{
-		domainRegex: regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])?)*$`),
+		// Labels may start with an underscore for service names such as
+		// _dmarc.example.com and _sip._tcp.example.com, but the last label
+		// is a top-level domain and never does
+		domainRegex: regexp.MustCompile(`^(_?[a-zA-Z0-9]([a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])?$`),
 		ipv4Regex:   regexp.MustCompile(`^((25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.){3}(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)$`),
-		ipv6Regex:   regexp.MustCompile(`^([0-9a-fA-F]{1,4}:){7}[0-9a-fA-F]{1,4}$|^::$|^::1$|^([0-9a-fA-F]{1,4}:){1,7}:$|^([0-9a-fA-F]{1,4}:){1,6}:[0-9a-fA-F]{1,4}$|^([0-9a-fA-F]{1,4}:){1,5}(:[0-9a-fA-F]{1,4}){1,2}$|^([0-9a-fA-F]{1,4}:){1,4}(:[0-9a-fA-F]{1,4}){1,3}$|^([0-9a-fA-F]{1,4}:){1,3}(:[0-9a-fA-F]{1,4}){1,4}$|^([0-9a-fA-F]{1,4}:){1,2}(:[0-9a-fA-F]{1,4}){1,5}$|^[0-9a-fA-F]{1,4}:((:[0-9a-fA-F]{1,4}){1,6})$`),
 	}
 	
 	return &InputReader{
@@ -57,7 +65,12 @@ func (r *InputReader) ReadDomains() ([]string, error) {
 		if r.validator.IsValid(line) {
 			domains = append(domains, line)
 		} else {
-			fmt.Fprintf(os.Stderr, "Warning: Invalid domain/IP on line %d: %s\n", lineNum, line)
+			r.invalid++
+			if r.logger != nil {
+				r.logger.Warnf("Invalid domain/IP on line %d: %s", lineNum, line)
+			} else {
+				fmt.Fprintf(os.Stderr, "Warning: Invalid domain/IP on line %d: %s\n", lineNum, line)
+			}
 		}
 	}
 	
@@ -89,8 +102,9 @@ func (v *DomainValidator) IsValid(input string) bool {
 		return true
 	}
 	
-	// Check if it's an IPv6 address
-	if v.ipv6Regex.MatchString(input) {
+	// Check if it's an IPv6 address. The full grammar, including compressed
+	// and IPv4-suffixed forms, is left to the standard library.
+	if strings.Contains(input, ":") && net.ParseIP(input) != nil {
 		return true
 	}
 	
@@ -132,35 +146,189 @@ func ReadDomainsFromStdin() ([]string, error) {
 	return reader.ReadDomains()
 }
 
-// generateSubdomains generates common subdomains for a given domain
-func generateSubdomains(domain string) []string {
-	commonSubdomains := []string{
-		"www", "mail", "ftp", "admin", "test", "dev", "staging", "api",
-		"blog", "shop", "store", "support", "help", "docs", "cdn",
-		"static", "media", "images", "img", "assets", "download",
-		"secure", "vpn", "remote", "portal", "dashboard", "panel",
-		"forum", "community", "social", "chat", "wiki", "news",
-		"mobile", "m", "app", "apps", "beta", "alpha", "demo",
+// embeddedWordlist is the default brute-force wordlist, used when no
+// -wordlist is given
+//
+//go:embed wordlist.txt
+var embeddedWordlist string
+
+// defaultWordlist returns the words of the embedded wordlist
+func defaultWordlist() []string {
+	words, err := parseWordlist(strings.NewReader(embeddedWordlist))
+	if err != nil {
+		panic(fmt.Sprintf("embedded wordlist is invalid: %v", err))
 	}
-	
+	return words
+}
+
+// generateSubdomains generates subdomains of a domain by prepending each word
+func generateSubdomains(domain string, words []string) []string {
 	var subdomains []string
-	for _, sub := range commonSubdomains {
-		subdomains = append(subdomains, fmt.Sprintf("%s.%s", sub, domain))
+	for _, word := range words {
+		subdomains = append(subdomains, fmt.Sprintf("%s.%s", word, domain))
 	}
 	
 	return subdomains
 }
 
+// parseInputLine splits an input line into the domain and an optional
+// trailing query type token, e.g. "_dmarc.example.com TXT". The returned
+// types are nil when the line has no token and the global -t applies.
+func parseInputLine(line string) (string, []uint16, error) {
+	fields := strings.Fields(line)
+	switch len(fields) {
+	case 1:
+		return canonicalAddress(fields[0]), nil, nil
+	case 2:
+		types, err := parseQueryTypes(fields[1])
+		if err != nil {
+			return fields[0], nil, err
+		}
+		return canonicalAddress(fields[0]), types, nil
+	default:
+		return "", nil, fmt.Errorf("expected a domain and at most one type, got %d fields", len(fields))
+	}
+}
+
+// canonicalAddress returns the standard text form of an IP address input,
+// so that 2001:0db8:0000::0001 and 2001:db8::1 are the same input. Other
+// inputs are returned unchanged.
+func canonicalAddress(input string) string {
+	if ip := net.ParseIP(input); ip != nil {
+		return ip.String()
+	}
+	return input
+}
+
+// searchNames returns the names to try for a bare label such as "www",
+// each -search domain appended in order, or nil when domain already has a
+// dot or no search domains are set
+func searchNames(domain string, search []string) []string {
+	if len(search) == 0 || strings.ContainsAny(domain, ".:") {
+		return nil
+	}
+
+	names := make([]string, 0, len(search))
+	for _, suffix := range search {
+		names = append(names, domain+"."+suffix)
+	}
+	return names
+}
+
+// parseSearchDomains splits a comma-separated -search list, dropping
+// surrounding dots so "example.com." and "example.com" are the same
+func parseSearchDomains(value string) ([]string, error) {
+	var domains []string
+	for _, part := range strings.Split(value, ",") {
+		domain := strings.ToLower(strings.Trim(strings.TrimSpace(part), "."))
+		if domain == "" {
+			return nil, fmt.Errorf("empty search domain in %q", value)
+		}
+		domains = append(domains, domain)
+	}
+	return domains, nil
+}
+
+// loadWordlist loads subdomain words from a file or http(s) URL, one per line
+func loadWordlist(ctx context.Context, filename string, fetchTimeout time.Duration) ([]string, error) {
+	var file io.ReadCloser
+	var err error
+	if isURL(filename) {
+		file, err = openURL(ctx, filename, fetchTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch wordlist: %v", err)
+		}
+	} else {
+		file, err = os.Open(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open wordlist: %v", err)
+		}
+	}
+	defer file.Close()
+	
+	words, err := parseWordlist(file)
+	if err != nil {
+		return nil, fmt.Errorf("wordlist %s: %v", filename, err)
+	}
+	
+	return words, nil
+}
+
+// parseWordlist reads one word per line, lowercasing them and dropping
+// blank lines, comments and duplicates
+func parseWordlist(r io.Reader) ([]string, error) {
+	var words []string
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	
+	for scanner.Scan() {
+		word := strings.ToLower(strings.Trim(strings.TrimSpace(scanner.Text()), "."))
+		if word == "" || strings.HasPrefix(word, "#") || seen[word] {
+			continue
+		}
+		seen[word] = true
+		words = append(words, word)
+	}
+	
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading wordlist: %v", err)
+	}
+	
+	if len(words) == 0 {
+		return nil, fmt.Errorf("wordlist is empty")
+	}
+	
+	return words, nil
+}
+
+// validateInput checks every input line without sending any queries,
+// writing the valid domains, lowercased and deduplicated, to the output
+// and logging the invalid ones
+func validateInput(ctx context.Context, config *Config, outputHandler *OutputHandler, logger *Logger) error {
+	input, err := setupInputReader(ctx, config.InputFile, config.FetchTimeout)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	reader := NewInputReader(input)
+	reader.logger = logger
+
+	domains, err := reader.ReadDomains()
+	if err != nil {
+		return err
+	}
+
+	valid, duplicates := filterDomains(domains, reader.validator)
+	for _, domain := range valid {
+		outputHandler.WriteDomain(domain)
+	}
+
+	invalid := reader.invalid + len(domains) - len(valid) - duplicates
+	logger.Printf("Validation complete: %d valid domains written, %d duplicates removed, %d invalid lines skipped",
+		len(valid), duplicates, invalid)
+	return nil
+}
+
 // FilterDomains filters out invalid or unwanted domains
 func FilterDomains(domains []string, validator *DomainValidator) []string {
+	filtered, _ := filterDomains(domains, validator)
+	return filtered
+}
+
+// filterDomains is FilterDomains, also returning how many of the domains
+// were dropped as duplicates rather than as invalid
+func filterDomains(domains []string, validator *DomainValidator) ([]string, int) {
 	var filtered []string
 	seen := make(map[string]bool)
+	duplicates := 0
 	
 	for _, domain := range domains {
-		domain = strings.ToLower(strings.TrimSpace(domain))
+		domain = canonicalAddress(strings.ToLower(strings.TrimSpace(domain)))
 		
 		// Skip if already seen
 		if seen[domain] {
+			duplicates++
 			continue
 		}
 		
@@ -171,5 +339,5 @@ func FilterDomains(domains []string, validator *DomainValidator) []string {
 		}
 	}
 	
-	return filtered
+	return filtered, duplicates
 }
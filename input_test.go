@@ -0,0 +1,130 @@
+package main
+
+import "testing"
+
+func TestParseInputLineCanonicalAddress(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"2001:db8::1", "2001:db8::1"},
+		{"2001:0db8:0000::0001", "2001:db8::1"},
+		{"2001:0DB8::0001 AAAA", "2001:db8::1"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{"Example.com", "Example.com"},
+	}
+
+	for _, tt := range tests {
+		got, _, err := parseInputLine(tt.line)
+		if err != nil {
+			t.Errorf("parseInputLine(%q): %v", tt.line, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseInputLine(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestFilterDomainsCanonicalAddress(t *testing.T) {
+	validator := NewInputReader(nil).validator
+	got := FilterDomains([]string{"2001:db8::1", "2001:0db8:0000::0001", "example.com"}, validator)
+
+	want := []string{"2001:db8::1", "example.com"}
+	if len(got) != len(want) {
+		t.Fatalf("FilterDomains = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("FilterDomains = %q, want %q", got, want)
+			break
+		}
+	}
+}
+
+func TestDomainValidatorIPv6(t *testing.T) {
+	validator := NewInputReader(nil).validator
+
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"2001:db8::8a2e:370:7334", true},
+		{"2001:0db8:0000:0000:0000:8a2e:0370:7334", true},
+		{"::1", true},
+		{"::", true},
+		{"fe80::", true},
+		{"::ffff:192.0.2.1", true},
+		{"::ffff:c000:201", true},
+		{"64:ff9b::192.0.2.1", true},
+		{"[2001:db8::1]:53", true},
+
+		// Zone IDs only mean something to the local host
+		{"fe80::1%eth0", false},
+		{"fe80::1%25eth0", false},
+
+		// Brackets belong to host:port forms only
+		{"[2001:db8::1]", false},
+		{"[2001:db8::1", false},
+		{"2001:db8::1]", false},
+
+		{"2001:db8::1::2", false},
+		{"2001:db8:::1", false},
+		{"2001:db8::g", false},
+		{"12345::1", false},
+		{"1:2:3:4:5:6:7:8:9", false},
+		{"::ffff:192.0.2.256", false},
+		{":", false},
+	}
+
+	for _, tt := range tests {
+		if got := validator.IsValid(tt.input); got != tt.want {
+			t.Errorf("IsValid(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestDomainValidatorUnderscoreLabels(t *testing.T) {
+	validator := NewInputReader(nil).validator
+
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"_dmarc.example.com", true},
+		{"_sip._tcp.example.com", true},
+		{"_25._tcp.mail.example.com", true},
+		{"selector1._domainkey.example.com", true},
+		{"_DMARC.Example.COM", true},
+		{"www.example.com", true},
+
+		// Underscores only lead service labels; hostnames never have them
+		{"host_name.example.com", false},
+		{"host_.example.com", false},
+		{"www.example_site.com", false},
+		{"_.example.com", false},
+		{"__dmarc.example.com", false},
+		{"-_dmarc.example.com", false},
+		{"example._com", false},
+		{"_dmarc", false},
+	}
+
+	for _, tt := range tests {
+		if got := validator.IsValid(tt.input); got != tt.want {
+			t.Errorf("IsValid(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestFilterDomainsCountsDuplicates(t *testing.T) {
+	validator := NewInputReader(nil).validator
+	got, duplicates := filterDomains([]string{"example.com", "Example.com", "bad..name", "example.org"}, validator)
+
+	if len(got) != 2 {
+		t.Errorf("filterDomains kept %q, want 2 domains", got)
+	}
+	if duplicates != 1 {
+		t.Errorf("filterDomains counted %d duplicates, want 1", duplicates)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxDelegationDepth bounds the number of referrals followed for one name
+	maxDelegationDepth = 32
+	// maxGlueLookupDepth bounds nested lookups of glueless nameserver names
+	maxGlueLookupDepth = 4
+	// maxGlueLookups bounds how many nameserver names are resolved per referral
+	maxGlueLookups = 3
+)
+
+// GetRootServers returns the IPv4 addresses of the DNS root servers
+func GetRootServers() []string {
+	return []string{
+		"198.41.0.4:53",     // a.root-servers.net
+		"170.247.170.2:53",  // b.root-servers.net
+		"192.33.4.12:53",    // c.root-servers.net
+		"199.7.91.13:53",    // d.root-servers.net
+		"192.203.230.10:53", // e.root-servers.net
+		"192.5.5.241:53",    // f.root-servers.net
+		"192.112.36.4:53",   // g.root-servers.net
+		"198.97.190.53:53",  // h.root-servers.net
+		"192.36.148.17:53",  // i.root-servers.net
+		"192.58.128.30:53",  // j.root-servers.net
+		"193.0.14.129:53",   // k.root-servers.net
+		"199.7.83.42:53",    // l.root-servers.net
+		"202.12.27.33:53",   // m.root-servers.net
+	}
+}
+
+// delegation is a cached zone cut and the servers authoritative for it
+type delegation struct {
+	servers []string
+	expires time.Time
+}
+
+// IterativeResolver resolves names by walking the delegation chain from the
+// root. Each server is only sent one label more than the zone it is
+// authoritative for (QNAME minimisation, RFC 7816), so the full name is only
+// revealed to the servers of the final zone.
+type IterativeResolver struct {
+	client      *dns.Client
+	rateLimiter *RateLimiter
+	timeout     time.Duration
+	cache       map[string]*delegation
+	cacheMutex  sync.RWMutex
+	logger      *Logger
+}
+
+// NewIterativeResolver creates a new iterative resolver
+func NewIterativeResolver(config *Config, rateLimiter *RateLimiter, logger *Logger) *IterativeResolver {
+	timeout := time.Duration(config.Timeout) * time.Second
+
+	return &IterativeResolver{
+		client: &dns.Client{
+			Timeout: timeout,
+			Net:     "udp",
+		},
+		rateLimiter: rateLimiter,
+		timeout:     timeout,
+		cache:       make(map[string]*delegation),
+		logger:      logger,
+	}
+}
+
+// Resolve performs a minimised iterative lookup of domain for qtype
+func (r *IterativeResolver) Resolve(ctx context.Context, domain string, qtype uint16) *DNSResult {
+	start := time.Now()
+	response, server, err := r.resolve(ctx, domain, qtype, 0)
+
+	return &DNSResult{
+		Domain:   domain,
+		Type:     qtype,
+		Response: response,
+		Error:    err,
+		Resolver: server,
+		Latency:  time.Since(start),
+	}
+}
+
+// resolve walks from the closest known zone cut down to the full name
+func (r *IterativeResolver) resolve(ctx context.Context, domain string, qtype uint16, depth int) (*dns.Msg, string, error) {
+	name := strings.ToLower(dns.Fqdn(domain))
+	labels := dns.SplitDomainName(name)
+
+	zone, servers := r.closestDelegation(name)
+	covered := dns.CountLabel(zone)
+
+	for referrals := 0; referrals < maxDelegationDepth; referrals++ {
+		// Only reveal one more label than the current zone needs to see
+		qname, qt := name, qtype
+		if covered+1 < len(labels) {
+			qname = dns.Fqdn(strings.Join(labels[len(labels)-covered-1:], "."))
+			qt = dns.TypeNS
+		}
+
+		response, server, err := r.queryServers(ctx, servers, qname, qt)
+		if err != nil {
+			return nil, server, err
+		}
+
+		if response.Rcode == dns.RcodeSuccess {
+			// Referrals normally arrive in the authority section, but a server
+			// authoritative for both parent and child answers NS directly
+			rrs := response.Ns
+			if len(response.Answer) > 0 {
+				rrs = nil
+				if qt == dns.TypeNS && qname != name {
+					rrs = response.Answer
+				}
+			}
+
+			if cut, nsNames, ttl := findDelegation(rrs, zone, name); cut != "" {
+				nextServers := r.serverAddresses(ctx, response, nsNames, depth)
+				if len(nextServers) == 0 {
+					return nil, server, fmt.Errorf("no reachable nameservers for %s", cut)
+				}
+				r.storeDelegation(cut, nextServers, ttl)
+
+				r.logger.Debugf("Referral for %s: %s -> %d servers", name, cut, len(nextServers))
+
+				zone, servers = cut, nextServers
+				covered = dns.CountLabel(cut)
+				continue
+			}
+		}
+
+		if qname == name {
+			return response, server, nil
+		}
+
+		// Nothing exists below a non-existent name (RFC 8020)
+		if response.Rcode == dns.RcodeNameError {
+			return response, server, nil
+		}
+
+		// No zone cut at qname, ask the same servers about the next label
+		covered++
+	}
+
+	return nil, "", fmt.Errorf("too many referrals resolving %s", name)
+}
+
+// findDelegation returns the zone cut, nameserver names and TTL announced by
+// rrs when they delegate the part of name below zone
+func findDelegation(rrs []dns.RR, zone, name string) (string, []string, uint32) {
+	var cut string
+	var nsNames []string
+	var ttl uint32
+
+	for _, rr := range rrs {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+
+		owner := strings.ToLower(ns.Hdr.Name)
+		if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, name) {
+			continue
+		}
+
+		if cut == "" {
+			cut = owner
+			ttl = ns.Hdr.Ttl
+		}
+		if owner != cut {
+			continue
+		}
+
+		nsNames = append(nsNames, strings.ToLower(ns.Ns))
+		if ns.Hdr.Ttl < ttl {
+			ttl = ns.Hdr.Ttl
+		}
+	}
+
+	return cut, nsNames, ttl
+}
+
+// serverAddresses returns addresses for the given nameservers, preferring
+// glue records and falling back to resolving the names iteratively
+func (r *IterativeResolver) serverAddresses(ctx context.Context, response *dns.Msg, nsNames []string, depth int) []string {
+	wanted := make(map[string]bool)
+	for _, ns := range nsNames {
+		wanted[ns] = true
+	}
+
+	var servers []string
+	for _, rr := range response.Extra {
+		if a, ok := rr.(*dns.A); ok && wanted[strings.ToLower(a.Hdr.Name)] {
+			servers = append(servers, net.JoinHostPort(a.A.String(), "53"))
+		}
+	}
+
+	if len(servers) > 0 || depth >= maxGlueLookupDepth {
+		return servers
+	}
+
+	for i, ns := range nsNames {
+		if i >= maxGlueLookups {
+			break
+		}
+
+		nsResponse, _, err := r.resolve(ctx, ns, dns.TypeA, depth+1)
+		if err != nil || nsResponse == nil {
+			continue
+		}
+
+		for _, rr := range nsResponse.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				servers = append(servers, net.JoinHostPort(a.A.String(), "53"))
+			}
+		}
+
+		if len(servers) > 0 {
+			break
+		}
+	}
+
+	return servers
+}
+
+// queryServers sends a non-recursive query to each server in random order
+// until one of them gives a usable answer
+func (r *IterativeResolver) queryServers(ctx context.Context, servers []string, qname string, qtype uint16) (*dns.Msg, string, error) {
+	var lastErr error
+	var lastServer string
+
+	for _, idx := range rand.Perm(len(servers)) {
+		server := servers[idx]
+		lastServer = server
+
+		if r.rateLimiter != nil {
+			if err := r.rateLimiter.Wait(ctx); err != nil {
+				return nil, server, err
+			}
+		}
+
+		msg := &dns.Msg{}
+		msg.SetQuestion(qname, qtype)
+		msg.RecursionDesired = false
+
+		queryCtx, cancel := context.WithTimeout(ctx, r.timeout)
+		response, _, err := r.client.ExchangeContext(queryCtx, msg, server)
+		cancel()
+
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if response.Rcode == dns.RcodeServerFailure || response.Rcode == dns.RcodeRefused {
+			lastErr = fmt.Errorf("%s returned %s for %s", server, dns.RcodeToString[response.Rcode], qname)
+			continue
+		}
+
+		return response, server, nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no nameservers to query for %s", qname)
+	}
+
+	return nil, lastServer, lastErr
+}
+
+// closestDelegation returns the deepest cached zone cut above name
+func (r *IterativeResolver) closestDelegation(name string) (string, []string) {
+	r.cacheMutex.RLock()
+	defer r.cacheMutex.RUnlock()
+
+	now := time.Now()
+	for zone := name; zone != "."; {
+		if d, exists := r.cache[zone]; exists && now.Before(d.expires) {
+			return zone, d.servers
+		}
+
+		idx := strings.Index(zone, ".")
+		zone = zone[idx+1:]
+		if zone == "" {
+			break
+		}
+	}
+
+	return ".", GetRootServers()
+}
+
+// storeDelegation caches the servers for a zone cut for the given TTL
+func (r *IterativeResolver) storeDelegation(zone string, servers []string, ttl uint32) {
+	r.cacheMutex.Lock()
+	defer r.cacheMutex.Unlock()
+
+	r.cache[zone] = &delegation{
+		servers: servers,
+		expires: time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// lameChecker tests the nameservers in NS answers for -check-lame by
+// asking each of them directly for the zone's SOA
+type lameChecker struct {
+	client      *dns.Client
+	timeout     time.Duration
+	rateLimiter *RateLimiter
+	logger      *Logger
+}
+
+// newLameChecker creates a checker that queries nameservers over UDP
+func newLameChecker(config *Config, rateLimiter *RateLimiter, logger *Logger) *lameChecker {
+	timeout := time.Duration(config.Timeout) * time.Second
+
+	return &lameChecker{
+		client:      &dns.Client{Timeout: timeout, Net: "udp"},
+		timeout:     timeout,
+		rateLimiter: rateLimiter,
+		logger:      logger,
+	}
+}
+
+// Check fills result.Lame for every nameserver in an NS answer. A server
+// is lame when none of its addresses answers the zone's SOA query with
+// RD=0 authoritatively: with AA set and the SOA in the answer section.
+// Glue in the response is used for addresses first, then lookup.
+func (c *lameChecker) Check(ctx context.Context, result *DNSResult, lookup func(string, uint16) *DNSResult) {
+	if result.Error != nil || result.Response == nil {
+		return
+	}
+
+	for _, rr := range result.Response.Answer {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+
+		zone := strings.ToLower(dns.Fqdn(ns.Hdr.Name))
+		server := strings.ToLower(dns.Fqdn(ns.Ns))
+		if result.Lame == nil {
+			result.Lame = make(map[string]bool)
+		}
+		if _, checked := result.Lame[server]; checked {
+			continue
+		}
+
+		lame := true
+		for _, address := range nameserverAddresses(result.Response, server, lookup) {
+			if c.authoritative(ctx, address, zone) {
+				lame = false
+				break
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		result.Lame[server] = lame
+
+		if lame && c.logger != nil {
+			c.logger.Warnf("Lame delegation detected: %s is listed for %s but does not answer for it", server, zone)
+		}
+	}
+}
+
+// authoritative reports whether the server at address answers the SOA of
+// zone authoritatively
+func (c *lameChecker) authoritative(ctx context.Context, address, zone string) bool {
+	if c.rateLimiter != nil {
+		if err := c.rateLimiter.Wait(ctx); err != nil {
+			return false
+		}
+	}
+
+	msg := &dns.Msg{}
+	msg.SetQuestion(zone, dns.TypeSOA)
+	msg.RecursionDesired = false
+
+	queryCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	response, _, err := c.client.ExchangeContext(queryCtx, msg, address)
+	cancel()
+
+	if err != nil || response.Rcode != dns.RcodeSuccess || !response.Authoritative {
+		return false
+	}
+	for _, rr := range response.Answer {
+		if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// nameserverAddresses returns the host:port addresses of server, taken
+// from the glue in response or else resolved with lookup
+func nameserverAddresses(response *dns.Msg, server string, lookup func(string, uint16) *DNSResult) []string {
+	var addresses []string
+	collect := func(rrs []dns.RR) {
+		for _, rr := range rrs {
+			if a, ok := rr.(*dns.A); ok && strings.EqualFold(a.Hdr.Name, server) {
+				addresses = append(addresses, net.JoinHostPort(a.A.String(), "53"))
+			}
+		}
+	}
+
+	collect(response.Extra)
+	if len(addresses) > 0 {
+		return addresses
+	}
+
+	check := lookup(server, dns.TypeA)
+	if check.Error != nil || check.Response == nil {
+		return nil
+	}
+
+	// The answer may lead through CNAMEs, so match the address records by type
+	for _, rr := range check.Response.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			addresses = append(addresses, net.JoinHostPort(a.A.String(), "53"))
+		}
+	}
+	return addresses
+}
@@ -5,27 +5,60 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/miekg/dns"
 )
 
 const (
-	defaultQPS      = 100
-	defaultTimeout  = 5
-	defaultRetries  = 3
-	defaultWorkers  = 50
+	defaultQPS                 = 100
+	defaultTimeout             = 5
+	defaultRetries             = 3
+	defaultWorkers             = 50
+	defaultMinWorkers          = 10
+	defaultMaxWorkers          = 500
+	defaultTestDomain          = "google.com"
+	defaultResolverTestTimeout = 2
+	defaultRandomizeWindow     = 100000
+	defaultFastFluxThreshold   = 0.5
+	defaultESIndex             = "dns-resolver"
+	defaultESBatchSize         = 500
+	defaultESFlushInterval     = 5 * time.Second
+	defaultAbortSample         = 100
+	defaultFetchTimeout        = 30 * time.Second
+	defaultRefusedCooldown     = 30 * time.Second
+
+	// resultDrainTimeout bounds the wildcard checks made while writing the
+	// results still queued when the run is cut short
+	resultDrainTimeout = 10 * time.Second
+
+	// -low-memory caps
+	lowMemoryWorkers         = 10
+	lowMemoryRandomizeWindow = 1000
+	lowMemoryESBatchSize     = 100
+
+	// Workers per GOMAXPROCS above which a warning is logged
+	workersPerProc = 25
+
+	// toolVersion is reported by -version and recorded in -manifest
+	toolVersion = "1.0.0"
 )
 
 func main() {
+	startedAt := time.Now()
 	config := parseFlags()
 	
 	if config.Help {
@@ -34,77 +67,387 @@ func main() {
 	}
 
 	if config.Version {
-		fmt.Println("DNS Resolver v1.0.0")
+		fmt.Println("DNS Resolver v" + toolVersion)
 		return
 	}
 
 	// Initialize logger
-	logger := setupLogger(config.LogFile, config.Verbose)
+	logger := setupLogger(config.LogFile, config.logLevel, config.LogJSON)
+	defer closeQueryLog(config, logger)
+	
+	if config.LowMemory {
+		logger.Printf("Low-memory mode: %d workers, queue %d, result buffer %d; -cache, -merge-families and -group-by-answer off",
+			config.Workers, config.QueueSize, config.ResultBuffer)
+	}
+	if selected, err := parseQueryTypes(config.QueryTypes); err == nil {
+		for _, qtype := range config.excludedTypes {
+			if !containsType(selected, qtype) {
+				logger.Warnf("-exclude-types %s is not among the -t types", dns.TypeToString[qtype])
+			}
+		}
+	}
+	if procs := runtime.GOMAXPROCS(0); config.Workers > workersPerProc*procs {
+		logger.Warnf("%d workers is more than %d per CPU (%d available) and may use a lot of memory; consider -low-memory or fewer -workers",
+			config.Workers, workersPerProc, procs)
+	}
+	
+	// Validation only cleans the input list and needs no resolvers
+	if config.ValidateOnly {
+		outputHandler, err := NewOutputHandler(config, logger)
+		if err != nil {
+			logger.Errorf("Error opening output: %v", err)
+			os.Exit(1)
+		}
+		err = validateInput(context.Background(), config, outputHandler, logger)
+		outputHandler.Close()
+		if err != nil {
+			logger.Fatalf("Error validating input: %v", err)
+		}
+		return
+	}
+
+	// Setup signal handling for graceful shutdown, including during resolver testing
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	
+	// Bound the whole run, separately from the per-query timeout
+	if config.MaxRuntime > 0 {
+		ctx, cancel = context.WithTimeout(ctx, config.MaxRuntime)
+		defer cancel()
+	}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	
+	go func() {
+		<-sigChan
+		logger.Println("Received shutdown signal, stopping...")
+		cancel()
+	}()
+
+	// Comparing resolver sets builds its own two pools instead of the usual one
+	if config.CompareResolvers != "" {
+		outputHandler, err := NewOutputHandler(config, logger)
+		if err != nil {
+			logger.Errorf("Error opening output: %v", err)
+			os.Exit(1)
+		}
+		err = runCompare(ctx, config, outputHandler, logger)
+		outputHandler.Close()
+		if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			logger.Fatalf("Error comparing resolvers: %v", err)
+		}
+		return
+	}
+
 	// Initialize resolver pool
-	resolverPool := NewResolverPool(config, logger)
+	resolverPool, err := NewResolverPool(ctx, config, logger)
+	if err != nil && ctx.Err() != nil {
+		logger.Println("Interrupted while testing resolvers")
+		os.Exit(130)
+	}
+	if err != nil {
+		logger.Fatalf("Failed to initialize resolver pool: %v", err)
+	}
 	defer resolverPool.Close()
 
 	// Initialize rate limiter
-	rateLimiter := NewRateLimiter(config.QPS)
+	rateLimiter := NewRateLimiter(config.QPS, config.Burst)
 
 	// Initialize wildcard detector if enabled
 	var wildcardDetector *WildcardDetector
 	if config.WildcardDetection {
-		wildcardDetector = NewWildcardDetector(resolverPool, logger)
+		wildcardDetector = NewWildcardDetector(resolverPool, rateLimiter, config.WildcardStrict, logger)
 	}
 
-	// Initialize output handler
-	outputHandler := NewOutputHandler(config.OutputFile, config.OutputFormat, logger)
+	// Register the built-in enrichment processors that were requested
+	if config.ASN {
+		RegisterResultProcessor(NewASNProcessor(resolverPool, rateLimiter, config, logger))
+	}
+
+	// The open resolver check is a diagnostic of the pool itself
+	if config.CheckOpen {
+		outputHandler, err := NewOutputHandler(config, logger)
+		if err != nil {
+			logger.Errorf("Error opening output: %v", err)
+			resolverPool.Close()
+			os.Exit(1)
+		}
+		err = checkOpenResolvers(ctx, config, resolverPool, rateLimiter, outputHandler, logger)
+		outputHandler.Close()
+		if err != nil {
+			logger.Errorf("Open resolver check stopped: %v", err)
+		}
+		return
+	}
+
+	// The interactive shell replaces the batch run
+	if config.REPL {
+		if err := runREPL(ctx, os.Stdin, os.Stdout, config, resolverPool, rateLimiter, logger); err != nil {
+			logger.Errorf("%v", err)
+		}
+		return
+	}
+
+	// Probe the resolvers before the run so it starts with their health
+	// known and the dead ones dropped
+	if config.Warmup > 0 {
+		resolverPool.Warmup(ctx, config.Warmup, rateLimiter, config)
+		if ctx.Err() != nil {
+			logger.Println("Interrupted during warmup")
+			resolverPool.Close()
+			closeQueryLog(config, logger)
+			os.Exit(130)
+		}
+	}
+
+	// Initialize output handler. Release the resolvers before exiting, since
+	// os.Exit skips the deferred Close.
+	outputHandler, err := NewOutputHandler(config, logger)
+	if err != nil {
+		logger.Errorf("Error opening output: %v", err)
+		resolverPool.Close()
+		os.Exit(1)
+	}
 	defer outputHandler.Close()
 
 	// Initialize statistics tracker
 	stats := NewStats()
 
-	// Setup signal handling for graceful shutdown
-	ctx, cancel := context.WithCancel(context.Background())
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	// Background reporters run until the queries are done and are waited
+	// for before the final statistics, so nothing prints over them
+	reportCtx, stopReporters := context.WithCancel(ctx)
+	var reporters sync.WaitGroup
 	
+	// Dump the current statistics on SIGUSR1 without stopping the run
+	statsChan := make(chan os.Signal, 1)
+	notifyStatsSignal(statsChan)
+	reporters.Add(1)
 	go func() {
-		<-sigChan
-		logger.Println("Received shutdown signal, stopping...")
-		cancel()
+		defer reporters.Done()
+		defer signal.Stop(statsChan)
+		for {
+			select {
+			case <-statsChan:
+				stats.PrintCurrentStats(logger)
+			case <-reportCtx.Done():
+				return
+			}
+		}
 	}()
 
+	// Start statistics reporter if verbose
+	if config.Verbose && !config.Quiet {
+		reporters.Add(1)
+		go func() {
+			defer reporters.Done()
+			stats.StartReporter(reportCtx, logger, nil, 10*time.Second)
+		}()
+	}
+
+	// Machine-readable progress for frontends goes to its own descriptor
+	if config.progressOut != nil {
+		reporters.Add(1)
+		go func() {
+			defer reporters.Done()
+			stats.StartReporter(reportCtx, nil, config.progressOut, time.Second)
+		}()
+	}
+
+	// A run where nearly every query fails is stopped early
+	breaker := newErrorBreaker(config.AbortErrorRate, config.AbortSample, cancel)
+	
 	// Start the DNS resolution process
-	err := processDNSQueries(ctx, config, resolverPool, rateLimiter, wildcardDetector, outputHandler, stats, logger)
-	if err != nil {
-		logger.Fatalf("Error processing DNS queries: %v", err)
+	err = processDNSQueries(ctx, config, resolverPool, rateLimiter, wildcardDetector, outputHandler, breaker, stats, logger)
+	stopReporters()
+	reporters.Wait()
+	if config.Manifest != "" {
+		runErr := err
+		if tripErr := breaker.Err(); tripErr != nil {
+			runErr = tripErr
+		}
+		if err := writeManifest(config.Manifest, config, resolverPool, startedAt, runErr); err != nil {
+			logger.Errorf("Error writing manifest: %v", err)
+		}
+	}
+	if tripErr := breaker.Err(); tripErr != nil {
+		stats.PrintFinalStats(logger)
+		logger.Errorf("Aborting run: %v", tripErr)
+		outputHandler.Close()
+		resolverPool.Close()
+		closeQueryLog(config, logger)
+		os.Exit(1)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		logger.Printf("Maximum runtime of %v reached, stopping", config.MaxRuntime)
+	} else if err != nil {
+		logger.Errorf("Error processing DNS queries: %v", err)
+		outputHandler.Close()
+		resolverPool.Close()
+		closeQueryLog(config, logger)
+		os.Exit(1)
 	}
 
 	// Print final statistics
+	stats.SetConnectionCounts(resolverPool.ConnectionCounts())
+	stats.SetBytesReceived(resolverPool.BytesReceived())
+	stats.SetCooldowns(resolverPool.Cooldowns())
 	stats.PrintFinalStats(logger)
+	outputHandler.PrintAnswerGroups()
+
+	if config.ResolverStats || config.ResolverStatsFile != "" {
+		resolverStats := resolverPool.ResolverStats()
+		if config.ResolverStats {
+			resolverPool.PrintResolverStats(resolverStats)
+		}
+		if config.ResolverStatsFile != "" {
+			if err := WriteResolverStats(config.ResolverStatsFile, resolverStats); err != nil {
+				logger.Errorf("Error writing resolver stats: %v", err)
+			}
+		}
+	}
+
+	// Send a last snapshot so frontends see the final counts
+	if config.progressOut != nil {
+		stats.WriteProgress(config.progressOut)
+	}
+
+	// In count mode the summary takes the place of the per-record output
+	if config.Count {
+		outputHandler.WriteSummary(stats.GetSummary())
+	}
 }
 
 func parseFlags() *Config {
 	config := &Config{}
 	
-	flag.StringVar(&config.InputFile, "i", "", "Input file containing DNS names (default: stdin)")
-	flag.StringVar(&config.OutputFile, "o", "", "Output file for results (default: stdout)")
+	flag.StringVar(&config.InputFile, "i", "", "Input file or http(s) URL containing DNS names (default: stdin)")
+	flag.StringVar(&config.OutputFile, "o", "", "Output file for results, gzip-compressed if it ends in .gz (default: stdout); or comma-separated format:path pairs to write several at once, e.g. simple:-,json:out.json")
+	flag.StringVar(&config.RotateSize, "rotate-size", "", "Start a new numbered output file once the records written to the current one reach this size before compression, e.g. 100MB")
+	flag.IntVar(&config.RotateCount, "rotate-count", 0, "Start a new numbered output file after this many records")
 	flag.StringVar(&config.LogFile, "l", "", "Log file for errors and debug info (default: stderr)")
 	flag.StringVar(&config.ResolversFile, "rf", "", "File containing DNS resolver IP addresses")
-	flag.StringVar(&config.Resolvers, "r", "", "Comma-separated list of DNS resolver IP addresses")
-	flag.StringVar(&config.QueryTypes, "t", "A", "Comma-separated list of DNS record types (A,AAAA,CNAME,MX,NS,TXT,SOA,PTR)")
-	flag.StringVar(&config.OutputFormat, "f", "simple", "Output format: simple, json, csv")
+	flag.StringVar(&config.Resolvers, "r", "", "Comma-separated list of DNS resolver IP addresses (prefix with tcp://, tls:// or https:// to change transport)")
+	flag.StringVar(&config.TransportOrder, "transport-order", "", "Transports to step through as attempts fail, e.g. udp,tcp,https (each attempt counts toward -retries)")
+	flag.IntVar(&config.Port, "port", 0, "Default port for resolver addresses given without one (default: 53, or 853 for tls://)")
+	flag.BoolVar(&config.UseDoHDefaults, "use-doh-defaults", false, "Add the built-in DNS over HTTPS resolvers (Cloudflare, Google, Quad9)")
+	flag.StringVar(&config.Proxy, "proxy", "", "SOCKS5 proxy for TCP and TLS resolvers, e.g. socks5://127.0.0.1:1080")
+	flag.StringVar(&config.QueryTypes, "t", "A", "Comma-separated list of DNS record types (A,AAAA,CNAME,MX,NS,TXT,SOA,PTR,SRV,URI,TLSA), or ALL-COMMON for A,AAAA,CNAME,MX,NS,TXT,SOA")
+	flag.StringVar(&config.ExcludeTypes, "exclude-types", "", "Comma-separated record types to drop from -t, e.g. -t ALL-COMMON -exclude-types SOA,NS")
+	flag.StringVar(&config.AllowlistFile, "allowlist", "", "File of in-scope domains; only matching domains are queried")
+	flag.StringVar(&config.DenylistFile, "denylist", "", "File of out-of-scope domains that are never queried")
+	flag.BoolVar(&config.NoRecurse, "no-recurse", false, "Send non-recursive queries (RD=0), for querying authoritative servers directly")
+	flag.BoolVar(&config.QnameMinimization, "qname-min", false, "Resolve iteratively from the root with QNAME minimisation (RFC 7816); requires -no-recurse and ignores -r/-rf for lookups")
+	flag.BoolVar(&config.Cache, "cache", false, "Cache responses in memory for their TTL, including negative answers")
+	flag.BoolVar(&config.FirstMatch, "first-match", false, "Stop querying further types for a domain once one type returns an answer (same as -type-strategy first-success)")
+	flag.StringVar(&config.TypeStrategy, "type-strategy", typeStrategyAll, "How the -t types are worked through per domain: all, first-success or priority (tiers separated by >, e.g. -t A>AAAA>TXT)")
+	flag.BoolVar(&config.Syslog, "syslog", false, "Send results to syslog instead of a file or stdout, one message per record")
+	flag.StringVar(&config.ESURL, "es-url", "", "Index JSON results into Elasticsearch/OpenSearch at this URL via the _bulk API, e.g. http://localhost:9200")
+	flag.StringVar(&config.ESIndex, "es-index", defaultESIndex, "Index name for -es-url")
+	flag.IntVar(&config.ESBatchSize, "es-batch-size", defaultESBatchSize, "Documents per bulk request for -es-url")
+	flag.DurationVar(&config.ESFlushInterval, "es-flush-interval", defaultESFlushInterval, "Send a partial bulk request after this long for -es-url")
+	flag.StringVar(&config.SyslogAddr, "syslog-addr", "", "Remote syslog address as host:port, udp://host:port or tcp://host:port (default: local syslog)")
+	flag.BoolVar(&config.DetectDangling, "detect-dangling", false, "Flag CNAMEs whose target does not exist or is an unclaimed takeover-prone service")
+	flag.BoolVar(&config.CheckLame, "check-lame", false, "Ask each nameserver in NS answers for the zone's SOA with RD=0 and flag those that don't answer authoritatively (lame delegations)")
+	flag.BoolVar(&config.DetectInconsistency, "detect-inconsistency", false, "Flag answers that differ from the last one the same resolver gave for the same name and type, e.g. across -probe-count queries")
+	flag.DurationVar(&config.InconsistencyWindow, "inconsistency-window", defaultInconsistencyWindow, "How long -detect-inconsistency compares a resolver's answer against its previous one")
+	flag.BoolVar(&config.TXTConcat, "txt-concat", false, "Join the strings of a TXT record with no separator instead of a space (use for DKIM keys)")
+	flag.BoolVar(&config.Normalize, "normalize", true, "Write IP addresses in canonical form and target names lowercased and fully qualified")
+	flag.BoolVar(&config.CheckingDisabled, "cd", false, "Set the CD (checking disabled) bit on queries")
+	flag.IntVar(&config.EDNSVersion, "edns-version", 0, "EDNS version to send, for testing how resolvers handle future versions (0-255)")
+	flag.IntVar(&config.EDNSZ, "edns-z", 0, "Value of the EDNS Z flags field to send, excluding the DO bit (0-32767)")
+	flag.BoolVar(&config.Cookies, "cookies", false, "Send DNS cookies (RFC 7873) and remember each resolver's server cookie")
+	flag.BoolVar(&config.ShowResolver, "show-resolver", false, "Append the answering resolver as a trailing column in simple output")
+	flag.BoolVar(&config.Brute, "brute", false, "Treat input names as base domains and brute-force subdomains from the wordlist")
+	flag.StringVar(&config.Wordlist, "wordlist", "", "Subdomain wordlist file or http(s) URL for -brute and -recursive-brute (default: built-in list)")
+	flag.DurationVar(&config.FetchTimeout, "fetch-timeout", defaultFetchTimeout, "Time allowed to connect and receive the response headers when -i or -wordlist is a URL")
+	flag.IntVar(&config.RecursiveBrute, "recursive-brute", 0, "Prepend the wordlist to names that resolve, for up to N further levels")
+	flag.IntVar(&config.MaxQueries, "max-queries", 0, "Stop after this many lookups in total (0 = unlimited)")
+	flag.Var(&config.EDNSOptions, "edns-option", "Attach a raw EDNS option to queries as CODE:HEXDATA (repeatable)")
+	flag.BoolVar(&config.Prefilter, "prefilter", false, "Send one A query per domain first and only query the full -t set for names that exist")
+	flag.StringVar(&config.RawOutputDir, "raw-output", "", "Also write the wire format of every response to DOMAIN_TYPE.bin files in this directory")
+	flag.IntVar(&config.BatchSize, "batch-size", 0, "Hold this many records in memory and write them to the output file or stdout together, for fewer small writes in large runs (default: write each one through)")
+	flag.StringVar(&config.CSVDelimiter, "csv-delim", ",", "Field delimiter for CSV output, a single character (use \\t or tab for TSV)")
+	flag.StringVar(&config.Fields, "fields", "", "Comma-separated fields to write for CSV and JSON output, in order: "+outputFieldNames()+"; JSON records always start with schema_version")
+	flag.BoolVar(&config.EmitNXDomain, "emit-nxdomain", false, "Write a record with status NXDOMAIN and an empty value for names that don't exist")
+	flag.BoolVar(&config.RequireFinalType, "require-final-type", false, "Count a query as answered only if it returns a record of the queried type, not just CNAMEs; alias-only answers are still written but counted separately")
+	flag.BoolVar(&config.PTRAddress, "ptr-ip", false, "Write PTR results under the queried IP address instead of its in-addr.arpa or ip6.arpa name")
+	flag.BoolVar(&config.SortAnswers, "sort-answers", false, "Sort the records of each response by value so round-robin answers are written in a stable order")
+	flag.BoolVar(&config.Timestamp, "timestamp", false, "Add the time each result was written, in RFC 3339 UTC, as an observed_at field or trailing column")
+	flag.BoolVar(&config.JSONPretty, "json-pretty", false, "Indent JSON output for reading by eye instead of one compact record per line")
+	flag.StringVar(&config.OutputFormat, "f", "simple", "Output format: simple, json, json-grouped, csv, or hosts for IP<TAB>name lines of the A/AAAA answers")
 	flag.IntVar(&config.QPS, "qps", defaultQPS, "Queries per second per resolver")
+	flag.StringVar(&config.MaxBPS, "max-bps", "", "Throttle queries to keep responses under this many bytes per second, e.g. 64KB (default: no limit)")
+	flag.IntVar(&config.Burst, "burst", 0, "Rate limiter burst capacity (default: qps/10, at least 1)")
 	flag.IntVar(&config.Timeout, "timeout", defaultTimeout, "Query timeout in seconds")
+	flag.DurationVar(&config.Warmup, "warmup", 0, "Probe every resolver with the test domain for this long before the run, dropping those that never answer, e.g. 5s")
+	flag.DurationVar(&config.Jitter, "jitter", 0, "Wait a random delay of up to this long before each query, on top of -qps, so workers don't send in bursts, e.g. 20ms")
+	flag.DurationVar(&config.RefusedCooldown, "refused-cooldown", defaultRefusedCooldown, fmt.Sprintf("Take a resolver out of rotation for this long after %d REFUSED answers in a row, as rate limiting resolvers send (0 = never)", refusedBurst))
+	flag.DurationVar(&config.HedgeDelay, "hedge-delay", 0, "Race a second resolver if the first has not answered within this delay, e.g. 50ms")
+	flag.IntVar(&config.ProbeCount, "probe-count", 1, "Query each name this many times across resolvers and union the answers, to map round-robin pools")
+	flag.DurationVar(&config.DomainDeadline, "domain-deadline", 0, "Give up on a domain's remaining types and retries after this long, e.g. 15s (default: no limit)")
+	flag.BoolVar(&config.FastFlux, "fastflux", false, "Score A/AAAA answer churn across -probe-count queries and flag likely fast-flux names")
+	flag.Float64Var(&config.FastFluxThreshold, "fastflux-threshold", defaultFastFluxThreshold, "Flag names whose -fastflux score is at least this (0-1)")
+	flag.Float64Var(&config.AbortErrorRate, "abort-on-error-rate", 0, "Abort the run once this share (0-1) of the last -abort-sample queries failed, e.g. 0.95 (default: never)")
+	flag.IntVar(&config.AbortSample, "abort-sample", defaultAbortSample, "Number of recent queries -abort-on-error-rate is measured over")
+	flag.StringVar(&config.RetryOn, "retry-on", defaultRetryOn, "Comma-separated outcomes that use up a retry: timeout, error (other failed exchanges), servfail, refused, empty (NOERROR without answers); anything else is returned as is")
 	flag.IntVar(&config.Retries, "retries", defaultRetries, "Number of retries for failed queries")
 	flag.IntVar(&config.Workers, "workers", defaultWorkers, "Number of worker goroutines")
+	flag.BoolVar(&config.AutoWorkers, "auto-workers", false, "Start with -workers and add workers while the domain queue stays full, retiring them while it stays empty")
+	flag.IntVar(&config.MinWorkers, "min-workers", defaultMinWorkers, "Fewest workers -auto-workers scales down to")
+	flag.IntVar(&config.MaxWorkers, "max-workers", defaultMaxWorkers, "Most workers -auto-workers scales up to")
+	flag.IntVar(&config.PerResolverConc, "per-resolver-conc", 0, "Most queries outstanding to any one resolver at a time; workers over the cap wait (default: no limit)")
+	flag.IntVar(&config.QueueSize, "queue-size", 0, "Domains buffered ahead of the workers (default: -workers)")
+	flag.BoolVar(&config.LowMemory, "low-memory", false, "Cap -workers at 10 and the queues at the worker count, shrink -randomize-window and -es-batch-size, and turn off -cache, -merge-families and -group-by-answer; lowers memory on small machines at the cost of throughput and those features")
+	flag.IntVar(&config.ResultBuffer, "result-buffer", 0, "Results buffered ahead of the output writer (default: 2 x -workers)")
 	flag.BoolVar(&config.WildcardDetection, "w", false, "Enable DNS wildcard detection")
-	flag.BoolVar(&config.Verbose, "v", false, "Verbose logging")
+	flag.BoolVar(&config.WildcardStrict, "wildcard-strict", true, "With -w, require random subdomains to return identical answers; false flags any zone where they all resolve")
+	flag.BoolVar(&config.InlineWildcard, "inline-wildcard", false, "Send a random sibling control query with each lookup and flag answers that match it as wildcards")
+	flag.BoolVar(&config.Verbose, "v", false, "Verbose logging (same as -log-level debug)")
+	flag.BoolVar(&config.LogJSON, "log-json", false, "Write log lines as JSON objects with level, msg and structured fields such as domain and error kind")
+	flag.StringVar(&config.Manifest, "manifest", "", "Write a JSON manifest of the run (effective config, resolvers, version, times, host) to this file when it ends; values are not redacted, so -proxy and -es-url credentials are included")
+	flag.StringVar(&config.QueryLog, "query-log", "", "Write one line per query sent and response received (resolver, name, type, rcode, answers, latency) to this file")
+	flag.StringVar(&config.LogLevel, "log-level", "info", "Minimum level to log: error, warn, info, debug")
 	flag.BoolVar(&config.Help, "h", false, "Show help message")
 	flag.BoolVar(&config.Version, "version", false, "Show version information")
 	flag.BoolVar(&config.Quiet, "q", false, "Quiet mode (suppress non-essential output)")
+	flag.BoolVar(&config.MergeFamilies, "merge-families", false, "Write one record per name combining its A and AAAA answers (buffered until the run ends)")
+	flag.BoolVar(&config.ResolverStats, "resolver-stats", false, "Print per-resolver query, error and latency counts at the end of the run")
+	flag.StringVar(&config.ResolverStatsFile, "resolver-stats-file", "", "Write per-resolver counts to this CSV file")
+	flag.BoolVar(&config.GroupByAnswer, "group-by-answer", false, "Report domains that share an identical A/AAAA answer set at the end of the run")
+	flag.BoolVar(&config.ASN, "asn", false, "Annotate JSON results with the origin ASN of each IPv4 address (Team Cymru lookup)")
+	flag.IntVar(&config.ProgressFD, "progress-fd", 0, "Write JSON progress snapshots every second to this file descriptor")
+	flag.BoolVar(&config.REPL, "repl", false, "Start an interactive shell that queries each typed domain with the configured resolvers")
+	flag.BoolVar(&config.CheckOpen, "check-open", false, "Report which configured resolvers recursively resolve -test-domain for anyone (open resolvers) instead of reading input")
+	flag.BoolVar(&config.ValidateOnly, "validate-only", false, "Validate and deduplicate the input list and write the valid domains without querying")
+	flag.BoolVar(&config.Count, "count", false, "Write only a summary of counts instead of per-record results (JSON with -f json)")
+	flag.BoolVar(&config.SkipResolverTest, "skip-resolver-test", false, "Skip the startup connectivity test and use all configured resolvers")
+	flag.BoolVar(&config.RandomizeInput, "randomize-input", false, "Shuffle the input order before querying")
+	flag.BoolVar(&config.CSVRecordCount, "csv-record-count", false, "Start buffered CSV output with a \"# records=N\" line before the header; requires -f csv and -merge-families")
+	flag.IntVar(&config.RandomizeWindow, "randomize-window", defaultRandomizeWindow, "Number of input lines buffered for -randomize-input")
+	flag.IntVar(&config.Sample, "sample", 0, "Query a uniformly random sample of this many input lines, in random order, holding only the sample in memory")
+	flag.IntVar(&config.SpillAfter, "spill-after", defaultSpillAfter, "Lines -merge-families, -group-by-answer and -csv-record-count hold in memory before spilling sorted runs to temp files (in $TMPDIR)")
+	flag.BoolVar(&config.ShuffleResolvers, "shuffle-resolvers", false, "Randomize resolver order instead of keeping the configured order")
+	flag.DurationVar(&config.MaxRuntime, "max-runtime", 0, "Stop the whole run after this long, e.g. 10m (default: no limit)")
+	flag.IntVar(&config.ResolverTestTimeout, "resolver-test-timeout", defaultResolverTestTimeout, "Timeout in seconds for each resolver connectivity test at startup")
+	flag.StringVar(&config.CompareResolvers, "compare-resolvers", "", "Query every name against two resolver sets, given as FILE_A,FILE_B, and write the lookups whose answers differ")
+	flag.StringVar(&config.Search, "search", "", "Comma-separated search domains appended to bare input labels like www, tried in order until a name exists")
+	flag.StringVar(&config.NSMapFile, "ns-map", "", "File of suffix=resolver[,resolver...] lines routing names under each suffix to their own resolvers")
+	flag.BoolVar(&config.NoDefaultResolvers, "no-default-resolvers", false, "Fail instead of falling back to the built-in public resolvers when none are configured or none pass the startup test")
+	flag.BoolVar(&config.SystemResolvers, "system-resolvers", false, "Add the nameservers from /etc/resolv.conf to the resolver list, for internal and split-horizon names")
+	flag.StringVar(&config.TestDomain, "test-domain", defaultTestDomain, "Domain name queried when testing resolvers at startup")
 
 	flag.Parse()
 	
 	// Validate and set defaults
+	if isOutputSinkList(config.OutputFile) {
+		sinks, err := parseOutputSinks(config.OutputFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -o: %v\n", err)
+			os.Exit(2)
+		}
+		config.outputSinks = sinks
+		config.OutputFormat, config.OutputFile = sinks[0].format, sinks[0].path
+	}
 	if config.QPS <= 0 {
 		config.QPS = defaultQPS
 	}
@@ -117,10 +460,334 @@ func parseFlags() *Config {
 	if config.Workers <= 0 {
 		config.Workers = defaultWorkers
 	}
+	if config.AutoWorkers {
+		if config.MinWorkers < 1 || config.MaxWorkers < config.MinWorkers {
+			fmt.Fprintf(os.Stderr, "Invalid -min-workers %d / -max-workers %d: need 1 <= min <= max\n",
+				config.MinWorkers, config.MaxWorkers)
+			os.Exit(2)
+		}
+		if config.Workers < config.MinWorkers {
+			config.Workers = config.MinWorkers
+		}
+		if config.Workers > config.MaxWorkers {
+			config.Workers = config.MaxWorkers
+		}
+	}
+	level, err := parseLogLevel(config.LogLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -log-level: %v\n", err)
+		os.Exit(2)
+	}
+	if config.Verbose && level < levelDebug {
+		level = levelDebug
+	}
+	config.logLevel = level
+	config.Verbose = level >= levelDebug
+	
+	if config.FastFlux {
+		if config.ProbeCount < 2 {
+			fmt.Fprintln(os.Stderr, "-fastflux requires -probe-count of at least 2")
+			os.Exit(2)
+		}
+		if config.FastFluxThreshold < 0 || config.FastFluxThreshold > 1 {
+			fmt.Fprintf(os.Stderr, "Invalid -fastflux-threshold %v: must be between 0 and 1\n", config.FastFluxThreshold)
+			os.Exit(2)
+		}
+	}
+	if config.AbortErrorRate < 0 || config.AbortErrorRate > 1 {
+		fmt.Fprintf(os.Stderr, "Invalid -abort-on-error-rate %v: must be between 0 and 1\n", config.AbortErrorRate)
+		os.Exit(2)
+	}
+	if config.RefusedCooldown < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -refused-cooldown %v: must not be negative\n", config.RefusedCooldown)
+		os.Exit(2)
+	}
+	if config.Jitter < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -jitter %v: must not be negative\n", config.Jitter)
+		os.Exit(2)
+	}
+	if config.BatchSize < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -batch-size %d: must not be negative\n", config.BatchSize)
+		os.Exit(2)
+	}
+	if config.FetchTimeout <= 0 {
+		config.FetchTimeout = defaultFetchTimeout
+	}
+	if config.InconsistencyWindow <= 0 {
+		config.InconsistencyWindow = defaultInconsistencyWindow
+	}
+	if config.AbortSample <= 0 {
+		config.AbortSample = defaultAbortSample
+	}
+	if config.JSONPretty && (config.Syslog || config.ESURL != "") {
+		fmt.Fprintln(os.Stderr, "-json-pretty cannot be used with -syslog or -es-url, which need one record per line")
+		os.Exit(2)
+	}
+	if config.ESURL != "" {
+		if config.OutputFormat != "json" && config.OutputFormat != "json-grouped" {
+			fmt.Fprintln(os.Stderr, "-es-url requires -f json or -f json-grouped")
+			os.Exit(2)
+		}
+		if strings.TrimSpace(config.ESIndex) == "" {
+			config.ESIndex = defaultESIndex
+		}
+		if config.ESBatchSize <= 0 {
+			config.ESBatchSize = defaultESBatchSize
+		}
+		if config.ESFlushInterval <= 0 {
+			config.ESFlushInterval = defaultESFlushInterval
+		}
+	}
+	if config.ProbeCount < 1 {
+		config.ProbeCount = 1
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = config.Workers
+	}
+	if config.ResultBuffer <= 0 {
+		config.ResultBuffer = config.Workers * 2
+	}
+	if config.RecursiveBrute < 0 {
+		config.RecursiveBrute = 0
+	}
+	if strings.TrimSpace(config.TestDomain) == "" {
+		config.TestDomain = defaultTestDomain
+	}
+	if config.Port < 0 || config.Port > 65535 {
+		fmt.Fprintf(os.Stderr, "Invalid -port %d: must be between 1 and 65535\n", config.Port)
+		os.Exit(2)
+	}
+	if config.RotateSize != "" {
+		size, err := parseSize(config.RotateSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -rotate-size: %v\n", err)
+			os.Exit(2)
+		}
+		config.rotateBytes = size
+	}
+	if config.MaxBPS != "" {
+		bps, err := parseSize(config.MaxBPS)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -max-bps: %v\n", err)
+			os.Exit(2)
+		}
+		config.maxBytesPerSecond = bps
+	}
+	if (config.rotateBytes > 0 || config.RotateCount > 0) && config.OutputFile == "" && len(config.outputSinks) == 0 {
+		fmt.Fprintln(os.Stderr, "-rotate-size and -rotate-count require -o")
+		os.Exit(2)
+	}
+	if config.TransportOrder != "" {
+		order, err := parseTransportOrder(config.TransportOrder)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -transport-order: %v\n", err)
+			os.Exit(2)
+		}
+		config.transportOrder = order
+	}
+	retryOn, err := parseRetryOn(config.RetryOn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -retry-on: %v\n", err)
+		os.Exit(2)
+	}
+	config.retryOn = retryOn
+	if config.EDNSVersion < 0 || config.EDNSVersion > 255 {
+		fmt.Fprintf(os.Stderr, "Invalid -edns-version %d: must be between 0 and 255\n", config.EDNSVersion)
+		os.Exit(2)
+	}
+	if config.EDNSZ < 0 || config.EDNSZ > 0x7FFF {
+		fmt.Fprintf(os.Stderr, "Invalid -edns-z %d: must be between 0 and 32767\n", config.EDNSZ)
+		os.Exit(2)
+	}
+	if config.ProgressFD != 0 {
+		if config.ProgressFD < 0 {
+			fmt.Fprintf(os.Stderr, "Invalid -progress-fd %d\n", config.ProgressFD)
+			os.Exit(2)
+		}
+		config.progressOut = os.NewFile(uintptr(config.ProgressFD), "progress")
+	}
+	if config.QueryLog != "" {
+		queryLog, err := openQueryLog(config.QueryLog)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -query-log: %v\n", err)
+			os.Exit(2)
+		}
+		config.queryLog = queryLog
+	}
+	if config.RandomizeWindow <= 0 {
+		config.RandomizeWindow = defaultRandomizeWindow
+	}
+	if config.Sample < 0 {
+		fmt.Fprintln(os.Stderr, "-sample cannot be negative")
+		os.Exit(2)
+	}
+	if config.SpillAfter <= 0 {
+		config.SpillAfter = defaultSpillAfter
+	}
+	if config.ResolverTestTimeout <= 0 {
+		config.ResolverTestTimeout = defaultResolverTestTimeout
+	}
+	if config.LowMemory {
+		applyLowMemory(config)
+	}
+	
+	options, err := parseEDNSOptions(config.EDNSOptions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -edns-option: %v\n", err)
+		os.Exit(2)
+	}
+	config.ednsOptions = options
+	
+	comma, err := parseCSVDelimiter(config.CSVDelimiter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -csv-delim: %v\n", err)
+		os.Exit(2)
+	}
+	config.csvComma = comma
+	
+	if config.CheckLame && config.Proxy != "" {
+		fmt.Fprintln(os.Stderr, "-check-lame queries nameservers over UDP and cannot be combined with -proxy")
+		os.Exit(2)
+	}
+	if config.CheckOpen {
+		if config.NoRecurse {
+			fmt.Fprintln(os.Stderr, "-check-open sends recursive queries and cannot be combined with -no-recurse")
+			os.Exit(2)
+		}
+		if config.writesFormat("csv") {
+			fmt.Fprintln(os.Stderr, "-check-open writes simple or JSON output, not CSV")
+			os.Exit(2)
+		}
+	}
+	switch config.TypeStrategy {
+	case typeStrategyAll, typeStrategyFirstSuccess, typeStrategyPriority:
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid -type-strategy %q: must be all, first-success or priority\n", config.TypeStrategy)
+		os.Exit(2)
+	}
+	if config.FirstMatch {
+		if config.TypeStrategy == typeStrategyPriority {
+			fmt.Fprintln(os.Stderr, "-first-match cannot be combined with -type-strategy priority")
+			os.Exit(2)
+		}
+		config.TypeStrategy = typeStrategyFirstSuccess
+	}
+	if config.ExcludeTypes != "" {
+		excluded, err := parseQueryTypes(config.ExcludeTypes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -exclude-types: %v\n", err)
+			os.Exit(2)
+		}
+		config.excludedTypes = excluded
+		if _, err := parseTypeTiers(config.QueryTypes, excluded); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -t with -exclude-types: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	if config.Search != "" {
+		domains, err := parseSearchDomains(config.Search)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -search: %v\n", err)
+			os.Exit(2)
+		}
+		config.searchDomains = domains
+	}
+	if config.CompareResolvers != "" {
+		files, err := parseCompareFiles(config.CompareResolvers)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -compare-resolvers: %v\n", err)
+			os.Exit(2)
+		}
+		if config.writesFormat("csv") || config.Fields != "" || config.REPL {
+			fmt.Fprintln(os.Stderr, "-compare-resolvers cannot be combined with -f csv, -fields or -repl")
+			os.Exit(2)
+		}
+		config.compareFiles = files
+	}
+	
+	if config.Fields != "" {
+		if config.writesFormat("simple") || config.writesFormat("json-grouped") || config.writesFormat("hosts") {
+			fmt.Fprintln(os.Stderr, "-fields requires -f csv or -f json")
+			os.Exit(2)
+		}
+		if config.MergeFamilies {
+			fmt.Fprintln(os.Stderr, "-fields cannot be combined with -merge-families")
+			os.Exit(2)
+		}
+		fields, err := parseOutputFields(config.Fields)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -fields: %v\n", err)
+			os.Exit(2)
+		}
+		config.outputFields = fields
+	}
+	
+	// The count is only known up front when every record is buffered
+	// until the end of the run, which -merge-families does
+	if config.CSVRecordCount {
+		if !config.writesFormat("csv") || !config.MergeFamilies {
+			fmt.Fprintln(os.Stderr, "-csv-record-count requires -f csv and -merge-families (which -low-memory turns off)")
+			os.Exit(2)
+		}
+		if config.rotateBytes > 0 || config.RotateCount > 0 {
+			fmt.Fprintln(os.Stderr, "-csv-record-count cannot be combined with -rotate-size or -rotate-count")
+			os.Exit(2)
+		}
+	}
 
 	return config
 }
 
+// applyLowMemory caps the settings that scale memory for -low-memory and
+// turns off the features that hold results until the run ends. Explicit
+// values below the caps are kept.
+func applyLowMemory(config *Config) {
+	if config.Workers > lowMemoryWorkers {
+		config.Workers = lowMemoryWorkers
+	}
+	if config.MaxWorkers > lowMemoryWorkers {
+		config.MaxWorkers = lowMemoryWorkers
+	}
+	if config.MinWorkers > config.MaxWorkers {
+		config.MinWorkers = config.MaxWorkers
+	}
+	if config.QueueSize > config.Workers {
+		config.QueueSize = config.Workers
+	}
+	if config.ResultBuffer > config.Workers {
+		config.ResultBuffer = config.Workers
+	}
+	if config.RandomizeWindow > lowMemoryRandomizeWindow {
+		config.RandomizeWindow = lowMemoryRandomizeWindow
+	}
+	if config.ESBatchSize > lowMemoryESBatchSize {
+		config.ESBatchSize = lowMemoryESBatchSize
+	}
+	config.Cache = false
+	config.MergeFamilies = false
+	config.GroupByAnswer = false
+}
+
+// parseCSVDelimiter validates a CSV delimiter, which must be a single rune
+func parseCSVDelimiter(delim string) (rune, error) {
+	switch delim {
+	case "\\t", "tab":
+		return '\t', nil
+	}
+	
+	runes := []rune(delim)
+	if len(runes) != 1 {
+		return 0, fmt.Errorf("%q must be exactly one character", delim)
+	}
+	
+	comma := runes[0]
+	if comma == '"' || comma == '\r' || comma == '\n' || comma == utf8.RuneError {
+		return 0, fmt.Errorf("%q cannot be used as a delimiter", delim)
+	}
+	
+	return comma, nil
+}
+
 func printUsage() {
 	fmt.Println("DNS Resolver - High-performance DNS resolution tool")
 	fmt.Println()
@@ -134,9 +801,79 @@ func printUsage() {
 	fmt.Println("  dns-resolver -i domains.txt -o results.txt -t A,AAAA -qps 50")
 	fmt.Println("  dns-resolver -r 8.8.8.8,1.1.1.1 -w -v")
 	fmt.Println("  dns-resolver -rf resolvers.txt -f json -timeout 10")
+	fmt.Println("  dns-resolver -r 10.0.0.53 -test-domain corp.internal")
+	fmt.Println("  dns-resolver -no-recurse -qname-min -i domains.txt")
+	fmt.Println("  dns-resolver -r tls://1.1.1.1 -proxy socks5://127.0.0.1:1080")
+	fmt.Println("  dns-resolver -use-doh-defaults -i domains.txt")
+	fmt.Println("  dns-resolver -f csv -fields domain,value,ttl -i domains.txt")
+	fmt.Println("  dns-resolver -probe-count 5 -f json -i load-balanced.txt")
+	fmt.Println("  dns-resolver -probe-count 8 -fastflux -f json -i suspicious.txt")
+	fmt.Println("  dns-resolver -f json -es-url http://localhost:9200 -es-index dns -i domains.txt")
+	fmt.Println("  dns-resolver -repl -r 10.0.0.53")
+	fmt.Println("  dns-resolver -check-open -rf candidates.txt -f json")
+	fmt.Println("  dns-resolver -compare-resolvers isp.txt,trusted.txt -f json -i domains.txt")
+	fmt.Println("  dns-resolver -count -f json -i domains.txt")
+	fmt.Println("  dns-resolver -t NS -check-lame -f json -i zones.txt")
+	fmt.Println("  printf 'www\\nmail\\nvpn\\n' | dns-resolver -search corp.example.com,example.com")
+	fmt.Println("  printf '_dmarc.example.com TXT\\nexample.com MX\\n' | dns-resolver")
+	fmt.Println("  dns-resolver -brute -wordlist words.txt -recursive-brute 2 -max-queries 100000 -w")
+	fmt.Println()
+	fmt.Println("Send SIGUSR1 to print the current statistics without stopping the run.")
+	fmt.Println()
+	fmt.Println("-fastflux compares the A/AAAA sets of consecutive -probe-count answers. The")
+	fmt.Println("score is 1 minus their mean Jaccard similarity (shared / all addresses):")
+	fmt.Println("0 means every probe saw the same set, 1 means no two in a row overlapped.")
+	fmt.Println("Load balancers handing out slices of a large pool also score high, so treat")
+	fmt.Println("flagged names as leads to check, not verdicts.")
+	fmt.Println()
+	fmt.Println("-t ALL-COMMON queries A, AAAA, CNAME, MX, NS, TXT and SOA, so each name")
+	fmt.Println("costs seven queries where -t A costs one. It can be mixed with other")
+	fmt.Println("types, e.g. -t ALL-COMMON,SRV; a type given twice is queried once.")
+	fmt.Println()
+	fmt.Println("-w resolves three random subdomains of each base domain. By default they")
+	fmt.Println("must all return the same answer, which misses wildcards that hand out a")
+	fmt.Println("random address per name. -wildcard-strict=false only requires that all of")
+	fmt.Println("them resolve; that catches those zones, but also flags zones that answer")
+	fmt.Println("any name for other reasons, such as parking or ISP NXDOMAIN redirection,")
+	fmt.Println("and drops every result under them.")
+	fmt.Println()
+	fmt.Println("-type-strategy sets how many of the -t types each domain costs. all sends")
+	fmt.Println("every type. first-success stops at the first type with an answer, so a")
+	fmt.Println("domain costs between one query and all of them. priority queries -t in")
+	fmt.Println("tiers separated by >, e.g. -t A,CNAME>AAAA>TXT, sending a whole tier and")
+	fmt.Println("stopping after the first tier with an answer; without > it is the same as")
+	fmt.Println("all. Names that don't resolve still cost every type under any strategy.")
+	fmt.Println()
+	fmt.Println("-randomize-input holds up to -randomize-window lines in memory and sends a")
+	fmt.Println("random one each time a new line arrives. Inputs shorter than the window")
+	fmt.Println("are fully shuffled; longer ones are shuffled within a sliding window, so")
+	fmt.Println("memory stays bounded no matter how large the input is. For a uniform")
+	fmt.Println("random order over a huge input, -sample N keeps a reservoir of N lines")
+	fmt.Println("drawn evenly from the whole input and queries only those, once the input")
+	fmt.Println("ends.")
+	fmt.Println()
+	fmt.Println("-merge-families, -group-by-answer and -csv-record-count can only write once")
+	fmt.Println("the run ends. They keep up to -spill-after lines in memory and spill the")
+	fmt.Println("rest to sorted temp files, so memory stays bounded for any input size.")
+	fmt.Println()
+	fmt.Println("A port given in a resolver address (1.2.3.4:5353) always takes precedence;")
+	fmt.Println("-port only changes the default used for addresses without one.")
+	fmt.Println()
+	fmt.Println("With -no-recurse alone, queries go to the configured resolvers with RD=0,")
+	fmt.Println("so they should be authoritative for the input names. Adding -qname-min")
+	fmt.Println("walks the delegation chain from the root servers instead, revealing only")
+	fmt.Println("one extra label to each zone's servers.")
 }
 
-func setupLogger(logFile string, verbose bool) *log.Logger {
+// closeQueryLog flushes and closes the -query-log file, if one is open
+func closeQueryLog(config *Config, logger *Logger) {
+	if err := config.queryLog.Close(); err != nil {
+		logger.Errorf("Error writing query log: %v", err)
+	}
+	config.queryLog = nil
+}
+
+func setupLogger(logFile string, level logLevel, jsonLogs bool) *Logger {
 	var logOutput *os.File = os.Stderr
 	
 	if logFile != "" {
@@ -147,84 +884,244 @@ func setupLogger(logFile string, verbose bool) *log.Logger {
 		logOutput = file
 	}
 	
+	// JSON entries carry their own time and caller fields
+	if jsonLogs {
+		return newLogger(log.New(logOutput, "", 0), level, true)
+	}
+	
 	flags := log.LstdFlags
-	if verbose {
+	if level >= levelDebug {
 		flags |= log.Lshortfile
 	}
 	
-	return log.New(logOutput, "[DNS-RESOLVER] ", flags)
+	return newLogger(log.New(logOutput, "[DNS-RESOLVER] ", flags), level, false)
 }
 
 func processDNSQueries(ctx context.Context, config *Config, resolverPool *ResolverPool, 
 	rateLimiter *RateLimiter, wildcardDetector *WildcardDetector, 
-	outputHandler *OutputHandler, stats *Stats, logger *log.Logger) error {
+	outputHandler *OutputHandler, breaker *errorBreaker, stats *Stats, logger *Logger) error {
 
-	// Parse query types
-	queryTypes, err := parseQueryTypes(config.QueryTypes)
+	// Parse query types, keeping the -type-strategy priority tiers
+	typeTiers, err := parseTypeTiers(config.QueryTypes, config.excludedTypes)
 	if err != nil {
 		return fmt.Errorf("invalid query types: %v", err)
 	}
 
+	// QNAME minimisation performs its own iterative resolution, which only
+	// makes sense when recursion is not delegated to the configured resolvers
+	var iterativeResolver *IterativeResolver
+	if config.QnameMinimization {
+		if !config.NoRecurse {
+			return fmt.Errorf("-qname-min requires -no-recurse")
+		}
+		if config.Proxy != "" {
+			return fmt.Errorf("-qname-min queries servers over UDP and cannot be combined with -proxy")
+		}
+		iterativeResolver = NewIterativeResolver(config, rateLimiter, logger)
+	}
+
+	// Lame delegation checks ask each listed nameserver directly
+	var lame *lameChecker
+	if config.CheckLame {
+		lame = newLameChecker(config, rateLimiter, logger)
+	}
+
+	// In-run response cache, mostly useful for inputs with repeated names
+	var cache *ResponseCache
+	if config.Cache {
+		cache = NewResponseCache()
+	}
+
+	// Load scope restrictions
+	scopeFilter, err := NewScopeFilter(config.AllowlistFile, config.DenylistFile)
+	if err != nil {
+		return fmt.Errorf("invalid scope configuration: %v", err)
+	}
+
+	// Load the brute-force wordlist, falling back to the embedded one
+	var wordlist []string
+	if config.Wordlist != "" {
+		if wordlist, err = loadWordlist(ctx, config.Wordlist, config.FetchTimeout); err != nil {
+			return err
+		}
+	} else if config.Brute || config.RecursiveBrute > 0 {
+		wordlist = defaultWordlist()
+	}
+
+	// Recursion adds levels on top of the initial pass
+	maxDepth := config.RecursiveBrute
+	if config.Brute {
+		maxDepth++
+	}
+
 	// Setup input reader
-	inputReader, err := setupInputReader(config.InputFile)
+	inputReader, err := setupInputReader(ctx, config.InputFile, config.FetchTimeout)
 	if err != nil {
-		return fmt.Errorf("failed to setup input reader: %v", err)
+		return err
 	}
 	defer inputReader.Close()
 
-	// Create channels for communication
-	domainChan := make(chan string, config.Workers)
-	resultChan := make(chan *DNSResult, config.Workers*2)
+	// Answers are compared per resolver only when asked, as every lookup
+	// is remembered for the window
+	var consistency *consistencyTracker
+	if config.DetectInconsistency {
+		consistency = newConsistencyTracker(config.InconsistencyWindow, logger)
+	}
+
+	// Create the dispatch pipeline
+	pipeline := &queryPipeline{
+		config:            config,
+		typeTiers:         typeTiers,
+		resolverPool:      resolverPool,
+		iterativeResolver: iterativeResolver,
+		cache:             cache,
+		rateLimiter:       rateLimiter,
+		wildcardDetector:  wildcardDetector,
+		lameChecker:       lame,
+		consistency:       consistency,
+		scopeFilter:       scopeFilter,
+		budget:            newQueryBudget(config.MaxQueries),
+		wordlist:          wordlist,
+		maxDepth:          maxDepth,
+		stats:             stats,
+		logger:            logger,
+		domainChan:        make(chan *domainJob, config.QueueSize),
+		resultChan:        make(chan *DNSResult, config.ResultBuffer),
+	}
 	
 	// Start worker goroutines
 	for i := 0; i < config.Workers; i++ {
-		go dnsWorker(ctx, domainChan, resultChan, queryTypes, resolverPool, 
-			rateLimiter, config, stats, logger)
+		pipeline.workers.Add(1)
+		go pipeline.worker(ctx)
+	}
+	
+	// With -auto-workers a supervisor adjusts the count from here
+	var scaler *workerScaler
+	if config.AutoWorkers {
+		pipeline.retire = make(chan struct{})
+		scaler = startWorkerScaler(ctx, pipeline, config.Workers, config.MinWorkers, config.MaxWorkers, logger)
 	}
 
 	// Start result processor
-	go resultProcessor(ctx, resultChan, outputHandler, wildcardDetector, stats, logger)
+	processorDone := make(chan struct{})
+	go func() {
+		defer close(processorDone)
+		resultProcessor(ctx, pipeline.resultChan, outputHandler, wildcardDetector, breaker, stats, logger)
+	}()
 
-	// Start statistics reporter if verbose
-	if config.Verbose && !config.Quiet {
-		go stats.StartReporter(ctx, logger, 10*time.Second)
+	// On cancellation, let workers stop, then close resultChan so the
+	// result processor writes out what they queued before returning
+	stop := func() error {
+		scaler.Stop()
+		pipeline.workers.Wait()
+		close(pipeline.resultChan)
+		<-processorDone
+		return ctx.Err()
 	}
 
-	// Read domains and send to workers
+	// Read domains and send to workers. With -randomize-input entries pass
+	// through a bounded shuffle buffer, and with -sample only a fixed-size
+	// reservoir is kept, so memory stays flat for any input.
+	var shuffle *shuffleBuffer
+	var sample *reservoir
+	if config.Sample > 0 {
+		sample = newReservoir(config.Sample)
+	} else if config.RandomizeInput {
+		shuffle = newShuffleBuffer(config.RandomizeWindow)
+	}
+	
+	exhausted := false
 	scanner := bufio.NewScanner(inputReader)
+	lineNum := 0
 	for scanner.Scan() {
-		domain := strings.TrimSpace(scanner.Text())
-		if domain == "" || strings.HasPrefix(domain, "#") {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
 		
-		select {
-		case domainChan <- domain:
-			stats.IncrementTotal()
-		case <-ctx.Done():
-			close(domainChan)
-			return ctx.Err()
+		// A trailing type token overrides -t for this line
+		domain, types, err := parseInputLine(line)
+		if err != nil {
+			logger.Warnf("Skipping line %d (%s): %v", lineNum, line, err)
+			continue
+		}
+		
+		entry := inputEntry{domain: domain, types: types}
+		if sample != nil {
+			sample.Push(entry)
+			continue
+		}
+		if shuffle != nil {
+			var ready bool
+			if entry, ready = shuffle.Push(entry); !ready {
+				continue
+			}
+		}
+		
+		if pipeline.budget.Exhausted() {
+			exhausted = true
+			break
+		}
+		
+		for _, job := range pipeline.inputJobs(entry.domain, entry.types) {
+			if !pipeline.dispatch(ctx, job) {
+				return stop()
+			}
 		}
 	}
 	
-	close(domainChan)
-	
 	if err := scanner.Err(); err != nil {
+		// A fetched input stops reading when the run is cancelled
+		if ctx.Err() != nil {
+			return stop()
+		}
 		return fmt.Errorf("error reading input: %v", err)
 	}
+	
+	var held []inputEntry
+	switch {
+	case sample != nil:
+		held = sample.Drain()
+	case shuffle != nil && !exhausted:
+		held = shuffle.Drain()
+	}
+	for _, entry := range held {
+		if pipeline.budget.Exhausted() {
+			exhausted = true
+			break
+		}
+		
+		for _, job := range pipeline.inputJobs(entry.domain, entry.types) {
+			if !pipeline.dispatch(ctx, job) {
+				return stop()
+			}
+		}
+	}
+	
+	if exhausted {
+		logger.Printf("Query limit of %d reached, ignoring remaining input", config.MaxQueries)
+	}
 
-	// Wait for all workers to finish
+	// Wait until every queued domain, including generated ones, is done
 	logger.Println("Waiting for workers to complete...")
-	for stats.GetProcessed() < stats.GetTotal() {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(100 * time.Millisecond):
-			// Continue waiting
-		}
+	pendingDone := make(chan struct{})
+	go func() {
+		pipeline.pending.Wait()
+		close(pendingDone)
+	}()
+	
+	select {
+	case <-pendingDone:
+	case <-ctx.Done():
+		return stop()
 	}
 
-	close(resultChan)
+	scaler.Stop()
+	close(pipeline.domainChan)
+	pipeline.workers.Wait()
+	close(pipeline.resultChan)
+	<-processorDone
 	return nil
 }
 
@@ -239,23 +1136,42 @@ func parseQueryTypes(queryTypesStr string) ([]uint16, error) {
 		"SOA":   dns.TypeSOA,
 		"PTR":   dns.TypePTR,
 		"SRV":   dns.TypeSRV,
+		"URI":   dns.TypeURI,
+		"TLSA":  dns.TypeTLSA,
 	}
 	
-	types := strings.Split(strings.ToUpper(queryTypesStr), ",")
+	// Named sets of types, expanded in place
+	aliases := map[string][]uint16{
+		"ALL-COMMON": commonQueryTypes,
+	}
+	
+	// Priority tiers only matter to -type-strategy, so > separates types
+	// like a comma here
+	types := strings.Split(strings.ReplaceAll(strings.ToUpper(queryTypesStr), ">", ","), ",")
 	var result []uint16
 	
 	for _, t := range types {
 		t = strings.TrimSpace(t)
-		if qtype, exists := typeMap[t]; exists {
-			result = append(result, qtype)
+		var parsed []uint16
+		if expanded, exists := aliases[t]; exists {
+			parsed = expanded
+		} else if qtype, exists := typeMap[t]; exists {
+			parsed = []uint16{qtype}
 		} else {
 			// Try parsing as numeric type
 			if num, err := strconv.Atoi(t); err == nil && num > 0 && num < 65536 {
-				result = append(result, uint16(num))
+				parsed = []uint16{uint16(num)}
 			} else {
 				return nil, fmt.Errorf("unknown query type: %s", t)
 			}
 		}
+		
+		// A type given twice, directly or through an alias, is queried once
+		for _, qtype := range parsed {
+			if !containsType(result, qtype) {
+				result = append(result, qtype)
+			}
+		}
 	}
 	
 	if len(result) == 0 {
@@ -265,11 +1181,147 @@ func parseQueryTypes(queryTypesStr string) ([]uint16, error) {
 	return result, nil
 }
 
-func setupInputReader(inputFile string) (*os.File, error) {
+// commonQueryTypes is the -t ALL-COMMON set
+var commonQueryTypes = []uint16{
+	dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeMX, dns.TypeNS, dns.TypeTXT, dns.TypeSOA,
+}
+
+// containsType reports whether types includes qtype
+func containsType(types []uint16, qtype uint16) bool {
+	for _, t := range types {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutTypes returns types minus the excluded ones
+func withoutTypes(types, excluded []uint16) []uint16 {
+	var kept []uint16
+	for _, qtype := range types {
+		if !containsType(excluded, qtype) {
+			kept = append(kept, qtype)
+		}
+	}
+	return kept
+}
+
+// parseTypeTiers parses a -t list into -type-strategy priority tiers,
+// separated by >, each a comma-separated list of types
+func parseTypeTiers(value string, excluded []uint16) ([][]uint16, error) {
+	var tiers [][]uint16
+	for _, tier := range strings.Split(value, ">") {
+		types, err := parseQueryTypes(tier)
+		if err != nil {
+			return nil, err
+		}
+		if types = withoutTypes(types, excluded); len(types) > 0 {
+			tiers = append(tiers, types)
+		}
+	}
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("every type in %s is excluded", value)
+	}
+	return tiers, nil
+}
+
+// parseSize parses a byte size such as 500KB, 100MB or 2GB. Units are
+// powers of 1024 and a bare number is taken as bytes.
+func parseSize(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+	
+	value = strings.ToUpper(strings.TrimSpace(value))
+	scale := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			scale = unit.scale
+			break
+		}
+	}
+	
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("expected a positive size like 100MB, got %q", value)
+	}
+	
+	return n * scale, nil
+}
+
+// parseRetryOn parses a comma-separated -retry-on list into the set of
+// outcomes to retry
+func parseRetryOn(value string) (map[string]bool, error) {
+	retryOn := make(map[string]bool)
+	for _, outcome := range strings.Split(strings.ToLower(value), ",") {
+		outcome = strings.TrimSpace(outcome)
+		switch outcome {
+		case retryOnTimeout, retryOnError, retryOnServfail, retryOnRefused, retryOnEmpty:
+			retryOn[outcome] = true
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown outcome %q (want timeout, error, servfail, refused or empty)", outcome)
+		}
+	}
+	return retryOn, nil
+}
+
+// retryableAnswer returns the -retry-on outcome a response counts as, or
+// "" when it is an answer to keep
+func retryableAnswer(response *dns.Msg) string {
+	switch {
+	case response.Rcode == dns.RcodeServerFailure:
+		return retryOnServfail
+	case response.Rcode == dns.RcodeRefused:
+		return retryOnRefused
+	case response.Rcode == dns.RcodeSuccess && len(response.Answer) == 0:
+		return retryOnEmpty
+	}
+	return ""
+}
+
+// parseTransportOrder parses a comma-separated list of resolver transports
+func parseTransportOrder(value string) ([]string, error) {
+	var order []string
+	for _, transport := range strings.Split(strings.ToLower(value), ",") {
+		transport = strings.TrimSpace(transport)
+		switch transport {
+		case transportUDP, transportTCP, transportTLS, transportHTTPS:
+			order = append(order, transport)
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown transport %q (want udp, tcp, tls or https)", transport)
+		}
+	}
+	
+	if len(order) == 0 {
+		return nil, fmt.Errorf("no transports given")
+	}
+	
+	return order, nil
+}
+
+func setupInputReader(ctx context.Context, inputFile string, fetchTimeout time.Duration) (io.ReadCloser, error) {
 	if inputFile == "" {
 		return os.Stdin, nil
 	}
 	
+	if isURL(inputFile) {
+		body, err := openURL(ctx, inputFile, fetchTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch input: %v", err)
+		}
+		return body, nil
+	}
+	
 	file, err := os.Open(inputFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open input file: %v", err)
@@ -278,85 +1330,259 @@ func setupInputReader(inputFile string) (*os.File, error) {
 	return file, nil
 }
 
-func dnsWorker(ctx context.Context, domainChan <-chan string, resultChan chan<- *DNSResult,
-	queryTypes []uint16, resolverPool *ResolverPool, rateLimiter *RateLimiter,
-	config *Config, stats *Stats, logger *log.Logger) {
-	
-	for {
-		select {
-		case domain, ok := <-domainChan:
-			if !ok {
-				return
-			}
-			
-			for _, qtype := range queryTypes {
-				// Apply rate limiting
-				rateLimiter.Wait(ctx)
-				
-				// Perform DNS query with retries
-				result := performDNSQuery(ctx, domain, qtype, resolverPool, config, logger)
-				
-				select {
-				case resultChan <- result:
-				case <-ctx.Done():
-					return
-				}
-			}
-			
-		case <-ctx.Done():
-			return
-		}
-	}
-}
-
 func performDNSQuery(ctx context.Context, domain string, qtype uint16, 
-	resolverPool *ResolverPool, config *Config, logger *log.Logger) *DNSResult {
+	resolverPool *ResolverPool, config *Config, logger *Logger) *DNSResult {
 	
 	var lastErr error
+	var lastResolver string
+	var lastAnswer *DNSResult
+	refusals := 0
 	
 	for attempt := 0; attempt <= config.Retries; attempt++ {
-		resolver := resolverPool.GetResolver()
+		// Step through the transport order as attempts fail, staying on the last
+		pick := func() *DNSResolver {
+			resolver := resolverPool.GetResolver()
+			if resolver != nil && len(config.transportOrder) > 0 {
+				step := attempt
+				if step >= len(config.transportOrder) {
+					step = len(config.transportOrder) - 1
+				}
+				resolver = resolverPool.Variant(resolver, config.transportOrder[step], config)
+			}
+			return resolver
+		}
+		
+		resolver := pick()
 		if resolver == nil {
 			lastErr = fmt.Errorf("no resolvers available")
 			continue
 		}
 		
-		msg := &dns.Msg{}
-		msg.SetQuestion(dns.Fqdn(domain), qtype)
-		msg.RecursionDesired = true
+		response, rtt, sentEDNS, resolver, err := exchangeHedged(ctx, resolver, pick, domain, qtype, config, logger)
 		
-		ctx, cancel := context.WithTimeout(ctx, time.Duration(config.Timeout)*time.Second)
-		response, _, err := resolver.ExchangeContext(ctx, msg, resolver.Address)
-		cancel()
+		// Servers that predate EDNS may answer FORMERR to an OPT record, so
+		// ask the same server once more without one (RFC 6891 section 7).
+		// TCP and TLS queries carry one for keepalive even without EDNS
+		// options, so it is the query actually sent that counts.
+		fallback := false
+		if err == nil && response.Rcode == dns.RcodeFormatError && sentEDNS {
+			plainResponse, plainRTT, _, plainErr := exchangeOnce(ctx, resolver, domain, qtype, withoutEDNS(config))
+			if plainErr == nil {
+				logger.Debugf("FORMERR from %s for %s with EDNS, retried without it: %s", 
+					resolver.Address, domain, dns.RcodeToString[plainResponse.Rcode])
+				response, rtt, fallback = plainResponse, plainRTT, true
+			}
+		}
 		
 		if err != nil {
 			lastErr = err
-			if config.Verbose {
-				logger.Printf("Query failed for %s (type %d, attempt %d): %v", 
-					domain, qtype, attempt+1, err)
+			lastResolver = resolver.Address
+			
+			// A refused connection means the resolver port is closed, so move
+			// straight on to another resolver without spending a retry
+			if isConnectionRefused(err) && refusals < resolverPool.GetResolverCount() {
+				refusals++
+				attempt--
+				logger.Debugf("Connection refused by %s for %s, switching resolver", 
+					resolver.Address, domain)
+				continue
+			}
+			
+			kind := queryErrorKind(err)
+			logger.Debugf("Query failed for %s (type %d, attempt %d, %s): %v", 
+				domain, qtype, attempt+1, kind, err)
+			
+			// Connection refusals beyond the resolver count are plain errors
+			if kind == "refused" {
+				kind = retryOnError
+			}
+			if !config.retryOn[kind] {
+				break
 			}
 			continue
 		}
 		
-		return &DNSResult{
+		result := &DNSResult{
 			Domain:   domain,
 			Type:     qtype,
 			Response: response,
 			Error:    nil,
 			Resolver: resolver.Address,
+			Latency:  rtt,
+			EDE:      extractEDE(response),
+			
+			EDNSFallback: fallback,
+		}
+		
+		// Answers chosen with -retry-on are asked again, keeping the last
+		// one in case every attempt gives the same
+		if outcome := retryableAnswer(response); outcome != "" && config.retryOn[outcome] && attempt < config.Retries {
+			logger.Debugf("Retrying %s (type %d, attempt %d) after %s answer from %s", 
+				domain, qtype, attempt+1, outcome, resolver.Address)
+			lastAnswer = result
+			continue
 		}
+		
+		return result
+	}
+	
+	// An answer beats an error from a later attempt
+	if lastAnswer != nil {
+		return lastAnswer
 	}
 	
 	return &DNSResult{
-		Domain: domain,
-		Type:   qtype,
-		Error:  lastErr,
+		Domain:   domain,
+		Type:     qtype,
+		Error:    lastErr,
+		Resolver: lastResolver,
 	}
 }
 
+// queryErrorKind classifies a query error for logs: timeout, refused or error
+func queryErrorKind(err error) string {
+	switch {
+	case isTimeout(err):
+		return "timeout"
+	case isConnectionRefused(err):
+		return "refused"
+	default:
+		return "error"
+	}
+}
+
+// exchangeHedged sends the query to resolver and, with -hedge-delay set,
+// races a backup from pick if no answer has arrived by then. The first
+// successful response wins; it returns the resolver that produced the
+// returned response or error, and whether that query carried an OPT record.
+func exchangeHedged(ctx context.Context, resolver *DNSResolver, pick func() *DNSResolver, 
+	domain string, qtype uint16, config *Config, logger *Logger) (*dns.Msg, time.Duration, bool, *DNSResolver, error) {
+	
+	if config.HedgeDelay <= 0 {
+		response, rtt, sentEDNS, err := exchangeOnce(ctx, resolver, domain, qtype, config)
+		return response, rtt, sentEDNS, resolver, err
+	}
+	
+	type outcome struct {
+		response *dns.Msg
+		rtt      time.Duration
+		sentEDNS bool
+		resolver *DNSResolver
+		err      error
+	}
+	
+	// The loser is cancelled once a winner is known
+	hedgeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	
+	outcomes := make(chan outcome, 2)
+	launch := func(r *DNSResolver) {
+		go func() {
+			response, rtt, sentEDNS, err := exchangeOnce(hedgeCtx, r, domain, qtype, config)
+			outcomes <- outcome{response, rtt, sentEDNS, r, err}
+		}()
+	}
+	
+	launch(resolver)
+	inflight := 1
+	
+	timer := time.NewTimer(config.HedgeDelay)
+	defer timer.Stop()
+	
+	var last outcome
+	for {
+		select {
+		case <-timer.C:
+			backup := pick()
+			if backup == nil || backup == resolver {
+				continue
+			}
+			logger.Debugf("No answer from %s for %s after %v, hedging to %s", 
+				resolver.Address, domain, config.HedgeDelay, backup.Address)
+			launch(backup)
+			inflight++
+			
+		case result := <-outcomes:
+			inflight--
+			if result.err == nil {
+				return result.response, result.rtt, result.sentEDNS, result.resolver, nil
+			}
+			last = result
+			
+			// Without a backup in flight there is nothing left to wait for
+			if inflight == 0 {
+				return nil, last.rtt, false, last.resolver, last.err
+			}
+		}
+	}
+}
+
+// exchangeOnce sends a single query to resolver, updating its health and
+// cookie state. It also reports whether the query sent had an OPT record,
+// which the transport may have added.
+func exchangeOnce(ctx context.Context, resolver *DNSResolver, domain string, qtype uint16, 
+	config *Config) (*dns.Msg, time.Duration, bool, error) {
+	
+	msg := &dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(domain), qtype)
+	msg.RecursionDesired = !config.NoRecurse
+	msg.CheckingDisabled = config.CheckingDisabled
+	
+	if len(config.ednsOptions) > 0 {
+		opt := ednsOPT(msg)
+		opt.Option = append(opt.Option, config.ednsOptions...)
+	}
+	
+	// Deliberately unusual EDNS headers, for probing resolver behaviour
+	if config.EDNSVersion > 0 || config.EDNSZ > 0 {
+		opt := ednsOPT(msg)
+		opt.SetVersion(uint8(config.EDNSVersion))
+		opt.SetZ(uint16(config.EDNSZ))
+	}
+	
+	if config.Cookies {
+		resolver.AttachCookie(msg)
+	}
+	
+	// Waiting for a -per-resolver-conc slot doesn't count toward the timeout
+	release, err := resolver.Acquire(ctx)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	
+	queryCtx, cancel := context.WithTimeout(ctx, time.Duration(config.Timeout)*time.Second)
+	if config.plainQuery {
+		queryCtx = withoutKeepalive(queryCtx)
+	}
+	response, rtt, err := resolver.ExchangeContext(queryCtx, msg, resolver.Address)
+	cancel()
+	release()
+	sentEDNS := msg.IsEdns0() != nil
+	
+	if err != nil {
+		// A query abandoned by the caller says nothing about the resolver
+		if ctx.Err() == nil {
+			resolver.ReportFailure(err)
+		}
+		return nil, rtt, sentEDNS, err
+	}
+	
+	resolver.ReportSuccess(rtt)
+	resolver.ReportRcode(response.Rcode)
+	
+	if config.Cookies {
+		resolver.StoreCookie(response)
+	}
+	
+	return response, rtt, sentEDNS, nil
+}
+
+// resultProcessor writes the results of the run as they arrive. When ctx
+// is cancelled, as by -max-runtime, the results already queued are still
+// written: it drains resultChan until the caller closes it.
 func resultProcessor(ctx context.Context, resultChan <-chan *DNSResult, 
 	outputHandler *OutputHandler, wildcardDetector *WildcardDetector, 
-	stats *Stats, logger *log.Logger) {
+	breaker *errorBreaker, stats *Stats, logger *Logger) {
 	
 	for {
 		select {
@@ -364,33 +1590,92 @@ func resultProcessor(ctx context.Context, resultChan <-chan *DNSResult,
 			if !ok {
 				return
 			}
+			processResult(ctx, result, outputHandler, wildcardDetector, breaker, stats, logger)
 			
-			stats.IncrementProcessed()
-			
-			if result.Error != nil {
-				stats.IncrementErrors()
-				if logger != nil {
-					logger.Printf("DNS query error for %s: %v", result.Domain, result.Error)
-				}
-				continue
-			}
-			
-			// Check for wildcard if detector is enabled
-			if wildcardDetector != nil && wildcardDetector.IsWildcard(result) {
-				stats.IncrementWildcards()
-				continue
-			}
+		case <-ctx.Done():
+			// Wildcard checks still need a live context to query with
+			drainCtx, cancel := context.WithTimeout(context.Background(), resultDrainTimeout)
+			defer cancel()
 			
-			// Process successful result
-			if result.Response != nil && len(result.Response.Answer) > 0 {
-				stats.IncrementSuccessful()
-				outputHandler.WriteResult(result)
-			} else {
-				stats.IncrementNoAnswer()
+			for result := range resultChan {
+				processResult(drainCtx, result, outputHandler, wildcardDetector, breaker, stats, logger)
 			}
-			
-		case <-ctx.Done():
 			return
 		}
 	}
 }
+
+// processResult counts a result in the stats and writes it to the output
+func processResult(ctx context.Context, result *DNSResult, outputHandler *OutputHandler, 
+	wildcardDetector *WildcardDetector, breaker *errorBreaker, stats *Stats, logger *Logger) {
+	
+	stats.IncrementProcessed()
+	
+	if result.EDE != nil {
+		stats.IncrementEDE(result.EDE.Code, result.EDE.Name)
+	}
+	if result.EDNSFallback {
+		stats.IncrementEDNSFallbacks()
+	}
+	if result.Inconsistent {
+		stats.IncrementInconsistent()
+	}
+	breaker.Record(result.Error != nil)
+	
+	if result.Error != nil {
+		stats.IncrementErrors()
+		if logger != nil {
+			logger.WithFields(logFields{
+				"domain":     result.Domain,
+				"type":       dns.TypeToString[result.Type],
+				"resolver":   result.Resolver,
+				"error_kind": queryErrorKind(result.Error),
+				"error":      result.Error,
+			}).Warnf("DNS query error for %s: %v", result.Domain, result.Error)
+		}
+		return
+	}
+	
+	outputHandler.DumpRaw(result)
+	
+	// Check for wildcard if detector is enabled
+	if wildcardDetector != nil && wildcardDetector.IsWildcard(ctx, result) {
+		stats.IncrementWildcards()
+		return
+	}
+	
+	// Inline wildcard answers are kept in the output, flagged
+	if result.Wildcard {
+		stats.IncrementWildcards()
+	}
+	
+	// Process successful result. With -require-final-type an answer of
+	// only aliases counts as no answer.
+	if result.Response != nil && len(result.Response.Answer) > 0 && !result.CNAMEOnly {
+		stats.IncrementSuccessful()
+		stats.MarkResolved(result.Domain)
+		outputHandler.WriteResult(result)
+	} else {
+		stats.IncrementNoAnswer()
+		if result.CNAMEOnly {
+			stats.IncrementCNAMEOnly()
+		}
+		
+		// Only written for NXDOMAIN with -emit-nxdomain, or for the
+		// aliases of a -require-final-type answer
+		outputHandler.WriteResult(result)
+		
+		// The extended error usually explains a SERVFAIL or REFUSED
+		if result.EDE != nil && logger != nil {
+			logger.Infof("Extended DNS error from %s for %s: %s", 
+				result.Resolver, result.Domain, result.EDE)
+		}
+		
+		// Extended rcodes such as BADVERS only come from EDNS and
+		// are worth surfacing when probing resolvers
+		if result.Response != nil && result.Response.Rcode > 0xF && logger != nil {
+			logger.Infof("Extended rcode %s from %s for %s", 
+				dns.RcodeToString[result.Response.Rcode], result.Resolver, result.Domain)
+		}
+	}
+}
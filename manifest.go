@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"runtime"
+	"time"
+)
+
+// RunManifest records how a run was made for -manifest: the effective
+// configuration after defaults, the resolvers that passed the startup
+// test, the tool version and the host. Nothing is redacted, so proxy and
+// Elasticsearch URLs appear with any credentials they carry.
+type RunManifest struct {
+	Tool      string       `json:"tool"`
+	Version   string       `json:"version"`
+	Args      []string     `json:"args"`
+	StartedAt string       `json:"started_at"`
+	EndedAt   string       `json:"ended_at"`
+	Error     string       `json:"error,omitempty"`
+	Config    *Config      `json:"config"`
+	Resolvers []string     `json:"resolvers"`
+	Host      ManifestHost `json:"host"`
+}
+
+// ManifestHost describes the machine a run was made on
+type ManifestHost struct {
+	Hostname  string `json:"hostname"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	NumCPU    int    `json:"num_cpu"`
+	GoVersion string `json:"go_version"`
+	PID       int    `json:"pid"`
+}
+
+// writeManifest writes the manifest of a run that started at startedAt
+// and ended now, with runErr when it did not complete
+func writeManifest(path string, config *Config, resolverPool *ResolverPool, startedAt time.Time, runErr error) error {
+	hostname, _ := os.Hostname()
+
+	manifest := RunManifest{
+		Tool:      "dns-resolver",
+		Version:   toolVersion,
+		Args:      os.Args[1:],
+		StartedAt: startedAt.UTC().Format(time.RFC3339),
+		EndedAt:   time.Now().UTC().Format(time.RFC3339),
+		Config:    config,
+		Resolvers: resolverPool.Addresses(),
+		Host: ManifestHost{
+			Hostname:  hostname,
+			OS:        runtime.GOOS,
+			Arch:      runtime.GOARCH,
+			NumCPU:    runtime.NumCPU(),
+			GoVersion: runtime.Version(),
+			PID:       os.Getpid(),
+		},
+	}
+	if runErr != nil {
+		manifest.Error = runErr.Error()
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// MergedRecord is the combined A and AAAA answer for one name
+type MergedRecord struct {
+	SchemaVersion int `json:"schema_version"`
+
+	Domain   string   `json:"domain"`
+	IPv4     []string `json:"ipv4"`
+	IPv6     []string `json:"ipv6"`
+	TTL      uint32   `json:"ttl"`
+	Resolver string   `json:"resolver"`
+
+	// ObservedAt is when the record was written, set with -timestamp
+	ObservedAt string `json:"observed_at,omitempty"`
+}
+
+// familyMerger buffers A and AAAA answers per domain until the end of the
+// run so each name can be written once with both address families. The
+// answers go through a spillSorter, so memory stays bounded however many
+// names there are.
+type familyMerger struct {
+	answers *spillSorter
+	limit   int
+	seq     int64
+	mutex   sync.Mutex
+}
+
+// newFamilyMerger creates an empty merger holding up to limit answer lines
+// in memory
+func newFamilyMerger(limit int) *familyMerger {
+	return &familyMerger{
+		answers: newSpillSorter(limit),
+		limit:   limit,
+	}
+}
+
+// Accepts reports whether a result belongs to an address family that is merged
+func (m *familyMerger) Accepts(result *DNSResult) bool {
+	return result.Type == dns.TypeA || result.Type == dns.TypeAAAA
+}
+
+// Add buffers the address answers of a result under its domain. Each
+// answer becomes a line of the lowercased domain, the result's sequence
+// number and the answer's position, so sorting the lines groups them by
+// name in the order they arrived. Position 0 marks the result itself.
+func (m *familyMerger) Add(result *DNSResult) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.seq++
+	key := strings.ToLower(result.Domain)
+	prefix := fmt.Sprintf("%s\t%020d", key, m.seq)
+
+	if err := m.answers.Add(fmt.Sprintf("%s\t%06d\t%s\t%s", prefix, 0, result.Resolver, result.Domain)); err != nil {
+		return err
+	}
+
+	for i, rr := range result.Response.Answer {
+		var family, address string
+		switch r := rr.(type) {
+		case *dns.A:
+			family, address = "4", r.A.String()
+		case *dns.AAAA:
+			family, address = "6", r.AAAA.String()
+		default:
+			continue
+		}
+
+		line := fmt.Sprintf("%s\t%06d\t%s\t%s\t%d", prefix, i+1, family, address, rr.Header().Ttl)
+		if err := m.answers.Add(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Drain merges the buffered answers and returns the merged records, in
+// the order their domains first appeared, and empties the merger
+func (m *familyMerger) Drain() (*mergedRecords, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	records := &mergedRecords{sorted: newSpillSorter(m.limit)}
+
+	var record *MergedRecord
+	var key, firstSeq string
+	var seen map[string]bool
+
+	flush := func() error {
+		if record == nil {
+			return nil
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		records.count++
+		return records.sorted.Add(firstSeq + "\t" + string(data))
+	}
+
+	err := m.answers.Each(func(line string) error {
+		fields := strings.Split(line, "\t")
+		marker := len(fields) == 5 && fields[2] == "000000"
+		if !marker && len(fields) != 6 {
+			return fmt.Errorf("malformed merge line %q", line)
+		}
+
+		// The marker of a name's first result sorts before its answers
+		// and carries the domain and resolver written
+		if record == nil || fields[0] != key {
+			if err := flush(); err != nil {
+				return err
+			}
+			key, firstSeq = fields[0], fields[1]
+			seen = make(map[string]bool)
+			record = &MergedRecord{
+				SchemaVersion: outputSchemaVersion,
+
+				Domain:   fields[4],
+				IPv4:     []string{},
+				IPv6:     []string{},
+				Resolver: fields[3],
+			}
+		}
+		if marker {
+			return nil
+		}
+
+		family, address := fields[3], fields[4]
+		if seen[address] {
+			return nil
+		}
+		seen[address] = true
+
+		ttl, err := strconv.ParseUint(fields[5], 10, 32)
+		if err != nil {
+			return fmt.Errorf("malformed merge line %q", line)
+		}
+		if len(record.IPv4)+len(record.IPv6) == 0 || uint32(ttl) < record.TTL {
+			record.TTL = uint32(ttl)
+		}
+
+		if family == "4" {
+			record.IPv4 = append(record.IPv4, address)
+		} else {
+			record.IPv6 = append(record.IPv6, address)
+		}
+		return nil
+	})
+	m.seq = 0
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		records.sorted.Close()
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// mergedRecords are the records of a drained familyMerger, kept sorted by
+// the order their domains first appeared
+type mergedRecords struct {
+	sorted *spillSorter
+	count  int
+}
+
+// Len returns the number of merged records
+func (r *mergedRecords) Len() int {
+	return r.count
+}
+
+// Each calls fn for every merged record in order
+func (r *mergedRecords) Each(fn func(*MergedRecord)) error {
+	return r.sorted.Each(func(line string) error {
+		_, data, _ := strings.Cut(line, "\t")
+		record := &MergedRecord{}
+		if err := json.Unmarshal([]byte(data), record); err != nil {
+			return err
+		}
+		fn(record)
+		return nil
+	})
+}
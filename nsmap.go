@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// resolverRoute sends names under a domain suffix to their own resolvers
+type resolverRoute struct {
+	suffix string
+	pool   *ResolverPool
+}
+
+// nsMapEntry is one parsed line of a -ns-map file
+type nsMapEntry struct {
+	suffix    string
+	addresses []string
+}
+
+// loadNameserverMap reads a -ns-map file of suffix=resolver[,resolver...]
+// lines. Blank lines and lines starting with # are skipped.
+func loadNameserverMap(filename string) ([]nsMapEntry, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open nameserver map: %v", err)
+	}
+	defer file.Close()
+
+	var entries []nsMapEntry
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		suffix, list, found := strings.Cut(line, "=")
+		suffix = strings.Trim(strings.ToLower(strings.TrimSpace(suffix)), ".")
+		if !found || suffix == "" {
+			return nil, fmt.Errorf("line %d: expected suffix=resolver[,resolver...], got %q", lineNum, line)
+		}
+
+		var addresses []string
+		for _, addr := range strings.Split(list, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				addresses = append(addresses, addr)
+			}
+		}
+		if len(addresses) == 0 {
+			return nil, fmt.Errorf("line %d: no resolvers for %s", lineNum, suffix)
+		}
+
+		entries = append(entries, nsMapEntry{suffix: suffix, addresses: addresses})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading nameserver map: %v", err)
+	}
+
+	return entries, nil
+}
+
+// addRoutes creates a resolver pool for each -ns-map entry. A route whose
+// resolvers all fail their test is dropped with a warning, so its names
+// fall back to the default pool.
+func (p *ResolverPool) addRoutes(ctx context.Context, entries []nsMapEntry, config *Config) {
+	for _, entry := range entries {
+		pool := &ResolverPool{
+			proxyDialer: p.proxyDialer,
+			bandwidth:   p.bandwidth,
+			logger:      p.logger,
+		}
+		addresses, _ := dedupResolverAddresses(entry.addresses, config)
+		pool.resolvers = pool.createResolvers(ctx, addresses, config)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if len(pool.resolvers) == 0 {
+			p.logger.Warnf("No working resolvers for %s in the nameserver map, using the default pool", entry.suffix)
+			continue
+		}
+
+		p.routes = append(p.routes, &resolverRoute{suffix: entry.suffix, pool: pool})
+		p.logger.Printf("Routing *.%s to %d resolvers", entry.suffix, len(pool.resolvers))
+	}
+}
+
+// ForDomain returns the pool that should answer for name: the route with
+// the longest matching suffix, or p itself when no route matches
+func (p *ResolverPool) ForDomain(name string) *ResolverPool {
+	if len(p.routes) == 0 {
+		return p
+	}
+
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+
+	var best *resolverRoute
+	for _, route := range p.routes {
+		if name != route.suffix && !strings.HasSuffix(name, "."+route.suffix) {
+			continue
+		}
+		if best == nil || len(route.suffix) > len(best.suffix) {
+			best = route
+		}
+	}
+
+	if best == nil {
+		return p
+	}
+	return best.pool
+}
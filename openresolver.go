@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// OpenResolverCheck is the -check-open verdict for one resolver
+type OpenResolverCheck struct {
+	Resolver           string `json:"resolver"`
+	Open               bool   `json:"open"`
+	Rcode              string `json:"rcode,omitempty"`
+	RecursionAvailable bool   `json:"recursion_available"`
+	Answers            int    `json:"answers"`
+	Error              string `json:"error,omitempty"`
+}
+
+// checkOpenResolvers asks every resolver in the pool to recursively
+// resolve the test domain, which none of them should be authoritative
+// for, and writes one verdict per resolver in pool order. A resolver is
+// an open recursor when it answers with RA set and the records.
+func checkOpenResolvers(ctx context.Context, config *Config, resolverPool *ResolverPool,
+	rateLimiter *RateLimiter, outputHandler *OutputHandler, logger *Logger) error {
+
+	resolvers := resolverPool.resolvers
+	checks := make([]*OpenResolverCheck, len(resolvers))
+
+	workers := config.Workers
+	if len(resolvers) < workers {
+		workers = len(resolvers)
+	}
+
+	indexChan := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexChan {
+				rateLimiter.Wait(ctx)
+				checks[idx] = checkOpenResolver(ctx, resolvers[idx], config)
+			}
+		}()
+	}
+
+dispatch:
+	for idx := range resolvers {
+		select {
+		case indexChan <- idx:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(indexChan)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	open := 0
+	for _, check := range checks {
+		if check.Open {
+			open++
+		}
+		outputHandler.WriteOpenResolverCheck(check)
+	}
+
+	logger.Printf("Open resolver check: %d of %d resolvers recursively resolved %s",
+		open, len(checks), config.TestDomain)
+	return nil
+}
+
+// checkOpenResolver sends one recursive query for the test domain to
+// resolver and classifies the response
+func checkOpenResolver(ctx context.Context, resolver *DNSResolver, config *Config) *OpenResolverCheck {
+	check := &OpenResolverCheck{Resolver: resolver.Address}
+
+	response, _, _, err := exchangeOnce(ctx, resolver, config.TestDomain, dns.TypeA, config)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+
+	check.Rcode = dns.RcodeToString[response.Rcode]
+	check.RecursionAvailable = response.RecursionAvailable
+	check.Answers = len(response.Answer)
+	check.Open = response.Rcode == dns.RcodeSuccess && response.RecursionAvailable && len(response.Answer) > 0
+	return check
+}
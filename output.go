@@ -1,128 +1,728 @@
 package main
 
 import (
+        "bufio"
+        "bytes"
+        "compress/gzip"
         "encoding/csv"
         "encoding/json"
         "fmt"
-        "log"
+        "io"
+        "net"
         "os"
+        "path/filepath"
+        "sort"
         "strings"
         "sync"
+        "time"
 
         "github.com/miekg/dns"
 )
 
 // OutputHandler manages output formatting and writing
 type OutputHandler struct {
-        file   *os.File
-        format string
-        writer interface{}
-        mutex  sync.Mutex
-        logger *log.Logger
+        out          io.Writer
+        file         *os.File
+        compressor   *gzip.Writer
+        closers      []io.Closer
+        format       string
+        normalize    bool
+        showResolver bool
+        countOnly    bool
+        txtConcat    bool
+        pretty       bool
+        emitNX       bool
+        timestamp    bool
+        sortAnswers  bool
+        ptrAddress   bool
+        checkLame    bool
+        groups       *answerGroups
+        merger       *familyMerger
+        writer       interface{}
+        mutex        sync.Mutex
+        logger       *Logger
+        
+        // CSV settings, reapplied whenever a new file is started
+        csvComma  rune
+        csvHeader bool
+        
+        // countHeader holds the CSV header and rows back until the
+        // buffered records are written, so a record count can precede them.
+        // The rows wait in heldRows, keyed by their position.
+        countHeader bool
+        heldRows    *spillSorter
+        heldCount   int64
+        
+        // batched buffers the sink for -batch-size, nil when every write
+        // goes straight through; pending counts the records it holds
+        batched   *bufio.Writer
+        batchSize int64
+        pending   int64
+        
+        // Wire-format dumps for -raw-output, nil when disabled
+        raw *rawDumper
+        
+        // tees receive a copy of every write, one per further -o
+        // format:path pair
+        tees []*OutputHandler
+        
+        // Columns selected with -fields, nil for all of them
+        fields []outputField
+        
+        // Rotation state for -rotate-size and -rotate-count
+        path        string
+        rotateSize  int64
+        rotateCount int64
+        rotations   int
+        
+        // sized counts the bytes of formatted records as they are written,
+        // before compression and -batch-size buffering
+        sized       *countingWriter
+        records     int64
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+        w io.Writer
+        n int64
+}
+
+// Write writes p to the underlying writer and counts the bytes written
+func (c *countingWriter) Write(p []byte) (int, error) {
+        n, err := c.w.Write(p)
+        c.n += int64(n)
+        return n, err
 }
 
+// outputSchemaVersion identifies the layout of the JSON records. Bump it
+// whenever a field is renamed, removed or changes meaning.
+//
+// Version 2: type is the type of each record, with the queried type in
+// query_type.
+// Version 3: records written with -fields carry schema_version too.
+const outputSchemaVersion = 3
+
 // OutputRecord represents a single DNS resolution result for output
 type OutputRecord struct {
-        Domain   string `json:"domain"`
-        Type     string `json:"type"`
-        Record   string `json:"record"`
-        Value    string `json:"value"`
-        TTL      uint32 `json:"ttl"`
-        Resolver string `json:"resolver"`
+        SchemaVersion int `json:"schema_version"`
+
+        Domain   string         `json:"domain"`
+        Type     string         `json:"type"`
+        Record   string         `json:"record"`
+        
+        // QueryType is the type asked for. It differs from Type for the
+        // CNAMEs leading to the answer.
+        QueryType string `json:"query_type"`
+
+        Value    string         `json:"value"`
+        TTL      uint32         `json:"ttl"`
+        Resolver string         `json:"resolver"`
+        Dangling bool           `json:"dangling,omitempty"`
+        Wildcard bool           `json:"wildcard,omitempty"`
+        FastFlux bool           `json:"fastflux,omitempty"`
+        EDE      *ExtendedError `json:"ede,omitempty"`
+        
+        FastFluxScore *float64 `json:"fastflux_score,omitempty"`
+        
+        // Inconsistent is set with -detect-inconsistency
+        Inconsistent bool `json:"inconsistent,omitempty"`
+        
+        // Lame is set on NS records checked with -check-lame
+        Lame *bool `json:"lame,omitempty"`
+        
+        // Status is the response code, set with -emit-nxdomain
+        Status string `json:"status,omitempty"`
+        
+        // ObservedAt is when the result was written, set with -timestamp
+        ObservedAt string `json:"observed_at,omitempty"`
+        
+        Annotations map[string]string `json:"annotations,omitempty"`
+        
+        // TXT holds the individual character strings of a TXT record
+        TXT []string `json:"txt,omitempty"`
+}
+
+// AnswerRecord represents a single answer within a grouped result
+type AnswerRecord struct {
+        Record string   `json:"record"`
+        Type   string   `json:"type"`
+        Value  string   `json:"value"`
+        TTL    uint32   `json:"ttl"`
+        TXT    []string `json:"txt,omitempty"`
+        Lame   *bool    `json:"lame,omitempty"`
 }
 
-// NewOutputHandler creates a new output handler
-func NewOutputHandler(filename, format string, logger *log.Logger) *OutputHandler {
-        var file *os.File = os.Stdout
+// GroupedOutputRecord represents all answers from one DNS response
+type GroupedOutputRecord struct {
+        SchemaVersion int `json:"schema_version"`
+
+        Domain    string         `json:"domain"`
+        Type      string         `json:"type"`
+        Resolver  string         `json:"resolver"`
+        LatencyMs float64        `json:"latency_ms"`
+        Rcode     string         `json:"rcode"`
+        Dangling  bool           `json:"dangling,omitempty"`
+        Wildcard  bool           `json:"wildcard,omitempty"`
+        FastFlux  bool           `json:"fastflux,omitempty"`
+        EDE       *ExtendedError `json:"ede,omitempty"`
+        Answers   []AnswerRecord `json:"answers"`
         
-        if filename != "" {
-                var err error
-                file, err = os.Create(filename)
+        FastFluxScore *float64 `json:"fastflux_score,omitempty"`
+        Inconsistent  bool     `json:"inconsistent,omitempty"`
+        ObservedAt    string   `json:"observed_at,omitempty"`
+        
+        Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// NewOutputHandler creates a new output handler, returning an error when
+// the selected sink cannot be opened. With several -o format:path pairs
+// the first pair's handler is returned and writes to it are copied to
+// one handler per further pair. Answer groups and raw dumps come from
+// the first one only.
+func NewOutputHandler(config *Config, logger *Logger) (*OutputHandler, error) {
+        if len(config.outputSinks) < 2 {
+                return newOutputHandler(config, logger)
+        }
+        
+        var primary *OutputHandler
+        for i, sink := range config.outputSinks {
+                sinkConfig := *config
+                sinkConfig.OutputFormat, sinkConfig.OutputFile = sink.format, sink.path
+                if i > 0 {
+                        sinkConfig.GroupByAnswer = false
+                        sinkConfig.RawOutputDir = ""
+                }
+                
+                handler, err := newOutputHandler(&sinkConfig, logger)
                 if err != nil {
-                        logger.Fatalf("Failed to create output file: %v", err)
+                        if primary != nil {
+                                primary.Close()
+                        }
+                        return nil, fmt.Errorf("%s:%s: %v", sink.format, sink.path, err)
+                }
+                
+                if primary == nil {
+                        primary = handler
+                } else {
+                        primary.tees = append(primary.tees, handler)
                 }
         }
         
+        return primary, nil
+}
+
+// newOutputHandler creates the handler for the single sink and format in
+// config
+func newOutputHandler(config *Config, logger *Logger) (*OutputHandler, error) {
         handler := &OutputHandler{
-                file:   file,
-                format: format,
-                logger: logger,
+                out:          os.Stdout,
+                format:       config.OutputFormat,
+                normalize:    config.Normalize,
+                showResolver: config.ShowResolver,
+                countOnly:    config.Count,
+                txtConcat:    config.TXTConcat,
+                pretty:       config.JSONPretty,
+                emitNX:       config.EmitNXDomain,
+                timestamp:    config.Timestamp,
+                sortAnswers:  config.SortAnswers,
+                ptrAddress:   config.PTRAddress,
+                checkLame:    config.CheckLame,
+                batchSize:    int64(config.BatchSize),
+                fields:       config.outputFields,
+                logger:       logger,
         }
         
-        // Initialize writer based on format
-        switch format {
-        case "csv":
-                csvWriter := csv.NewWriter(file)
-                csvWriter.Write([]string{"Domain", "Type", "Record", "Value", "TTL", "Resolver"})
+        if config.GroupByAnswer {
+                handler.groups = newAnswerGroups(config.SpillAfter)
+        }
+        if config.MergeFamilies {
+                handler.merger = newFamilyMerger(config.SpillAfter)
+        }
+        if config.RawOutputDir != "" {
+                raw, err := newRawDumper(config.RawOutputDir)
+                if err != nil {
+                        return nil, err
+                }
+                handler.raw = raw
+        }
+        
+        // Syslog messages are self-contained records, so skip the CSV header.
+        // Count and validation modes don't write records at all.
+        handler.csvComma = config.csvComma
+        handler.csvHeader = !config.Syslog && !config.Count && !config.ValidateOnly
+        handler.countHeader = config.CSVRecordCount
+        if handler.countHeader {
+                handler.heldRows = newSpillSorter(config.SpillAfter)
+        }
+        
+        // Select the output sink
+        switch {
+        case config.ESURL != "":
+                if config.Syslog || config.OutputFile != "" {
+                        return nil, fmt.Errorf("cannot combine -es-url with -syslog or -o")
+                }
+                sink, err := newESSink(config.ESURL, config.ESIndex, config.ESBatchSize,
+                        config.ESFlushInterval, time.Duration(config.Timeout)*time.Second, logger)
+                if err != nil {
+                        return nil, fmt.Errorf("invalid -es-url: %v", err)
+                }
+                handler.out = sink
+                handler.closers = []io.Closer{sink}
+        case config.Syslog:
+                if config.OutputFile != "" {
+                        return nil, fmt.Errorf("cannot combine -syslog with -o")
+                }
+                sink, err := newSyslogSink(config.SyslogAddr)
+                if err != nil {
+                        return nil, fmt.Errorf("failed to connect to syslog: %v", err)
+                }
+                handler.out = sink
+                handler.closers = []io.Closer{sink}
+        case config.OutputFile != "":
+                handler.path = config.OutputFile
+                handler.rotateSize = config.rotateBytes
+                handler.rotateCount = int64(config.RotateCount)
+                if err := handler.openFile(config.OutputFile); err != nil {
+                        return nil, fmt.Errorf("failed to create output file: %v", err)
+                }
+                return handler, nil
+        default:
+                // Syslog and Elasticsearch take one record per write, so
+                // only stdout is batched
+                handler.startBatch()
+        }
+        
+        handler.startFormat()
+        return handler, nil
+}
+
+// openFile creates an output file, compressing it when the name ends in
+// .gz, and starts the format on it
+func (o *OutputHandler) openFile(name string) error {
+        file, err := os.Create(name)
+        if err != nil {
+                return err
+        }
+        
+        o.out = file
+        o.file = file
+        o.compressor = nil
+        o.closers = []io.Closer{file}
+        
+        // Compress transparently when the file name asks for it
+        if strings.HasSuffix(name, ".gz") {
+                o.compressor = gzip.NewWriter(file)
+                o.out = o.compressor
+                o.closers = []io.Closer{o.compressor, file}
+        }
+        
+        o.startBatch()
+        
+        // -rotate-size limits the records written, whatever the file
+        // takes up once compressed
+        o.sized = &countingWriter{w: o.out}
+        o.out = o.sized
+        o.startFormat()
+        return nil
+}
+
+// batchBufferSize is the buffer behind -batch-size. A batch larger than
+// this reaches the sink in several writes.
+const batchBufferSize = 256 << 10
+
+// startBatch buffers the current sink for -batch-size, so records reach it
+// a batch at a time instead of in one write each
+func (o *OutputHandler) startBatch() {
+        o.batched = nil
+        o.pending = 0
+        if o.batchSize <= 0 {
+                return
+        }
+        
+        o.batched = bufio.NewWriterSize(o.out, batchBufferSize)
+        o.out = o.batched
+}
+
+// wrote counts n records written and, with -batch-size, flushes the
+// buffered ones to the sink once a full batch is held
+func (o *OutputHandler) wrote(n int) {
+        if o.batched == nil {
+                return
+        }
+        
+        o.pending += int64(n)
+        if o.pending >= o.batchSize {
+                o.flushBatch()
+        }
+}
+
+// flushBatch writes the records held for -batch-size through to the sink
+func (o *OutputHandler) flushBatch() {
+        if o.batched == nil {
+                return
+        }
+        
+        if csvWriter, ok := o.writer.(*csv.Writer); ok {
                 csvWriter.Flush()
-                handler.writer = csvWriter
-        case "json":
-                // JSON array will be handled manually
+        }
+        if err := o.batched.Flush(); err != nil && o.logger != nil {
+                o.logger.Errorf("Error writing output: %v", err)
+        }
+        o.pending = 0
+}
+
+// startFormat initializes the writer for the output format on the current
+// sink, writing the CSV header if one is wanted
+func (o *OutputHandler) startFormat() {
+        switch o.format {
+        case "csv":
+                csvWriter := csv.NewWriter(o.out)
+                if o.csvComma != 0 {
+                        csvWriter.Comma = o.csvComma
+                }
+                o.writer = csvWriter
+                if o.csvHeader && !o.countHeader {
+                        o.writeCSVHeader()
+                }
+        case "json", "json-grouped":
+                // JSON lines are written directly
         default:
                 // Simple format, no special writer needed
         }
+}
+
+// writeCSVHeader writes the CSV header row for the selected columns
+func (o *OutputHandler) writeCSVHeader() {
+        csvWriter, ok := o.writer.(*csv.Writer)
+        if !ok {
+                return
+        }
+        
+        header := []string{"Domain", "Type", "Record", "Value", "TTL", "Resolver"}
+        if o.emitNX {
+                header = append(header, "Status")
+        }
+        if o.timestamp {
+                header = append(header, "ObservedAt")
+        }
+        if o.checkLame {
+                header = append(header, "Lame")
+        }
+        if o.fields != nil {
+                header = fieldHeaders(o.fields)
+        }
+        csvWriter.Write(header)
+        csvWriter.Flush()
+}
+
+// rotateIfNeeded closes the current output file and opens the next
+// numbered one once it has reached the configured size or record count
+func (o *OutputHandler) rotateIfNeeded() {
+        if o.sized == nil {
+                return
+        }
+        
+        full := (o.rotateSize > 0 && o.sized.n >= o.rotateSize) ||
+                (o.rotateCount > 0 && o.records >= o.rotateCount)
+        if !full {
+                return
+        }
         
-        return handler
+        o.closeSink()
+        
+        o.rotations++
+        o.records = 0
+        name := rotatedName(o.path, o.rotations)
+        if err := o.openFile(name); err != nil {
+                // Without a file to write to, keep counting but drop output
+                if o.logger != nil {
+                        o.logger.Errorf("Failed to rotate output to %s: %v", name, err)
+                }
+                o.out = io.Discard
+                o.sized = nil
+                o.file = nil
+                o.compressor = nil
+                o.closers = nil
+                o.batched = nil
+                o.startFormat()
+                return
+        }
+        
+        if o.logger != nil {
+                o.logger.Printf("Rotated output to %s", name)
+        }
+}
+
+// rotatedName inserts the rotation number before the file extension, so
+// results.csv.gz becomes results.1.csv.gz
+func rotatedName(path string, n int) string {
+        base, gz := path, ""
+        if strings.HasSuffix(base, ".gz") {
+                base, gz = strings.TrimSuffix(base, ".gz"), ".gz"
+        }
+        
+        ext := filepath.Ext(base)
+        if strings.Contains(ext, string(filepath.Separator)) {
+                ext = ""
+        }
+        
+        return fmt.Sprintf("%s.%d%s%s", strings.TrimSuffix(base, ext), n, ext, gz)
 }
 
 // WriteResult writes a DNS result to the output
 func (o *OutputHandler) WriteResult(result *DNSResult) {
+        for _, tee := range o.tees {
+                tee.WriteResult(result)
+        }
+        
         o.mutex.Lock()
         defer o.mutex.Unlock()
         
-        if result.Response == nil || len(result.Response.Answer) == 0 {
+        // With -emit-nxdomain a name that doesn't exist still gets a record
+        nx := o.emitNX && result.Response != nil && result.Response.Rcode == dns.RcodeNameError
+        if !nx && (result.Response == nil || len(result.Response.Answer) == 0) {
+                return
+        }
+        
+        if o.groups != nil && !nx {
+                if err := o.groups.Add(result); err != nil && o.logger != nil {
+                        o.logger.Errorf("Error buffering answer groups: %v", err)
+                }
+        }
+        
+        if o.countOnly {
+                return
+        }
+        
+        // Addresses are held back and written per name when the run ends
+        if o.merger != nil && !nx && o.merger.Accepts(result) {
+                if err := o.merger.Add(result); err != nil && o.logger != nil {
+                        o.logger.Errorf("Error buffering merged records: %v", err)
+                }
+                return
+        }
+        
+        o.rotateIfNeeded()
+        
+        var observedAt string
+        if o.timestamp {
+                observedAt = time.Now().UTC().Format(time.RFC3339)
+        }
+        
+        if o.format == "json-grouped" {
+                o.writeGroupedJSON(result, observedAt)
+                o.records++
+                o.wrote(1)
                 return
         }
         
         records := o.extractRecords(result)
+        if nx {
+                records = []OutputRecord{o.nxRecord(result)}
+        } else if o.emitNX {
+                for i := range records {
+                        records[i].Status = dns.RcodeToString[result.Response.Rcode]
+                }
+        }
+        for i := range records {
+                records[i].ObservedAt = observedAt
+        }
+        o.records += int64(len(records))
         
         switch o.format {
         case "json":
                 o.writeJSON(records)
         case "csv":
                 o.writeCSV(records)
+        case "hosts":
+                o.writeHosts(records)
         default:
                 o.writeSimple(records)
         }
+        o.wrote(len(records))
+}
+
+// marshalJSON encodes v compactly, one record per line, or indented with
+// -json-pretty
+func (o *OutputHandler) marshalJSON(v interface{}) ([]byte, error) {
+        if o.pretty {
+                return json.MarshalIndent(v, "", "  ")
+        }
+        return json.Marshal(v)
+}
+
+// indentJSON re-indents already encoded JSON for -json-pretty
+func indentJSON(data []byte) ([]byte, error) {
+        var buf bytes.Buffer
+        if err := json.Indent(&buf, data, "", "  "); err != nil {
+                return nil, err
+        }
+        return buf.Bytes(), nil
+}
+
+// DumpRaw writes the wire format of the response to the -raw-output
+// directory, including responses without answers
+func (o *OutputHandler) DumpRaw(result *DNSResult) {
+        if o.raw == nil {
+                return
+        }
+        
+        if err := o.raw.Dump(result); err != nil && o.logger != nil {
+                o.logger.Errorf("Error writing raw response: %v", err)
+        }
+}
+
+// writeMerged writes the buffered A and AAAA answers, one record per name.
+// The text formats list every address in the value column and otherwise
+// use the same columns as other records.
+func (o *OutputHandler) writeMerged() {
+        if o.merger == nil {
+                return
+        }
+        
+        records, err := o.merger.Drain()
+        if err != nil {
+                if o.logger != nil {
+                        o.logger.Errorf("Error merging address records: %v", err)
+                }
+                return
+        }
+        if csvWriter, ok := o.writer.(*csv.Writer); ok && o.countHeader {
+                fmt.Fprintf(o.out, "# records=%d\n", o.heldCount+int64(records.Len()))
+                if o.csvHeader {
+                        o.writeCSVHeader()
+                }
+                err := o.heldRows.Each(func(line string) error {
+                        _, data, _ := strings.Cut(line, "\t")
+                        var row []string
+                        if err := json.Unmarshal([]byte(data), &row); err != nil {
+                                return err
+                        }
+                        return csvWriter.Write(row)
+                })
+                if err != nil && o.logger != nil {
+                        o.logger.Errorf("Error writing held CSV rows: %v", err)
+                }
+                csvWriter.Flush()
+                o.heldCount = 0
+        }
+        
+        err = records.Each(func(record *MergedRecord) {
+                o.rotateIfNeeded()
+                o.records++
+                
+                if o.timestamp {
+                        record.ObservedAt = time.Now().UTC().Format(time.RFC3339)
+                }
+                row := OutputRecord{
+                        SchemaVersion: outputSchemaVersion,
+                        
+                        Domain:     record.Domain,
+                        Type:       "A/AAAA",
+                        Record:     dns.Fqdn(record.Domain),
+                        QueryType:  "A/AAAA",
+                        Value:      strings.Join(append(append([]string{}, record.IPv4...), record.IPv6...), ","),
+                        TTL:        record.TTL,
+                        Resolver:   record.Resolver,
+                        ObservedAt: record.ObservedAt,
+                }
+                if o.emitNX {
+                        row.Status = dns.RcodeToString[dns.RcodeSuccess]
+                }
+                
+                switch o.format {
+                case "json", "json-grouped":
+                        data, err := o.marshalJSON(record)
+                        if err != nil {
+                                if o.logger != nil {
+                                        o.logger.Errorf("Error marshaling JSON: %v", err)
+                                }
+                                return
+                        }
+                        fmt.Fprintf(o.out, "%s\n", data)
+                case "csv":
+                        if csvWriter, ok := o.writer.(*csv.Writer); ok {
+                                csvWriter.Write(o.csvRow(&row))
+                                csvWriter.Flush()
+                        }
+                case "hosts":
+                        for _, address := range append(append([]string{}, record.IPv4...), record.IPv6...) {
+                                fmt.Fprintf(o.out, "%s\t%s\n", address, record.Domain)
+                        }
+                default:
+                        fmt.Fprintln(o.out, o.simpleLine(&row))
+                }
+                o.wrote(1)
+        })
+        if err != nil && o.logger != nil {
+                o.logger.Errorf("Error writing merged records: %v", err)
+        }
+}
+
+// nxRecord returns the record written for an NXDOMAIN response: no value,
+// and the negative caching TTL from the SOA in the authority section
+// (RFC 2308), or 0 when there is none
+func (o *OutputHandler) nxRecord(result *DNSResult) OutputRecord {
+        record := OutputRecord{
+                SchemaVersion: outputSchemaVersion,
+                
+                Domain:    result.Domain,
+                Type:      dns.TypeToString[result.Type],
+                QueryType: dns.TypeToString[result.Type],
+                Record:    dns.Fqdn(result.Domain),
+                Resolver:  result.Resolver,
+                EDE:       result.EDE,
+                Status:    dns.RcodeToString[dns.RcodeNameError],
+                
+                Annotations: result.Annotations,
+        }
+        
+        for _, rr := range result.Response.Ns {
+                if soa, ok := rr.(*dns.SOA); ok {
+                        record.TTL = soa.Hdr.Ttl
+                        if soa.Minttl < record.TTL {
+                                record.TTL = soa.Minttl
+                        }
+                        break
+                }
+        }
+        
+        return record
 }
 
 // extractRecords extracts DNS records from a response
 func (o *OutputHandler) extractRecords(result *DNSResult) []OutputRecord {
         var records []OutputRecord
         
-        for _, rr := range result.Response.Answer {
+        for _, rr := range o.answers(result.Response) {
                 record := OutputRecord{
-                        Domain:   result.Domain,
-                        Type:     dns.TypeToString[result.Type],
-                        Record:   rr.Header().Name,
-                        TTL:      rr.Header().Ttl,
-                        Resolver: result.Resolver,
+                        SchemaVersion: outputSchemaVersion,
+                        
+                        Domain:    result.Domain,
+                        Type:      dns.TypeToString[rr.Header().Rrtype],
+                        QueryType: dns.TypeToString[result.Type],
+                        Record:    rr.Header().Name,
+                        TTL:       rr.Header().Ttl,
+                        Resolver:  result.Resolver,
+                        Value:     o.recordValue(rr),
+                        Dangling:  result.Dangling,
+                        Wildcard:  result.Wildcard,
+                        FastFlux:  result.FastFlux,
+                        EDE:       result.EDE,
+                        
+                        FastFluxScore: result.FastFluxScore,
+                        Inconsistent:  result.Inconsistent,
+                        
+                        Annotations: result.Annotations,
                 }
-                
-                // Extract the value based on record type
-                switch r := rr.(type) {
-                case *dns.A:
-                        record.Value = r.A.String()
-                case *dns.AAAA:
-                        record.Value = r.AAAA.String()
-                case *dns.CNAME:
-                        record.Value = r.Target
-                case *dns.MX:
-                        record.Value = fmt.Sprintf("%d %s", r.Preference, r.Mx)
-                case *dns.NS:
-                        record.Value = r.Ns
-                case *dns.TXT:
-                        record.Value = strings.Join(r.Txt, " ")
-                case *dns.SOA:
-                        record.Value = fmt.Sprintf("%s %s %d %d %d %d %d", 
-                                r.Ns, r.Mbox, r.Serial, r.Refresh, r.Retry, r.Expire, r.Minttl)
-                case *dns.PTR:
-                        record.Value = r.Ptr
-                case *dns.SRV:
-                        record.Value = fmt.Sprintf("%d %d %d %s", 
-                                r.Priority, r.Weight, r.Port, r.Target)
-                default:
-                        record.Value = rr.String()
+                if txt, ok := rr.(*dns.TXT); ok {
+                        record.TXT = txt.Txt
+                }
+                record.Lame = lameVerdict(result, rr)
+                if _, ok := rr.(*dns.PTR); ok && o.ptrAddress {
+                        if ip := reverseNameIP(result.Domain); ip != nil {
+                                record.Domain = ip.String()
+                        }
                 }
                 
                 records = append(records, record)
@@ -131,68 +731,504 @@ func (o *OutputHandler) extractRecords(result *DNSResult) []OutputRecord {
         return records
 }
 
+// lameVerdict returns the -check-lame verdict for an NS record, or nil
+// when rr is not one or its nameserver was not checked
+func lameVerdict(result *DNSResult, rr dns.RR) *bool {
+        ns, ok := rr.(*dns.NS)
+        if !ok || result.Lame == nil {
+                return nil
+        }
+        lame, checked := result.Lame[strings.ToLower(dns.Fqdn(ns.Ns))]
+        if !checked {
+                return nil
+        }
+        return &lame
+}
+
+// answers returns the answer section of response, with -sort-answers
+// sorted by value within each run of records sharing an owner and type.
+// Sorting only within runs keeps a CNAME chain ahead of the addresses it
+// leads to.
+func (o *OutputHandler) answers(response *dns.Msg) []dns.RR {
+        if !o.sortAnswers || len(response.Answer) < 2 {
+                return response.Answer
+        }
+        
+        sorted := append([]dns.RR(nil), response.Answer...)
+        sameRun := func(a, b dns.RR) bool {
+                return strings.EqualFold(a.Header().Name, b.Header().Name) && a.Header().Rrtype == b.Header().Rrtype
+        }
+        
+        for start := 0; start < len(sorted); {
+                end := start + 1
+                for end < len(sorted) && sameRun(sorted[start], sorted[end]) {
+                        end++
+                }
+                run := sorted[start:end]
+                sort.SliceStable(run, func(i, j int) bool {
+                        return o.lessValue(run[i], run[j])
+                })
+                start = end
+        }
+        
+        return sorted
+}
+
+// lessValue orders two records of the same type by value, comparing
+// addresses numerically so 10.0.0.2 sorts before 10.0.0.10
+func (o *OutputHandler) lessValue(a, b dns.RR) bool {
+        var ipA, ipB net.IP
+        switch r := a.(type) {
+        case *dns.A:
+                ipA, ipB = r.A.To16(), b.(*dns.A).A.To16()
+        case *dns.AAAA:
+                ipA, ipB = r.AAAA.To16(), b.(*dns.AAAA).AAAA.To16()
+        }
+        if ipA != nil && ipB != nil {
+                return bytes.Compare(ipA, ipB) < 0
+        }
+        
+        return o.recordValue(a) < o.recordValue(b)
+}
+
+// recordValue extracts the value of a resource record based on its type.
+// Addresses are decoded from the wire, so they are always written in
+// canonical form. With normalization enabled, target names are lowercased
+// and fully qualified so values from different resolvers compare equal.
+func (o *OutputHandler) recordValue(rr dns.RR) string {
+        name := func(n string) string {
+                if o.normalize {
+                        return strings.ToLower(dns.Fqdn(n))
+                }
+                return n
+        }
+        
+        switch r := rr.(type) {
+        case *dns.A:
+                return r.A.String()
+        case *dns.AAAA:
+                return r.AAAA.String()
+        case *dns.CNAME:
+                return name(r.Target)
+        case *dns.MX:
+                return fmt.Sprintf("%d %s", r.Preference, name(r.Mx))
+        case *dns.NS:
+                return name(r.Ns)
+        case *dns.TXT:
+                // Long values such as DKIM keys are split into 255 byte
+                // strings that only make sense concatenated
+                if o.txtConcat {
+                        return strings.Join(r.Txt, "")
+                }
+                return strings.Join(r.Txt, " ")
+        case *dns.SOA:
+                return fmt.Sprintf("%s %s %d %d %d %d %d", 
+                        r.Ns, r.Mbox, r.Serial, r.Refresh, r.Retry, r.Expire, r.Minttl)
+        case *dns.PTR:
+                return name(r.Ptr)
+        case *dns.SRV:
+                return fmt.Sprintf("%d %d %d %s", 
+                        r.Priority, r.Weight, r.Port, name(r.Target))
+        case *dns.URI:
+                return fmt.Sprintf("%d %d %q", r.Priority, r.Weight, r.Target)
+        case *dns.TLSA:
+                return fmt.Sprintf("%d %d %d %s", 
+                        r.Usage, r.Selector, r.MatchingType, strings.ToLower(r.Certificate))
+        default:
+                return rr.String()
+        }
+}
+
+// reverseNameIP returns the address a reverse lookup name stands for,
+// such as 192.0.2.1 for 1.2.0.192.in-addr.arpa, or nil when name is not
+// a complete in-addr.arpa or ip6.arpa name
+func reverseNameIP(name string) net.IP {
+        labels := dns.SplitDomainName(strings.ToLower(name))
+        n := len(labels)
+        
+        switch {
+        case n == 6 && labels[4] == "in-addr" && labels[5] == "arpa":
+                ip := net.ParseIP(strings.Join([]string{labels[3], labels[2], labels[1], labels[0]}, "."))
+                if ip == nil || ip.To4() == nil {
+                        return nil
+                }
+                return ip
+        case n == 34 && labels[32] == "ip6" && labels[33] == "arpa":
+                var hex strings.Builder
+                for i := 31; i >= 0; i-- {
+                        if len(labels[i]) != 1 {
+                                return nil
+                        }
+                        hex.WriteString(labels[i])
+                        if i%4 == 0 && i > 0 {
+                                hex.WriteByte(':')
+                        }
+                }
+                return net.ParseIP(hex.String())
+        }
+        return nil
+}
+
 // writeSimple writes records in simple text format
 func (o *OutputHandler) writeSimple(records []OutputRecord) {
         for _, record := range records {
-                fmt.Fprintf(o.file, "%s\t%s\t%s\t%d\n", 
-                        record.Domain, record.Type, record.Value, record.TTL)
+                fmt.Fprintln(o.out, o.simpleLine(&record))
+        }
+}
+
+// simpleLine returns the simple text line for a record
+func (o *OutputHandler) simpleLine(record *OutputRecord) string {
+        line := fmt.Sprintf("%s\t%s\t%s\t%d", 
+                record.Domain, record.Type, record.Value, record.TTL)
+        if o.showResolver {
+                line += "\t" + record.Resolver
+        }
+        if record.ObservedAt != "" {
+                line += "\t" + record.ObservedAt
+        }
+        if record.Dangling {
+                line += "\tDANGLING"
+        }
+        if record.Wildcard {
+                line += "\tWILDCARD"
+        }
+        if record.FastFlux {
+                line += "\tFASTFLUX"
+        }
+        if record.Inconsistent {
+                line += "\tINCONSISTENT"
+        }
+        if record.Lame != nil && *record.Lame {
+                line += "\tLAME"
+        }
+        if record.Status == dns.RcodeToString[dns.RcodeNameError] {
+                line += "\tNXDOMAIN"
+        }
+        return line
+}
+
+// writeHosts writes the address records as hosts file lines of address
+// and name, one line per address, and skips every other type
+func (o *OutputHandler) writeHosts(records []OutputRecord) {
+        for _, record := range records {
+                if (record.Type != "A" && record.Type != "AAAA") || record.Value == "" {
+                        continue
+                }
+                fmt.Fprintf(o.out, "%s\t%s\n", record.Value, record.Domain)
         }
 }
 
 // writeJSON writes records in JSON format
 func (o *OutputHandler) writeJSON(records []OutputRecord) {
         for _, record := range records {
-                data, err := json.Marshal(record)
+                var data []byte
+                var err error
+                if o.fields != nil {
+                        data, err = marshalFields(o.fields, &record)
+                        if err == nil && o.pretty {
+                                data, err = indentJSON(data)
+                        }
+                } else {
+                        data, err = o.marshalJSON(record)
+                }
                 if err != nil {
                         if o.logger != nil {
-                                o.logger.Printf("Error marshaling JSON: %v", err)
+                                o.logger.Errorf("Error marshaling JSON: %v", err)
                         }
                         continue
                 }
-                fmt.Fprintf(o.file, "%s\n", data)
+                fmt.Fprintf(o.out, "%s\n", data)
+        }
+}
+
+// writeGroupedJSON writes one JSON object per DNS response with all its answers
+func (o *OutputHandler) writeGroupedJSON(result *DNSResult, observedAt string) {
+        grouped := GroupedOutputRecord{
+                SchemaVersion: outputSchemaVersion,
+                
+                Domain:    result.Domain,
+                Type:      dns.TypeToString[result.Type],
+                Resolver:  result.Resolver,
+                LatencyMs: float64(result.Latency) / float64(time.Millisecond),
+                Rcode:     dns.RcodeToString[result.Response.Rcode],
+                Dangling:  result.Dangling,
+                Wildcard:  result.Wildcard,
+                FastFlux:  result.FastFlux,
+                EDE:       result.EDE,
+                
+                FastFluxScore: result.FastFluxScore,
+                ObservedAt:    observedAt,
+                Inconsistent:  result.Inconsistent,
+                
+                Annotations: result.Annotations,
+        }
+        
+        // An NXDOMAIN record from -emit-nxdomain has an empty answer list
+        if len(result.Response.Answer) == 0 {
+                grouped.Answers = []AnswerRecord{}
+        }
+        
+        for _, rr := range o.answers(result.Response) {
+                answer := AnswerRecord{
+                        Record: rr.Header().Name,
+                        Type:   dns.TypeToString[rr.Header().Rrtype],
+                        Value:  o.recordValue(rr),
+                        TTL:    rr.Header().Ttl,
+                }
+                if txt, ok := rr.(*dns.TXT); ok {
+                        answer.TXT = txt.Txt
+                }
+                answer.Lame = lameVerdict(result, rr)
+                grouped.Answers = append(grouped.Answers, answer)
+        }
+        
+        data, err := o.marshalJSON(grouped)
+        if err != nil {
+                if o.logger != nil {
+                        o.logger.Errorf("Error marshaling JSON: %v", err)
+                }
+                return
         }
+        fmt.Fprintf(o.out, "%s\n", data)
+}
+
+// writeCSVRow writes one CSV row, or holds it for the record count
+// with -csv-record-count
+func (o *OutputHandler) writeCSVRow(csvWriter *csv.Writer, row []string) {
+        if o.countHeader {
+                data, err := json.Marshal(row)
+                if err == nil {
+                        o.heldCount++
+                        err = o.heldRows.Add(fmt.Sprintf("%020d\t%s", o.heldCount, data))
+                }
+                if err != nil && o.logger != nil {
+                        o.logger.Errorf("Error holding CSV row: %v", err)
+                }
+                return
+        }
+        csvWriter.Write(row)
 }
 
 // writeCSV writes records in CSV format
 func (o *OutputHandler) writeCSV(records []OutputRecord) {
         if csvWriter, ok := o.writer.(*csv.Writer); ok {
                 for _, record := range records {
-                        row := []string{
-                                record.Domain,
-                                record.Type,
-                                record.Record,
-                                record.Value,
-                                fmt.Sprintf("%d", record.TTL),
-                                record.Resolver,
+                        o.writeCSVRow(csvWriter, o.csvRow(&record))
+                }
+                
+                // With -batch-size this only moves the rows into the batch
+                // buffer, and it keeps the -rotate-size count current
+                csvWriter.Flush()
+        }
+}
+
+// csvRow returns the CSV row for a record, with the columns of the header
+// written by writeCSVHeader
+func (o *OutputHandler) csvRow(record *OutputRecord) []string {
+        if o.fields != nil {
+                return fieldRow(o.fields, record)
+        }
+        
+        row := []string{
+                record.Domain,
+                record.Type,
+                record.Record,
+                record.Value,
+                fmt.Sprintf("%d", record.TTL),
+                record.Resolver,
+        }
+        if o.emitNX {
+                row = append(row, record.Status)
+        }
+        if o.timestamp {
+                row = append(row, record.ObservedAt)
+        }
+        if o.checkLame {
+                lame := ""
+                if record.Lame != nil {
+                        lame = fmt.Sprintf("%t", *record.Lame)
+                }
+                row = append(row, lame)
+        }
+        return row
+}
+
+// WriteDomain writes a bare domain name, as a JSON object for the JSON
+// formats and as a plain line otherwise
+func (o *OutputHandler) WriteDomain(domain string) {
+        for _, tee := range o.tees {
+                tee.WriteDomain(domain)
+        }
+        
+        o.mutex.Lock()
+        defer o.mutex.Unlock()
+        
+        if o.format == "json" || o.format == "json-grouped" {
+                data, _ := o.marshalJSON(map[string]string{"domain": domain})
+                fmt.Fprintf(o.out, "%s\n", data)
+        } else {
+                fmt.Fprintln(o.out, domain)
+        }
+        o.wrote(1)
+}
+
+// WriteComparison writes a -compare-resolvers divergence, as a JSON object
+// for the JSON formats and as one line listing both answer sets otherwise
+func (o *OutputHandler) WriteComparison(c *Comparison) {
+        for _, tee := range o.tees {
+                tee.WriteComparison(c)
+        }
+        
+        o.mutex.Lock()
+        defer o.mutex.Unlock()
+        
+        if o.format == "json" || o.format == "json-grouped" {
+                data, err := o.marshalJSON(c)
+                if err != nil {
+                        if o.logger != nil {
+                                o.logger.Errorf("Error marshaling JSON: %v", err)
                         }
-                        csvWriter.Write(row)
+                        return
                 }
+                fmt.Fprintf(o.out, "%s\n", data)
+                return
+        }
+        
+        fmt.Fprintf(o.out, "%s %s DIFFERS A=%s[%s] B=%s[%s]\n", c.Domain, c.Type,
+                c.RcodeA, strings.Join(c.AnswersA, ","), c.RcodeB, strings.Join(c.AnswersB, ","))
+}
+
+// WriteOpenResolverCheck writes a -check-open verdict, as a JSON object for
+// the JSON formats and as a resolver and OPEN or CLOSED line otherwise
+func (o *OutputHandler) WriteOpenResolverCheck(check *OpenResolverCheck) {
+        for _, tee := range o.tees {
+                tee.WriteOpenResolverCheck(check)
+        }
+        
+        o.mutex.Lock()
+        defer o.mutex.Unlock()
+        
+        if o.format == "json" || o.format == "json-grouped" {
+                data, err := o.marshalJSON(check)
+                if err != nil {
+                        if o.logger != nil {
+                                o.logger.Errorf("Error marshaling JSON: %v", err)
+                        }
+                        return
+                }
+                fmt.Fprintf(o.out, "%s\n", data)
+                return
+        }
+        
+        verdict := "CLOSED"
+        if check.Open {
+                verdict = "OPEN"
+        }
+        detail := check.Error
+        if detail == "" {
+                detail = fmt.Sprintf("%s ra=%t answers=%d", check.Rcode, check.RecursionAvailable, check.Answers)
+        }
+        fmt.Fprintf(o.out, "%s\t%s\t%s\n", check.Resolver, verdict, detail)
+}
+
+// PrintAnswerGroups logs the address sets shared between domains, if
+// grouping was enabled
+func (o *OutputHandler) PrintAnswerGroups() {
+        if o.groups != nil && o.logger != nil {
+                o.groups.PrintReport(o.logger)
+        }
+}
+
+// WriteSummary writes a statistics summary in the output format, as a
+// single JSON object for the JSON formats or one key and value per line
+func (o *OutputHandler) WriteSummary(summary map[string]interface{}) {
+        for _, tee := range o.tees {
+                tee.WriteSummary(summary)
+        }
+        
+        o.mutex.Lock()
+        defer o.mutex.Unlock()
+        
+        if o.format == "json" || o.format == "json-grouped" {
+                data, err := o.marshalJSON(summary)
+                if err != nil {
+                        if o.logger != nil {
+                                o.logger.Errorf("Error marshaling JSON: %v", err)
+                        }
+                        return
+                }
+                fmt.Fprintf(o.out, "%s\n", data)
+                return
+        }
+        
+        keys := make([]string, 0, len(summary))
+        for key := range summary {
+                keys = append(keys, key)
+        }
+        sort.Strings(keys)
+        
+        csvWriter, isCSV := o.writer.(*csv.Writer)
+        for _, key := range keys {
+                value := fmt.Sprintf("%v", summary[key])
+                if isCSV {
+                        csvWriter.Write([]string{key, value})
+                } else {
+                        fmt.Fprintf(o.out, "%s\t%s\n", key, value)
+                }
+        }
+        if isCSV {
                 csvWriter.Flush()
         }
 }
 
 // Close closes the output handler and flushes any pending data
 func (o *OutputHandler) Close() {
+        for _, tee := range o.tees {
+                tee.Close()
+        }
+        
         o.mutex.Lock()
         defer o.mutex.Unlock()
         
+        o.writeMerged()
+        o.closeSink()
+}
+
+// closeSink flushes pending data and closes the current sink
+func (o *OutputHandler) closeSink() {
         if csvWriter, ok := o.writer.(*csv.Writer); ok {
                 csvWriter.Flush()
         }
+        o.flushBatch()
         
-        if o.file != os.Stdout {
-                o.file.Close()
+        // Closed in order so the gzip trailer is written before the file closes
+        for _, closer := range o.closers {
+                if err := closer.Close(); err != nil && o.logger != nil {
+                        o.logger.Errorf("Error closing output: %v", err)
+                }
         }
+        o.closers = nil
 }
 
 // Flush flushes any buffered output
 func (o *OutputHandler) Flush() {
+        for _, tee := range o.tees {
+                tee.Flush()
+        }
+        
         o.mutex.Lock()
         defer o.mutex.Unlock()
         
         if csvWriter, ok := o.writer.(*csv.Writer); ok {
                 csvWriter.Flush()
         }
+        o.flushBatch()
         
-        o.file.Sync()
+        if o.compressor != nil {
+                o.compressor.Flush()
+        }
+        
+        if o.file != nil {
+                o.file.Sync()
+        }
 }
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// esQueueBatches is how many batches may wait to be sent before Write
+	// blocks, which holds back the pipeline while the cluster catches up
+	esQueueBatches = 4
+
+	// esMaxRetries and esRetryDelay bound the retries of a failed bulk request
+	esMaxRetries = 5
+	esRetryDelay = 500 * time.Millisecond
+
+	// maxESResponseSize bounds how much of a bulk response body is read
+	maxESResponseSize = 16 << 20
+)
+
+// esSink batches JSON output lines and indexes them through the
+// Elasticsearch/OpenSearch _bulk API
+type esSink struct {
+	endpoint  string
+	client    *http.Client
+	batchSize int
+	interval  time.Duration
+	logger    *Logger
+
+	lines chan []byte
+	done  chan struct{}
+
+	// Totals reported when the sink closes, owned by the run goroutine
+	indexed int
+	dropped int
+}
+
+// esBulkResponse is the part of a _bulk response needed to find failed items
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// newESSink creates a sink posting to the _bulk endpoint of index at
+// baseURL. Credentials may be given in the URL as user:password@host.
+func newESSink(baseURL, index string, batchSize int, interval, timeout time.Duration, logger *Logger) (*esSink, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q (use http or https)", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + url.PathEscape(index) + "/_bulk"
+
+	s := &esSink{
+		endpoint:  u.String(),
+		client:    &http.Client{Timeout: timeout},
+		batchSize: batchSize,
+		interval:  interval,
+		logger:    logger,
+		lines:     make(chan []byte, batchSize*esQueueBatches),
+		done:      make(chan struct{}),
+	}
+	go s.run()
+
+	return s, nil
+}
+
+// Write queues every non-empty line in p as a document, blocking while the
+// queue is full
+func (s *esSink) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		s.lines <- append([]byte(nil), line...)
+	}
+	return len(p), nil
+}
+
+// Close sends the remaining documents and waits for the last request
+func (s *esSink) Close() error {
+	close(s.lines)
+	<-s.done
+
+	if s.logger != nil {
+		s.logger.Printf("Elasticsearch output: %d documents indexed, %d dropped", s.indexed, s.dropped)
+	}
+	if s.dropped > 0 {
+		return fmt.Errorf("%d documents could not be indexed", s.dropped)
+	}
+	return nil
+}
+
+// run collects queued documents into batches, sending one whenever it is
+// full or the flush interval passes
+func (s *esSink) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	var batch [][]byte
+	for {
+		select {
+		case line, ok := <-s.lines:
+			if !ok {
+				s.send(batch)
+				return
+			}
+			batch = append(batch, line)
+			if len(batch) >= s.batchSize {
+				s.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			s.send(batch)
+			batch = nil
+		}
+	}
+}
+
+// send indexes a batch, retrying with backoff while the request fails or
+// the cluster rejects items as overloaded. Documents rejected for any
+// other reason, or still failing after the last retry, are dropped.
+func (s *esSink) send(batch [][]byte) {
+	delay := esRetryDelay
+
+	for attempt := 0; len(batch) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		retry, rejected, err := s.post(batch)
+		if err != nil {
+			if attempt >= esMaxRetries {
+				s.logf("Bulk request failed, dropping %d documents: %v", len(batch), err)
+				s.dropped += len(batch)
+				return
+			}
+			s.logf("Bulk request failed (attempt %d), retrying: %v", attempt+1, err)
+			continue
+		}
+
+		s.indexed += len(batch) - len(retry) - rejected
+		s.dropped += rejected
+		if len(retry) > 0 && attempt >= esMaxRetries {
+			s.logf("Dropping %d documents still rejected after %d retries", len(retry), esMaxRetries)
+			s.dropped += len(retry)
+			return
+		}
+		batch = retry
+	}
+}
+
+// post sends one bulk request and returns the documents that should be
+// retried and the number that were rejected for good
+func (s *esSink) post(batch [][]byte) ([][]byte, int, error) {
+	var body bytes.Buffer
+	for _, doc := range batch {
+		body.WriteString("{\"index\":{}}\n")
+		body.Write(doc)
+		body.WriteByte('\n')
+	}
+
+	resp, err := s.client.Post(s.endpoint, "application/x-ndjson", &body)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxESResponseSize))
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return nil, 0, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		// The request itself is bad, so retrying won't help
+		s.logf("Bulk request rejected with HTTP %d, dropping %d documents: %s",
+			resp.StatusCode, len(batch), strings.TrimSpace(string(data)))
+		return nil, len(batch), nil
+	}
+
+	var result esBulkResponse
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, 0, fmt.Errorf("invalid bulk response: %v", err)
+	}
+	if !result.Errors {
+		return nil, 0, nil
+	}
+
+	var retry [][]byte
+	rejected := 0
+	for i, item := range result.Items {
+		if i >= len(batch) {
+			break
+		}
+		for _, status := range item {
+			switch {
+			case status.Status == http.StatusTooManyRequests || status.Status >= 500:
+				retry = append(retry, batch[i])
+			case status.Status >= 300:
+				s.logf("Document rejected with status %d: %s", status.Status, status.Error)
+				rejected++
+			}
+		}
+	}
+	return retry, rejected, nil
+}
+
+// logf logs a sink problem when a logger is set
+func (s *esSink) logf(format string, args ...interface{}) {
+	if s.logger != nil {
+		s.logger.Warnf("Elasticsearch output: "+format, args...)
+	}
+}
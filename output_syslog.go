@@ -0,0 +1,52 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"log/syslog"
+	"strings"
+)
+
+// syslogSink writes each output line as a separate syslog message
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+// newSyslogSink connects to the local syslog daemon, or to a remote one
+// when addr is set. The address may carry a udp:// or tcp:// prefix and
+// defaults to UDP.
+func newSyslogSink(addr string) (*syslogSink, error) {
+	network := ""
+	if addr != "" {
+		network = "udp"
+		if idx := strings.Index(addr, "://"); idx != -1 {
+			network = addr[:idx]
+			addr = addr[idx+3:]
+		}
+	}
+
+	writer, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_USER, "dns-resolver")
+	if err != nil {
+		return nil, err
+	}
+
+	return &syslogSink{writer: writer}, nil
+}
+
+// Write sends every non-empty line in p as its own message
+func (s *syslogSink) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(string(p), "\n") {
+		if line == "" {
+			continue
+		}
+		if err := s.writer.Info(line); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close closes the connection to the syslog daemon
+func (s *syslogSink) Close() error {
+	return s.writer.Close()
+}
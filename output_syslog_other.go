@@ -0,0 +1,23 @@
+//go:build windows || plan9
+
+package main
+
+import "errors"
+
+// syslogSink is unavailable on platforms without log/syslog
+type syslogSink struct{}
+
+// newSyslogSink always fails on platforms without log/syslog
+func newSyslogSink(addr string) (*syslogSink, error) {
+	return nil, errors.New("syslog output is not supported on this platform")
+}
+
+// Write is never reached since newSyslogSink always fails
+func (s *syslogSink) Write(p []byte) (int, error) {
+	return 0, errors.New("syslog output is not supported on this platform")
+}
+
+// Close is never reached since newSyslogSink always fails
+func (s *syslogSink) Close() error {
+	return nil
+}
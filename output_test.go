@@ -0,0 +1,200 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// writeOutput writes results through a simple-format file handler and
+// returns what was written
+func writeOutput(t *testing.T, config *Config, results ...*DNSResult) string {
+	t.Helper()
+
+	config.OutputFile = filepath.Join(t.TempDir(), "out.txt")
+	handler, err := newOutputHandler(config, nil)
+	if err != nil {
+		t.Fatalf("newOutputHandler: %v", err)
+	}
+	for _, result := range results {
+		handler.WriteResult(result)
+	}
+	handler.Close()
+
+	data, err := os.ReadFile(config.OutputFile)
+	if err != nil {
+		t.Fatalf("reading output: %v", err)
+	}
+	return string(data)
+}
+
+// answerResult returns a successful result answering with the records in rrs
+func answerResult(t *testing.T, domain string, qtype uint16, rrs ...string) *DNSResult {
+	t.Helper()
+
+	response := &dns.Msg{}
+	response.SetQuestion(dns.Fqdn(domain), qtype)
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatalf("dns.NewRR(%q): %v", s, err)
+		}
+		response.Answer = append(response.Answer, rr)
+	}
+
+	return &DNSResult{Domain: domain, Type: qtype, Response: response, Resolver: "192.0.2.53:53"}
+}
+
+func TestWriteResultCanonicalIPv6(t *testing.T) {
+	compressed := writeOutput(t, &Config{OutputFormat: "simple", Normalize: true},
+		answerResult(t, "example.com", dns.TypeAAAA, "example.com. 300 IN AAAA 2001:db8::1"))
+	expanded := writeOutput(t, &Config{OutputFormat: "simple", Normalize: true},
+		answerResult(t, "example.com", dns.TypeAAAA, "example.com. 300 IN AAAA 2001:0db8:0000::0001"))
+
+	if compressed != expanded {
+		t.Errorf("output differs:\n%q\n%q", compressed, expanded)
+	}
+	if want := "example.com\tAAAA\t2001:db8::1\t300\n"; compressed != want {
+		t.Errorf("output = %q, want %q", compressed, want)
+	}
+}
+
+func TestWriteMergedColumns(t *testing.T) {
+	results := []*DNSResult{
+		answerResult(t, "example.com", dns.TypeA, "example.com. 300 IN A 192.0.2.1"),
+		answerResult(t, "example.com", dns.TypeAAAA, "example.com. 300 IN AAAA 2001:db8::1"),
+	}
+
+	output := writeOutput(t, &Config{
+		OutputFormat:  "csv",
+		MergeFamilies: true,
+		EmitNXDomain:  true,
+		Timestamp:     true,
+		CheckLame:     true,
+	}, results...)
+
+	rows, err := csv.NewReader(strings.NewReader(output)).ReadAll()
+	if err != nil {
+		t.Fatalf("reading CSV: %v\n%s", err, output)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want header and one merged row:\n%s", len(rows), output)
+	}
+
+	header, row := rows[0], rows[1]
+	want := []string{"example.com", "A/AAAA", "example.com.", "192.0.2.1,2001:db8::1", "300", "192.0.2.53:53", "NOERROR"}
+	for i, value := range want {
+		if row[i] != value {
+			t.Errorf("column %s = %q, want %q", header[i], row[i], value)
+		}
+	}
+	if observedAt := row[len(want)]; observedAt == "" {
+		t.Errorf("ObservedAt column is empty")
+	}
+
+	simple := writeOutput(t, &Config{OutputFormat: "simple", MergeFamilies: true, Timestamp: true}, results...)
+	fields := strings.Split(strings.TrimSuffix(simple, "\n"), "\t")
+	if len(fields) != 5 || fields[2] != "192.0.2.1,2001:db8::1" || fields[4] == "" {
+		t.Errorf("merged simple line = %q, want addresses and an observed_at column", simple)
+	}
+}
+
+func TestRotateSizeCountsRecordBytes(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{
+		OutputFormat: "simple",
+		OutputFile:   filepath.Join(dir, "out.txt.gz"),
+		BatchSize:    1000,
+		rotateBytes:  100,
+	}
+	handler, err := newOutputHandler(config, nil)
+	if err != nil {
+		t.Fatalf("newOutputHandler: %v", err)
+	}
+
+	// Each line is 29 bytes, so every file takes four before reaching 100,
+	// however small they compress and though the batch is never full
+	result := answerResult(t, "example.com", dns.TypeA, "example.com. 300 IN A 192.0.2.1")
+	for i := 0; i < 10; i++ {
+		handler.WriteResult(result)
+	}
+	handler.Close()
+
+	for name, want := range map[string]int{"out.txt.gz": 4, "out.1.txt.gz": 4, "out.2.txt.gz": 2} {
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("opening %s: %v", name, err)
+			continue
+		}
+		reader, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("reading %s: %v", name, err)
+		}
+		data, err := io.ReadAll(reader)
+		file.Close()
+		if err != nil {
+			t.Fatalf("reading %s: %v", name, err)
+		}
+		if got := strings.Count(string(data), "\n"); got != want {
+			t.Errorf("%s has %d records, want %d", name, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.3.txt.gz")); err == nil {
+		t.Errorf("rotated past out.2.txt.gz")
+	}
+}
+
+func BenchmarkWriteResult(b *testing.B) {
+	response := &dns.Msg{}
+	response.SetQuestion("example.com.", dns.TypeA)
+	for i := 1; i <= 4; i++ {
+		rr, _ := dns.NewRR(fmt.Sprintf("example.com. 300 IN A 192.0.2.%d", i))
+		response.Answer = append(response.Answer, rr)
+	}
+	result := &DNSResult{Domain: "example.com", Type: dns.TypeA, Response: response, Resolver: "192.0.2.53:53"}
+
+	for _, batchSize := range []int{1, 1000} {
+		for _, format := range []string{"simple", "csv"} {
+			b.Run(fmt.Sprintf("%s/batch=%d", format, batchSize), func(b *testing.B) {
+				config := &Config{
+					OutputFormat: format,
+					OutputFile:   filepath.Join(b.TempDir(), "out"),
+					BatchSize:    batchSize,
+				}
+				handler, err := newOutputHandler(config, nil)
+				if err != nil {
+					b.Fatalf("newOutputHandler: %v", err)
+				}
+				defer handler.Close()
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					handler.WriteResult(result)
+				}
+			})
+		}
+	}
+}
+
+func TestWriteJSONFieldsSchemaVersion(t *testing.T) {
+	fields, err := parseOutputFields("value,domain")
+	if err != nil {
+		t.Fatalf("parseOutputFields: %v", err)
+	}
+
+	output := writeOutput(t, &Config{OutputFormat: "json", outputFields: fields},
+		answerResult(t, "example.com", dns.TypeA, "example.com. 300 IN A 192.0.2.1"))
+
+	want := fmt.Sprintf("{\"schema_version\":%d,\"value\":\"192.0.2.1\",\"domain\":\"example.com\"}\n", outputSchemaVersion)
+	if output != want {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+}
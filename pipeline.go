@@ -0,0 +1,519 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// domainJob is a single domain queued for resolution
+type domainJob struct {
+	Domain string
+	// Depth is the number of wordlist labels prepended to the input name
+	Depth int
+	// Types overrides the global query types for this domain when set
+	Types []uint16
+	// Search holds the further -search names to try, in order, if Domain
+	// does not exist
+	Search []string
+}
+
+// inputEntry is a parsed input line waiting to be dispatched
+type inputEntry struct {
+	domain string
+	types  []uint16
+}
+
+// shuffleBuffer randomizes a stream of entries using a fixed amount of
+// memory. Once full, each new entry evicts a random buffered one.
+type shuffleBuffer struct {
+	entries []inputEntry
+	size    int
+	rng     *rand.Rand
+}
+
+// newShuffleBuffer creates a shuffle buffer holding up to size entries
+func newShuffleBuffer(size int) *shuffleBuffer {
+	return &shuffleBuffer{
+		size: size,
+		rng:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Push adds an entry, returning a randomly chosen entry to dispatch once
+// the buffer is full
+func (b *shuffleBuffer) Push(entry inputEntry) (inputEntry, bool) {
+	if len(b.entries) < b.size {
+		b.entries = append(b.entries, entry)
+		return inputEntry{}, false
+	}
+
+	idx := b.rng.Intn(len(b.entries) + 1)
+	if idx == len(b.entries) {
+		return entry, true
+	}
+
+	evicted := b.entries[idx]
+	b.entries[idx] = entry
+	return evicted, true
+}
+
+// Drain returns the remaining entries in random order and empties the buffer
+func (b *shuffleBuffer) Drain() []inputEntry {
+	entries := b.entries
+	b.rng.Shuffle(len(entries), func(i, j int) {
+		entries[i], entries[j] = entries[j], entries[i]
+	})
+
+	b.entries = nil
+	return entries
+}
+
+// reservoir keeps a uniformly random sample of up to size entries from a
+// stream of any length, for -sample (Algorithm R)
+type reservoir struct {
+	entries []inputEntry
+	size    int
+	seen    int64
+	rng     *rand.Rand
+}
+
+// newReservoir creates a reservoir sampling up to size entries
+func newReservoir(size int) *reservoir {
+	return &reservoir{
+		size: size,
+		rng:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Push offers an entry to the sample. Once full, the n-th entry replaces
+// a random sampled one with probability size/n.
+func (r *reservoir) Push(entry inputEntry) {
+	r.seen++
+	if len(r.entries) < r.size {
+		r.entries = append(r.entries, entry)
+		return
+	}
+
+	if idx := r.rng.Int63n(r.seen); idx < int64(r.size) {
+		r.entries[idx] = entry
+	}
+}
+
+// Drain returns the sample in random order and empties the reservoir
+func (r *reservoir) Drain() []inputEntry {
+	entries := r.entries
+	r.rng.Shuffle(len(entries), func(i, j int) {
+		entries[i], entries[j] = entries[j], entries[i]
+	})
+
+	r.entries = nil
+	r.seen = 0
+	return entries
+}
+
+// queryPipeline holds the state shared by the workers of a resolution run
+type queryPipeline struct {
+	config            *Config
+	typeTiers         [][]uint16
+	resolverPool      *ResolverPool
+	iterativeResolver *IterativeResolver
+	cache             *ResponseCache
+	rateLimiter       *RateLimiter
+	wildcardDetector  *WildcardDetector
+	lameChecker       *lameChecker
+	consistency       *consistencyTracker
+	scopeFilter       *ScopeFilter
+	budget            *queryBudget
+	wordlist          []string
+	maxDepth          int
+	stats             *Stats
+	logger            *Logger
+
+	domainChan chan *domainJob
+	resultChan chan *DNSResult
+
+	// pending counts queued domains, including generated ones, that
+	// have not been fully processed yet
+	pending sync.WaitGroup
+	workers sync.WaitGroup
+
+	// retire asks one worker to exit, for -auto-workers; nil otherwise
+	retire chan struct{}
+}
+
+// inputJobs returns the jobs for one input line. In brute-force mode the
+// line is a base domain and every wordlist entry is prepended to it.
+// Generated names inherit the line's query types. A bare label is
+// qualified with the -search domains; brute-force bases take the first
+// one, since picking among them would need a query.
+func (p *queryPipeline) inputJobs(domain string, types []uint16) []*domainJob {
+	var search []string
+	if names := searchNames(domain, p.config.searchDomains); names != nil {
+		domain, search = names[0], names[1:]
+	}
+
+	if !p.config.Brute {
+		return []*domainJob{{Domain: domain, Types: types, Search: search}}
+	}
+
+	var jobs []*domainJob
+	for _, subdomain := range generateSubdomains(domain, p.wordlist) {
+		jobs = append(jobs, &domainJob{Domain: subdomain, Depth: 1, Types: types})
+	}
+	return jobs
+}
+
+// dispatch queues a job for the workers unless it is out of scope or the
+// query budget is spent. It returns false once the run is cancelled.
+func (p *queryPipeline) dispatch(ctx context.Context, job *domainJob) bool {
+	if p.budget.Exhausted() {
+		return true
+	}
+
+	if !p.scopeFilter.InScope(job.Domain) {
+		p.stats.IncrementOutOfScope()
+		p.logger.Debugf("Skipping out-of-scope domain: %s", job.Domain)
+		return true
+	}
+
+	p.pending.Add(1)
+	select {
+	case p.domainChan <- job:
+		p.stats.IncrementTotal()
+		return true
+	case <-ctx.Done():
+		p.pending.Done()
+		return false
+	}
+}
+
+// worker resolves queued domains until the queue is closed
+func (p *queryPipeline) worker(ctx context.Context) {
+	defer p.workers.Done()
+
+	for {
+		select {
+		case job, ok := <-p.domainChan:
+			if !ok {
+				return
+			}
+			p.process(ctx, job)
+
+		case <-p.retire:
+			return
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// process queries every configured type for one domain and, when the
+// domain resolves and recursion allows it, queues its generated children
+func (p *queryPipeline) process(ctx context.Context, job *domainJob) {
+	defer p.pending.Done()
+
+	// Lookups share one deadline so a slow domain can't hold the worker for
+	// every type's retries; results are still delivered on the run context
+	lookupCtx := ctx
+	if p.config.DomainDeadline > 0 {
+		var cancel context.CancelFunc
+		lookupCtx, cancel = context.WithTimeout(ctx, p.config.DomainDeadline)
+		defer cancel()
+	}
+
+	// A bare label with several search domains settles on the first name
+	// that exists, as a stub resolver walking its search list would
+	var probe *DNSResult
+	if len(job.Search) > 0 {
+		domain, result := p.search(lookupCtx, job)
+		if result == nil || p.abandoned(ctx, lookupCtx, result, job) {
+			return
+		}
+		job = &domainJob{Domain: domain, Depth: job.Depth, Types: job.Types}
+		probe = result
+	}
+
+	// A single cheap A query weeds out dead names before the full type set
+	if p.config.Prefilter {
+		if probe == nil {
+			if !p.budget.Take() {
+				return
+			}
+
+			probe = p.lookup(lookupCtx, job.Domain, dns.TypeA)
+			if p.abandoned(ctx, lookupCtx, probe, job) {
+				return
+			}
+		}
+		if probe.Error != nil || probe.Response == nil || probe.Response.Rcode != dns.RcodeSuccess {
+			p.stats.IncrementPrefiltered()
+			return
+		}
+	}
+
+	resolved := false
+
+	// A type token on the input line is a single tier
+	tiers := p.typeTiers
+	if job.Types != nil {
+		tiers = [][]uint16{job.Types}
+	}
+
+types:
+	for _, tier := range tiers {
+		for _, qtype := range tier {
+			var result *DNSResult
+
+			if p.abandoned(ctx, lookupCtx, nil, job) {
+				return
+			}
+
+			if probe != nil && qtype == dns.TypeA {
+				// Reuse the prefilter or search answer instead of asking again
+				result = probe
+			} else {
+				if !p.budget.Take() {
+					break types
+				}
+				result = p.lookup(lookupCtx, job.Domain, qtype)
+				if p.abandoned(ctx, lookupCtx, result, job) {
+					return
+				}
+			}
+
+			if p.config.InlineWildcard && p.budget.Take() {
+				checkInlineWildcard(result, func(name string, qtype uint16) *DNSResult {
+					return p.lookup(lookupCtx, name, qtype)
+				})
+			}
+
+			if p.config.DetectDangling {
+				checkDangling(result, func(name string, qtype uint16) *DNSResult {
+					return p.lookup(lookupCtx, name, qtype)
+				}, p.logger)
+			}
+
+			if p.lameChecker != nil {
+				p.lameChecker.Check(lookupCtx, result, func(name string, qtype uint16) *DNSResult {
+					return p.lookup(lookupCtx, name, qtype)
+				})
+			}
+
+			if p.config.RequireFinalType && hasAnswer(result) && !hasFinalType(result) {
+				result.CNAMEOnly = true
+			}
+
+			// Processors may run lookups of their own, so they run here in
+			// the workers rather than in the single result processor
+			if result.Error == nil && result.Response != nil && len(result.Response.Answer) > 0 && !result.CNAMEOnly {
+				applyResultProcessors(lookupCtx, result, p.logger)
+			}
+
+			select {
+			case p.resultChan <- result:
+			case <-ctx.Done():
+				return
+			}
+
+			if hasAnswer(result) && !result.Wildcard && !result.CNAMEOnly {
+				resolved = true
+
+				// Skip the remaining types once the domain is known to resolve
+				if p.config.TypeStrategy == typeStrategyFirstSuccess {
+					break types
+				}
+			}
+		}
+
+		// A tier with an answer makes the lower-priority tiers unnecessary
+		if resolved && p.config.TypeStrategy == typeStrategyPriority {
+			break
+		}
+	}
+
+	if resolved && job.Depth < p.maxDepth {
+		p.expand(ctx, job)
+	}
+}
+
+// search sends an A query for each of the job's candidate names in order
+// and returns the first one that is not NXDOMAIN, with its result. If
+// every name is NXDOMAIN the first is returned. The result is nil when
+// the query budget runs out first.
+func (p *queryPipeline) search(ctx context.Context, job *domainJob) (string, *DNSResult) {
+	var firstResult *DNSResult
+
+	for i, name := range append([]string{job.Domain}, job.Search...) {
+		// The first name was scope-checked when it was dispatched
+		if i > 0 && !p.scopeFilter.InScope(name) {
+			continue
+		}
+		if !p.budget.Take() {
+			break
+		}
+
+		result := p.lookup(ctx, name, dns.TypeA)
+		if result.Error != nil || result.Response == nil || result.Response.Rcode != dns.RcodeNameError {
+			return name, result
+		}
+		if firstResult == nil {
+			firstResult = result
+		}
+		p.logger.Debugf("Search name %s does not exist", name)
+	}
+
+	if firstResult == nil {
+		return "", nil
+	}
+	return firstResult.Domain, firstResult
+}
+
+// abandoned reports whether lookupCtx hit the -domain-deadline while the
+// run itself goes on, counting the domain once when it did. A result that
+// completed despite the deadline is kept; one the deadline cut off is not.
+func (p *queryPipeline) abandoned(ctx, lookupCtx context.Context, result *DNSResult, job *domainJob) bool {
+	if lookupCtx.Err() == nil || ctx.Err() != nil {
+		return false
+	}
+	if result != nil && result.Error == nil {
+		return false
+	}
+
+	p.stats.IncrementAbandoned()
+	p.logger.Debugf("Abandoning %s after the %v domain deadline", job.Domain, p.config.DomainDeadline)
+	return true
+}
+
+// expand queues the wordlist children of a resolved domain. Children are
+// sent from a separate goroutine so a worker never blocks on the queue it
+// is draining; the extra pending count keeps the run open until they are in.
+// Names are built one at a time as the queue accepts them, so a waiting
+// expansion holds only its goroutine rather than a copy of the wordlist.
+func (p *queryPipeline) expand(ctx context.Context, job *domainJob) {
+	// Every child of a wildcard zone would resolve, so don't recurse into
+	// one. The probe is a query like any other; with the budget spent
+	// there is no room for the children either.
+	if p.wildcardDetector != nil {
+		if !p.budget.Take() {
+			return
+		}
+		probe := p.lookup(ctx, job.Domain, dns.TypeA)
+		if p.wildcardDetector.IsWildcard(ctx, probe) {
+			return
+		}
+	}
+
+	p.pending.Add(1)
+	go func() {
+		defer p.pending.Done()
+		for _, word := range p.wordlist {
+			child := &domainJob{Domain: word + "." + job.Domain, Depth: job.Depth + 1, Types: job.Types}
+			if !p.dispatch(ctx, child) {
+				return
+			}
+		}
+	}()
+}
+
+// lookup resolves a single name and type, consulting the cache first
+func (p *queryPipeline) lookup(ctx context.Context, name string, qtype uint16) *DNSResult {
+	if p.cache != nil {
+		if result, negative := p.cache.Lookup(name, qtype); result != nil {
+			p.stats.IncrementCacheHits(negative)
+			return result
+		}
+	}
+
+	var result *DNSResult
+	if p.iterativeResolver != nil {
+		// Rate limiting is applied to each step of the walk
+		result = p.iterativeResolver.Resolve(ctx, name, qtype)
+	} else if p.config.ProbeCount > 1 {
+		// Ask several resolvers and union what they hand out
+		result = p.probeDNSQuery(ctx, name, qtype, p.config.ProbeCount)
+	} else {
+		// Apply rate limiting
+		p.rateLimiter.Wait(ctx)
+		p.sleepJitter(ctx)
+
+		// Perform DNS query with retries
+		result = performDNSQuery(ctx, name, qtype, p.resolverPool.ForDomain(name), p.config, p.logger)
+		p.consistency.Observe(result)
+	}
+
+	if p.cache != nil {
+		p.cache.Store(result)
+	}
+	return result
+}
+
+// sleepJitter waits a random delay of up to -jitter before a query, so
+// workers released by the rate limiter together don't query in a burst.
+// It returns early when ctx is done.
+func (p *queryPipeline) sleepJitter(ctx context.Context) {
+	if p.config.Jitter <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(p.config.Jitter))))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// hasAnswer reports whether a result is a successful response with answers
+func hasAnswer(result *DNSResult) bool {
+	return result.Error == nil && result.Response != nil &&
+		result.Response.Rcode == dns.RcodeSuccess && len(result.Response.Answer) > 0
+}
+
+// hasFinalType reports whether a response answers with at least one record
+// of the queried type, rather than only the CNAMEs leading to it
+func hasFinalType(result *DNSResult) bool {
+	for _, rr := range result.Response.Answer {
+		if rr.Header().Rrtype == result.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// queryBudget caps the total number of lookups in a run. A nil budget is
+// unlimited.
+type queryBudget struct {
+	limit int64
+	used  int64
+}
+
+// newQueryBudget creates a budget of limit lookups, or nil for no limit
+func newQueryBudget(limit int) *queryBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &queryBudget{limit: int64(limit)}
+}
+
+// Take consumes one lookup from the budget, reporting whether one was left
+func (b *queryBudget) Take() bool {
+	if b == nil {
+		return true
+	}
+	return atomic.AddInt64(&b.used, 1) <= b.limit
+}
+
+// Exhausted reports whether the budget has been used up
+func (b *queryBudget) Exhausted() bool {
+	if b == nil {
+		return false
+	}
+	return atomic.LoadInt64(&b.used) >= b.limit
+}
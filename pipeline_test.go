@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestReservoirSample(t *testing.T) {
+	sample := newReservoir(10)
+	for i := 0; i < 1000; i++ {
+		sample.Push(inputEntry{domain: fmt.Sprintf("%d.example", i)})
+	}
+
+	entries := sample.Drain()
+	if len(entries) != 10 {
+		t.Fatalf("sampled %d entries, want 10", len(entries))
+	}
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		if seen[entry.domain] {
+			t.Errorf("%s sampled twice", entry.domain)
+		}
+		seen[entry.domain] = true
+	}
+
+	// Shorter inputs are kept whole
+	for i := 0; i < 3; i++ {
+		sample.Push(inputEntry{domain: fmt.Sprintf("%d.example", i)})
+	}
+	if n := len(sample.Drain()); n != 3 {
+		t.Errorf("sampled %d of 3 entries", n)
+	}
+}
+
+func TestResultProcessorDrainsOnCancel(t *testing.T) {
+	config := &Config{OutputFormat: "simple", OutputFile: filepath.Join(t.TempDir(), "out.txt")}
+	handler, err := newOutputHandler(config, nil)
+	if err != nil {
+		t.Fatalf("newOutputHandler: %v", err)
+	}
+
+	// Results left queued when the run is cut short
+	resultChan := make(chan *DNSResult, 3)
+	for i := 0; i < 3; i++ {
+		domain := fmt.Sprintf("%d.example", i)
+		resultChan <- answerResult(t, domain, dns.TypeA, domain+". 300 IN A 192.0.2.1")
+	}
+	close(resultChan)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	stats := NewStats()
+	resultProcessor(ctx, resultChan, handler, nil, nil, stats, nil)
+	handler.Close()
+
+	if n := stats.GetProcessed(); n != 3 {
+		t.Errorf("processed %d results, want 3", n)
+	}
+	data, err := os.ReadFile(config.OutputFile)
+	if err != nil {
+		t.Fatalf("reading output: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if domain := fmt.Sprintf("%d.example\t", i); !strings.Contains(string(data), domain) {
+			t.Errorf("output is missing %s:\n%s", domain, data)
+		}
+	}
+}
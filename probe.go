@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// probeDNSQuery sends the same query probes times, rotating through the
+// resolver pool, and unions the answers. Load-balanced names often hand
+// out only part of their address pool per response, so the union finds
+// backends a single query would miss. The first successful response is
+// the base of the result; if no probe succeeds the last failure is
+// returned.
+func (p *queryPipeline) probeDNSQuery(ctx context.Context, name string, qtype uint16, probes int) *DNSResult {
+	var merged *DNSResult
+	var last *DNSResult
+	inconsistent := false
+
+	// Per-probe address sets, kept for the -fastflux churn score
+	fastFlux := p.config.FastFlux && (qtype == dns.TypeA || qtype == dns.TypeAAAA)
+	var sets []map[string]bool
+
+	for i := 0; i < probes; i++ {
+		if ctx.Err() != nil {
+			break
+		}
+
+		p.rateLimiter.Wait(ctx)
+		p.sleepJitter(ctx)
+		result := performDNSQuery(ctx, name, qtype, p.resolverPool.ForDomain(name), p.config, p.logger)
+		p.consistency.Observe(result)
+		last = result
+		inconsistent = inconsistent || result.Inconsistent
+
+		if result.Error != nil || result.Response == nil || result.Response.Rcode != dns.RcodeSuccess {
+			continue
+		}
+
+		if fastFlux {
+			sets = append(sets, addressSet(result.Response))
+		}
+
+		if merged == nil {
+			merged = result
+			merged.Response = result.Response.Copy()
+			continue
+		}
+		unionAnswers(merged.Response, result.Response)
+	}
+
+	if merged == nil {
+		return last
+	}
+	merged.Inconsistent = inconsistent
+
+	distinct := countAddresses(merged.Response)
+	if distinct > 0 {
+		if merged.Annotations == nil {
+			merged.Annotations = make(map[string]string)
+		}
+		merged.Annotations["distinct_ips"] = strconv.Itoa(distinct)
+
+		p.logger.Debugf("Probed %s %s %d times: %d distinct addresses",
+			name, dns.TypeToString[qtype], probes, distinct)
+	}
+
+	if fastFlux && len(sets) >= 2 {
+		score := fastFluxScore(sets)
+		merged.FastFluxScore = &score
+		merged.FastFlux = score >= p.config.FastFluxThreshold
+	}
+
+	return merged
+}
+
+// unionAnswers appends the answers of other that base doesn't already hold
+func unionAnswers(base, other *dns.Msg) {
+	for _, rr := range other.Answer {
+		duplicate := false
+		for _, existing := range base.Answer {
+			if dns.IsDuplicate(existing, rr) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			base.Answer = append(base.Answer, rr)
+		}
+	}
+}
+
+// countAddresses returns the number of A and AAAA records in response
+func countAddresses(response *dns.Msg) int {
+	count := 0
+	for _, rr := range response.Answer {
+		switch rr.(type) {
+		case *dns.A, *dns.AAAA:
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// ResultProcessor enriches or inspects results. Registered processors are
+// called in order for every successful result by the worker that resolved
+// it, before it is written, and may add entries to result.Annotations.
+// Process must be safe to call from several workers at once.
+type ResultProcessor interface {
+	// Name identifies the processor in log messages
+	Name() string
+	// Process is called once per result; an error is logged and does not
+	// stop the result from being written
+	Process(ctx context.Context, result *DNSResult) error
+}
+
+var (
+	resultProcessors      []ResultProcessor
+	resultProcessorsMutex sync.RWMutex
+)
+
+// RegisterResultProcessor adds a processor to the chain run for each result
+func RegisterResultProcessor(processor ResultProcessor) {
+	resultProcessorsMutex.Lock()
+	defer resultProcessorsMutex.Unlock()
+
+	resultProcessors = append(resultProcessors, processor)
+}
+
+// applyResultProcessors runs every registered processor on result
+func applyResultProcessors(ctx context.Context, result *DNSResult, logger *Logger) {
+	resultProcessorsMutex.RLock()
+	defer resultProcessorsMutex.RUnlock()
+
+	for _, processor := range resultProcessors {
+		if err := processor.Process(ctx, result); err != nil && logger != nil {
+			logger.Warnf("Result processor %s failed for %s: %v", processor.Name(), result.Domain, err)
+		}
+	}
+}
+
+// asnZone is the Team Cymru IP to ASN mapping zone
+const asnZone = "origin.asn.cymru.com."
+
+// ASNProcessor is an example processor that annotates results with the
+// origin AS numbers of their IPv4 addresses, looked up over DNS through the
+// configured resolvers
+type ASNProcessor struct {
+	resolverPool *ResolverPool
+	rateLimiter  *RateLimiter
+	config       *Config
+	logger       *Logger
+	cache        sync.Map
+}
+
+// NewASNProcessor creates a new ASN enrichment processor
+func NewASNProcessor(resolverPool *ResolverPool, rateLimiter *RateLimiter, config *Config, logger *Logger) *ASNProcessor {
+	return &ASNProcessor{
+		resolverPool: resolverPool,
+		rateLimiter:  rateLimiter,
+		config:       config,
+		logger:       logger,
+	}
+}
+
+// Name returns the processor name
+func (p *ASNProcessor) Name() string {
+	return "asn"
+}
+
+// Process sets the "asn" annotation to the distinct AS numbers of the
+// result's A records, e.g. "AS13335 AS15169"
+func (p *ASNProcessor) Process(ctx context.Context, result *DNSResult) error {
+	seen := make(map[string]bool)
+	var asns []string
+
+	for _, rr := range result.Response.Answer {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			continue
+		}
+
+		asn, err := p.lookup(ctx, a.A)
+		if err != nil {
+			return err
+		}
+		if asn != "" && !seen[asn] {
+			seen[asn] = true
+			asns = append(asns, "AS"+asn)
+		}
+	}
+
+	if len(asns) == 0 {
+		return nil
+	}
+	sort.Strings(asns)
+
+	if result.Annotations == nil {
+		result.Annotations = make(map[string]string)
+	}
+	result.Annotations["asn"] = strings.Join(asns, " ")
+	return nil
+}
+
+// lookup returns the origin AS number for an IPv4 address, or an empty
+// string if it is not announced
+func (p *ASNProcessor) lookup(ctx context.Context, ip net.IP) (string, error) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return "", nil
+	}
+
+	key := ip4.String()
+	if asn, ok := p.cache.Load(key); ok {
+		return asn.(string), nil
+	}
+
+	if err := p.rateLimiter.Wait(ctx); err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%d.%d.%d.%d.%s", ip4[3], ip4[2], ip4[1], ip4[0], asnZone)
+	lookup := performDNSQuery(ctx, name, dns.TypeTXT, p.resolverPool, p.config, p.logger)
+	if lookup.Error != nil {
+		return "", lookup.Error
+	}
+
+	// Answers look like "13335 | 1.1.1.0/24 | AU | apnic | 2011-08-11"; an
+	// address originated by several ASes lists them space-separated
+	asn := ""
+	if lookup.Response != nil {
+		for _, rr := range lookup.Response.Answer {
+			txt, ok := rr.(*dns.TXT)
+			if !ok || len(txt.Txt) == 0 {
+				continue
+			}
+			fields := strings.Fields(strings.SplitN(txt.Txt[0], "|", 2)[0])
+			if len(fields) > 0 && isASN(fields[0]) {
+				asn = fields[0]
+				break
+			}
+		}
+	}
+
+	p.cache.Store(key, asn)
+	return asn, nil
+}
+
+// isASN reports whether s is a plain AS number
+func isASN(s string) bool {
+	n, err := strconv.ParseUint(s, 10, 32)
+	return err == nil && n > 0
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// queryLogFlushInterval is how often buffered -query-log lines are written
+const queryLogFlushInterval = time.Second
+
+// queryLog records every exchange with a resolver, one line each, for
+// -query-log. Lines are buffered and flushed periodically so logging
+// never waits on the disk per query. A nil queryLog records nothing.
+type queryLog struct {
+	file   *os.File
+	writer *bufio.Writer
+	mutex  sync.Mutex
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// openQueryLog creates or truncates the query log file and starts its
+// flusher
+func openQueryLog(path string) (*queryLog, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &queryLog{
+		file:   file,
+		writer: bufio.NewWriterSize(file, 64*1024),
+		done:   make(chan struct{}),
+	}
+
+	l.wg.Add(1)
+	go l.flusher()
+	return l, nil
+}
+
+// flusher writes out buffered lines until the log is closed
+func (l *queryLog) flusher() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(queryLogFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.mutex.Lock()
+			l.writer.Flush()
+			l.mutex.Unlock()
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// Record logs one exchange as
+//
+//	TIME RESOLVER TRANSPORT ID QNAME QTYPE RCODE ANSWERS LATENCY_MS [ERROR]
+//
+// with ERROR as the rcode and the quoted error text at the end when the
+// exchange failed
+func (l *queryLog) Record(resolver *DNSResolver, msg, response *dns.Msg, rtt time.Duration, err error) {
+	if l == nil || len(msg.Question) == 0 {
+		return
+	}
+
+	question := msg.Question[0]
+	rcode, answers := "ERROR", 0
+	if err == nil && response != nil {
+		rcode = dns.RcodeToString[response.Rcode]
+		answers = len(response.Answer)
+	}
+
+	line := fmt.Sprintf("%s %s %s %d %s %s %s %d %.3f",
+		time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		resolver.Address, resolver.Transport, msg.Id, question.Name,
+		dns.TypeToString[question.Qtype], rcode, answers,
+		float64(rtt)/float64(time.Millisecond))
+	if err != nil {
+		line += fmt.Sprintf(" %q", strings.TrimSpace(err.Error()))
+	}
+
+	l.mutex.Lock()
+	l.writer.WriteString(line)
+	l.writer.WriteByte('\n')
+	l.mutex.Unlock()
+}
+
+// Close stops the flusher and writes out the remaining lines
+func (l *queryLog) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	close(l.done)
+	l.wg.Wait()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.writer.Flush(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
@@ -2,6 +2,8 @@ package main
 
 import (
         "context"
+        "math"
+        "time"
 
         "golang.org/x/time/rate"
 )
@@ -9,23 +11,33 @@ import (
 // RateLimiter controls the rate of DNS queries
 type RateLimiter struct {
         limiter *rate.Limiter
+        burst   int
 }
 
-// NewRateLimiter creates a new rate limiter
-func NewRateLimiter(qps int) *RateLimiter {
+// NewRateLimiter creates a new rate limiter. A burst of 0 or less derives
+// the burst capacity from qps.
+func NewRateLimiter(qps, burst int) *RateLimiter {
         if qps <= 0 {
                 qps = defaultQPS
         }
         
+        r := &RateLimiter{burst: burst}
+        r.limiter = rate.NewLimiter(rate.Limit(qps), r.burstFor(qps))
+        return r
+}
+
+// burstFor returns the configured burst, or a tenth of qps when none was set
+func (r *RateLimiter) burstFor(qps int) int {
+        if r.burst > 0 {
+                return r.burst
+        }
+        
         // Allow some burst capacity
         burst := qps / 10
         if burst < 1 {
                 burst = 1
         }
-        
-        return &RateLimiter{
-                limiter: rate.NewLimiter(rate.Limit(qps), burst),
-        }
+        return burst
 }
 
 // Wait blocks until the rate limiter allows another request
@@ -44,16 +56,65 @@ func (r *RateLimiter) SetLimit(qps int) {
                 qps = defaultQPS
         }
         
-        burst := qps / 10
-        if burst < 1 {
-                burst = 1
-        }
-        
         r.limiter.SetLimit(rate.Limit(qps))
-        r.limiter.SetBurst(burst)
+        r.limiter.SetBurst(r.burstFor(qps))
 }
 
 // GetLimit returns the current rate limit
 func (r *RateLimiter) GetLimit() float64 {
         return float64(r.limiter.Limit())
 }
+
+// BandwidthLimiter holds queries back once the responses received exceed
+// a byte rate. Response sizes are only known afterwards, so each one is
+// charged as debt that later queries wait to pay off. A nil limiter is
+// unlimited.
+type BandwidthLimiter struct {
+        limiter *rate.Limiter
+}
+
+// NewBandwidthLimiter creates a limiter for bytesPerSecond, or returns nil
+// when it is 0 or less
+func NewBandwidthLimiter(bytesPerSecond int64) *BandwidthLimiter {
+        if bytesPerSecond <= 0 {
+                return nil
+        }
+        
+        // Allow up to a second's worth of bytes at once
+        burst := bytesPerSecond
+        if burst > math.MaxInt32 {
+                burst = math.MaxInt32
+        }
+        
+        return &BandwidthLimiter{
+                limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), int(burst)),
+        }
+}
+
+// Wait blocks until earlier responses have been paid for
+func (b *BandwidthLimiter) Wait(ctx context.Context) error {
+        if b == nil {
+                return nil
+        }
+        return b.limiter.Wait(ctx)
+}
+
+// Record charges a response of n bytes against the budget. A response
+// larger than the burst is charged in burst-sized pieces, since a single
+// reservation can't exceed it.
+func (b *BandwidthLimiter) Record(n int) {
+        if b == nil {
+                return
+        }
+        
+        now := time.Now()
+        burst := b.limiter.Burst()
+        for n > 0 {
+                chunk := n
+                if chunk > burst {
+                        chunk = burst
+                }
+                b.limiter.ReserveN(now, chunk)
+                n -= chunk
+        }
+}
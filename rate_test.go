@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// waitNow calls limiter.Wait with a deadline too short for any throttled
+// call to make, so it reports whether a token was available right away
+func waitNow(limiter *RateLimiter) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Millisecond)
+	defer cancel()
+	return limiter.Wait(ctx) == nil
+}
+
+// checkBurst asserts that burst calls pass straight away and the next one
+// is throttled
+func checkBurst(t *testing.T, limiter *RateLimiter, burst int) {
+	t.Helper()
+
+	for i := 0; i < burst; i++ {
+		if !waitNow(limiter) {
+			t.Fatalf("call %d of a burst of %d was throttled", i+1, burst)
+		}
+	}
+	if waitNow(limiter) {
+		t.Fatalf("call %d passed a burst of %d", burst+1, burst)
+	}
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	tests := []struct {
+		name       string
+		qps, burst int
+		newQPS     int
+		want       int
+		wantAfter  int
+	}{
+		// Without -burst the burst is a tenth of the rate
+		{name: "default", qps: 50, newQPS: 100, want: 5, wantAfter: 10},
+		// A configured burst survives rate changes
+		{name: "configured", qps: 20, burst: 3, newQPS: 40, want: 3, wantAfter: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewRateLimiter(tt.qps, tt.burst)
+			checkBurst(t, limiter, tt.want)
+
+			limiter.SetLimit(tt.newQPS)
+			if got := limiter.GetLimit(); got != float64(tt.newQPS) {
+				t.Fatalf("GetLimit() = %v after SetLimit(%d)", got, tt.newQPS)
+			}
+
+			// Let the bucket refill past the new burst, which caps it
+			time.Sleep(time.Duration(2*tt.wantAfter) * time.Second / time.Duration(tt.newQPS))
+			checkBurst(t, limiter, tt.wantAfter)
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// rawDumper writes the wire format of each response to its own file for
+// -raw-output, as ground truth when a record type is rendered oddly
+type rawDumper struct {
+	dir string
+}
+
+// newRawDumper creates dir if needed and returns a dumper writing into it
+func newRawDumper(dir string) (*rawDumper, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create raw output directory: %v", err)
+	}
+	return &rawDumper{dir: dir}, nil
+}
+
+// Dump packs the response of result into <domain>_<TYPE>.bin. A later
+// response for the same name and type replaces the earlier one.
+func (d *rawDumper) Dump(result *DNSResult) error {
+	if result.Response == nil {
+		return nil
+	}
+
+	data, err := result.Response.Pack()
+	if err != nil {
+		return fmt.Errorf("failed to pack response for %s: %v", result.Domain, err)
+	}
+
+	name := fmt.Sprintf("%s_%s.bin", rawFileName(result.Domain), dns.TypeToString[result.Type])
+	return os.WriteFile(filepath.Join(d.dir, name), data, 0644)
+}
+
+// rawFileName maps a domain to a safe file name component. Anything other
+// than letters, digits, dots, hyphens and underscores becomes an underscore.
+func rawFileName(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	mapped := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, domain)
+
+	// Keep a bare "." or ".." from naming a directory
+	if strings.Trim(mapped, ".") == "" {
+		return "root"
+	}
+	return mapped
+}
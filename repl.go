@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// replPrompt is printed before each line read in -repl mode
+const replPrompt = "dns> "
+
+// runREPL reads "domain [TYPE...]" lines from in and prints the answers
+// to out until :quit, end of input or cancellation. Each query goes
+// through the resolver pool and rate limiter like a normal run.
+func runREPL(ctx context.Context, in io.Reader, out io.Writer, config *Config,
+	resolverPool *ResolverPool, rateLimiter *RateLimiter, logger *Logger) error {
+
+	defaultTypes, err := parseQueryTypes(config.QueryTypes)
+	if err != nil {
+		return fmt.Errorf("invalid query types: %v", err)
+	}
+	defaultTypes = withoutTypes(defaultTypes, config.excludedTypes)
+
+	// Records are rendered exactly as the output handler would write them
+	formatter := &OutputHandler{normalize: config.Normalize, txtConcat: config.TXTConcat}
+
+	// Read on a separate goroutine so Ctrl-C ends the session while the
+	// prompt is waiting for input
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var history []string
+	fmt.Fprintln(out, "Type a domain and optional types, e.g. example.com A AAAA. :help lists commands.")
+
+	for {
+		fmt.Fprint(out, replPrompt)
+
+		var line string
+		select {
+		case l, ok := <-lines:
+			if !ok {
+				fmt.Fprintln(out)
+				return nil
+			}
+			line = strings.TrimSpace(l)
+		case <-ctx.Done():
+			fmt.Fprintln(out)
+			return nil
+		}
+
+		if line == "" {
+			continue
+		}
+
+		// !N repeats an earlier query from :history
+		if strings.HasPrefix(line, "!") {
+			n, err := strconv.Atoi(line[1:])
+			if err != nil || n < 1 || n > len(history) {
+				fmt.Fprintf(out, "No history entry %s\n", line[1:])
+				continue
+			}
+			line = history[n-1]
+			fmt.Fprintln(out, line)
+		}
+
+		switch line {
+		case ":quit", ":q", ":exit":
+			return nil
+		case ":help":
+			fmt.Fprintln(out, "  domain [TYPE...]  query domain for the given types (default: -t)")
+			fmt.Fprintln(out, "  :history          list earlier queries")
+			fmt.Fprintln(out, "  !N                repeat query N from :history")
+			fmt.Fprintln(out, "  :quit             leave the shell")
+			continue
+		case ":history":
+			for i, entry := range history {
+				fmt.Fprintf(out, "%4d  %s\n", i+1, entry)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, ":") {
+			fmt.Fprintf(out, "Unknown command %s, try :help\n", line)
+			continue
+		}
+
+		fields := strings.Fields(line)
+		domain := fields[0]
+		types := defaultTypes
+		if len(fields) > 1 {
+			types, err = parseQueryTypes(strings.Join(fields[1:], ","))
+			if err != nil {
+				fmt.Fprintf(out, "%v\n", err)
+				continue
+			}
+		}
+
+		history = append(history, line)
+
+		for _, qtype := range types {
+			if err := rateLimiter.Wait(ctx); err != nil {
+				return nil
+			}
+			result := performDNSQuery(ctx, domain, qtype, resolverPool.ForDomain(domain), config, logger)
+			printREPLResult(out, formatter, result)
+		}
+	}
+}
+
+// printREPLResult writes one result in a dig-like layout: a status line
+// followed by one answer per line
+func printREPLResult(out io.Writer, formatter *OutputHandler, result *DNSResult) {
+	qtype := dns.TypeToString[result.Type]
+
+	if result.Error != nil {
+		fmt.Fprintf(out, ";; %s %s: %v\n", result.Domain, qtype, result.Error)
+		return
+	}
+
+	fmt.Fprintf(out, ";; %s %s: %s from %s in %v\n", result.Domain, qtype,
+		dns.RcodeToString[result.Response.Rcode], result.Resolver, result.Latency.Round(time.Microsecond))
+	if result.EDE != nil {
+		fmt.Fprintf(out, ";; extended error %s\n", result.EDE)
+	}
+
+	for _, record := range formatter.extractRecords(result) {
+		fmt.Fprintf(out, "%s\t%d\t%s\t%s\n", record.Record, record.TTL, record.Type, record.Value)
+	}
+}
@@ -3,36 +3,125 @@ package main
 import (
         "bufio"
         "context"
+        "crypto/rand"
+        "crypto/tls"
+        "encoding/csv"
+        "encoding/hex"
+        "errors"
         "fmt"
-        "log"
-        "math/rand"
+        mathrand "math/rand"
         "net"
+        "net/http"
+        "net/url"
         "os"
+        "sort"
+        "strconv"
         "strings"
         "sync"
+        "sync/atomic"
+        "syscall"
         "time"
 
         "github.com/miekg/dns"
+        "golang.org/x/net/proxy"
+)
+
+const (
+        // maxResolverTestWorkers bounds the number of resolvers tested in parallel at startup
+        maxResolverTestWorkers = 64
+        // maxConsecutiveRefusals takes a resolver out of rotation after this many refused connections in a row
+        maxConsecutiveRefusals = 3
+        // refusedBurst REFUSED answers in a row put a resolver in -refused-cooldown
+        refusedBurst = 5
+        // resolvConfPath is read for -system-resolvers
+        resolvConfPath = "/etc/resolv.conf"
+)
+
+// Transports selectable with a scheme prefix on the resolver address
+const (
+        transportUDP   = "udp"
+        transportTCP   = "tcp"
+        transportTLS   = "tls"
+        transportHTTPS = "https"
 )
 
 // DNSResolver represents a single DNS resolver
 type DNSResolver struct {
-        Address string
-        Client  *dns.Client
+        Address   string
+        Transport string
+        Client    *dns.Client
+        dialer    proxy.ContextDialer
+        
+        // httpClient carries queries for DNS over HTTPS resolvers
+        httpClient *http.Client
+        
+        // conns holds idle TCP and TLS connections for reuse
+        conns connPool
+        
+        // bandwidth is shared by the whole pool for -max-bps, nil when unlimited
+        bandwidth *BandwidthLimiter
+        
+        // queryLog records every exchange for -query-log, nil when disabled
+        queryLog *queryLog
+        
+        // inflight holds a slot per outstanding query for -per-resolver-conc,
+        // nil when unlimited
+        inflight chan struct{}
+        
+        // refusedCooldown is how long a burst of REFUSED answers takes the
+        // resolver out of rotation, 0 to never
+        refusedCooldown time.Duration
+        
+        // DNS cookie state, as hex strings (RFC 7873)
+        clientCookie string
+        serverCookie string
+        cookieMutex  sync.Mutex
+        
+        // Health tracking, updated atomically
+        queries             int64
+        failures            int64
+        consecutiveRefusals int64
+        consecutiveRefused  int64
+        cooldownUntil       int64
+        cooldowns           int64
+        latencyTotal        int64
+        bytesReceived       int64
+}
+
+// ResolverStat summarizes how much traffic one resolver carried and how
+// reliably it answered
+type ResolverStat struct {
+        Address     string
+        Transport   string
+        Queries     int64
+        Successes   int64
+        Errors      int64
+        MeanLatency time.Duration
 }
 
 // ResolverPool manages a pool of DNS resolvers
 type ResolverPool struct {
-        resolvers []*DNSResolver
-        mutex     sync.RWMutex
-        index     int
-        logger    *log.Logger
+        resolvers   []*DNSResolver
+        mutex       sync.RWMutex
+        index       int
+        proxyDialer proxy.ContextDialer
+        bandwidth   *BandwidthLimiter
+        logger      *Logger
+        
+        // variants caches resolvers re-created on another transport for
+        // -transport-order, keyed by transport and base address
+        variants sync.Map
+        
+        // routes send names under -ns-map suffixes to their own pools
+        routes []*resolverRoute
 }
 
-// NewResolverPool creates a new resolver pool
-func NewResolverPool(config *Config, logger *log.Logger) *ResolverPool {
+// NewResolverPool creates a new resolver pool.
+// Resolver testing stops early if ctx is cancelled.
+func NewResolverPool(ctx context.Context, config *Config, logger *Logger) (*ResolverPool, error) {
         pool := &ResolverPool{
                 resolvers: make([]*DNSResolver, 0),
+                bandwidth: NewBandwidthLimiter(config.maxBytesPerSecond),
                 logger:    logger,
         }
         
@@ -54,65 +143,303 @@ func NewResolverPool(config *Config, logger *log.Logger) *ResolverPool {
         if config.ResolversFile != "" {
                 fileAddresses, err := loadResolversFromFile(config.ResolversFile)
                 if err != nil {
-                        logger.Printf("Error loading resolvers from file: %v", err)
+                        logger.Errorf("Error loading resolvers from file: %v", err)
                 } else {
                         resolverAddresses = append(resolverAddresses, fileAddresses...)
                 }
         }
         
-        // Use defaults if no resolvers specified
+        // Add the nameservers the operating system is configured with
+        if config.SystemResolvers {
+                systemAddresses, err := loadSystemResolvers(resolvConfPath)
+                if err != nil {
+                        logger.Warnf("Cannot use system resolvers: %v", err)
+                } else {
+                        resolverAddresses = append(resolverAddresses, systemAddresses...)
+                        logger.Printf("Using %d system resolvers from %s", len(systemAddresses), resolvConfPath)
+                }
+        }
+        
+        // Add the curated DoH endpoints if requested
+        if config.UseDoHDefaults {
+                resolverAddresses = append(resolverAddresses, GetDefaultDoHResolvers()...)
+                logger.Println("Using default DoH resolvers")
+        }
+        
+        // Use defaults if no resolvers specified, unless the run must not
+        // send anything to public DNS
+        if len(resolverAddresses) == 0 && config.NoDefaultResolvers {
+                return nil, fmt.Errorf("no resolvers configured and -no-default-resolvers is set; give them with -r, -rf or -system-resolvers")
+        }
         if len(resolverAddresses) == 0 {
                 resolverAddresses = GetDefaultResolvers()
                 logger.Println("Using default DNS resolvers")
         }
         
+        // The same server may come from several sources or be written
+        // differently, which would give it extra round-robin weight
+        resolverAddresses, duplicates := dedupResolverAddresses(resolverAddresses, config)
+        if duplicates > 0 {
+                logger.Printf("Removed %d duplicate resolver addresses", duplicates)
+        }
+        
+        // Split-horizon routes are created with the main pool below, but
+        // their addresses are checked against the proxy like the rest
+        var routes []nsMapEntry
+        checkAddresses := resolverAddresses
+        if config.NSMapFile != "" {
+                entries, err := loadNameserverMap(config.NSMapFile)
+                if err != nil {
+                        return nil, err
+                }
+                routes = entries
+                for _, entry := range entries {
+                        checkAddresses = append(checkAddresses, entry.addresses...)
+                }
+        }
+        
+        // Route TCP-based transports through the proxy if one is configured
+        if config.Proxy != "" {
+                dialer, err := newProxyDialer(config.Proxy)
+                if err != nil {
+                        return nil, err
+                }
+                pool.proxyDialer = dialer
+                
+                for _, transport := range config.transportOrder {
+                        if transport == transportUDP {
+                                return nil, fmt.Errorf("-transport-order includes udp, which cannot be sent through a SOCKS5 proxy")
+                        }
+                }
+                
+                for _, addr := range checkAddresses {
+                        if transport, _ := splitTransport(addr); transport == transportUDP && len(config.transportOrder) == 0 {
+                                return nil, fmt.Errorf("resolver %s uses UDP, which cannot be sent through a SOCKS5 proxy; use tcp://, tls:// or https:// addresses with -proxy", addr)
+                        }
+                }
+        }
+        
         // Create resolver instances
-        for _, addr := range resolverAddresses {
-                if resolver := pool.createResolver(addr, config.Timeout); resolver != nil {
-                        pool.resolvers = append(pool.resolvers, resolver)
+        pool.resolvers = pool.createResolvers(ctx, resolverAddresses, config)
+        if err := ctx.Err(); err != nil {
+                return nil, err
+        }
+        rejected := len(resolverAddresses) - len(pool.resolvers)
+        if len(pool.resolvers) == 0 && config.NoDefaultResolvers {
+                return nil, fmt.Errorf("none of the %d configured resolvers passed the connectivity test", len(resolverAddresses))
+        }
+        
+        pool.addRoutes(ctx, routes, config)
+        if err := ctx.Err(); err != nil {
+                return nil, err
+        }
+        
+        if config.ShuffleResolvers {
+                mathrand.Shuffle(len(pool.resolvers), func(i, j int) {
+                        pool.resolvers[i], pool.resolvers[j] = pool.resolvers[j], pool.resolvers[i]
+                })
+        }
+        
+        if config.SkipResolverTest {
+                logger.Println("Resolver connectivity test skipped")
+        }
+        logger.Printf("Initialized resolver pool: %d added, %d rejected", len(pool.resolvers), rejected)
+        return pool, nil
+}
+
+// createResolvers creates and tests resolvers concurrently using a bounded
+// number of goroutines. The returned slice keeps the input order.
+func (p *ResolverPool) createResolvers(ctx context.Context, addresses []string, config *Config) []*DNSResolver {
+        created := make([]*DNSResolver, len(addresses))
+        
+        workers := maxResolverTestWorkers
+        if len(addresses) < workers {
+                workers = len(addresses)
+        }
+        
+        indexChan := make(chan int)
+        var wg sync.WaitGroup
+        
+        for i := 0; i < workers; i++ {
+                wg.Add(1)
+                go func() {
+                        defer wg.Done()
+                        for idx := range indexChan {
+                                created[idx] = p.createTestedResolver(ctx, addresses[idx], config)
+                        }
+                }()
+        }
+        
+dispatch:
+        for idx := range addresses {
+                select {
+                case indexChan <- idx:
+                case <-ctx.Done():
+                        break dispatch
                 }
         }
+        close(indexChan)
+        wg.Wait()
         
-        logger.Printf("Initialized resolver pool with %d resolvers", len(pool.resolvers))
-        return pool
+        // Drop rejected resolvers while preserving order
+        resolvers := make([]*DNSResolver, 0, len(created))
+        for _, resolver := range created {
+                if resolver != nil {
+                        resolvers = append(resolvers, resolver)
+                }
+        }
+        
+        return resolvers
 }
 
-// createResolver creates a new DNS resolver with proper address formatting
-func (p *ResolverPool) createResolver(address string, timeout int) *DNSResolver {
-        // Ensure address has port
+// createResolver creates a new DNS resolver with proper address formatting.
+// The address may carry a tcp://, tls:// or https:// prefix to select the
+// transport.
+func (p *ResolverPool) createResolver(address string, config *Config) *DNSResolver {
+        transport, address := splitTransport(address)
+        timeout := time.Duration(config.Timeout) * time.Second
+        
+        // DoH resolvers are addressed by URL rather than host and port
+        if transport == transportHTTPS {
+                endpoint, err := parseDoHAddress(address)
+                if err != nil {
+                        p.logger.Warnf("Invalid DoH resolver address %s: %v", address, err)
+                        return nil
+                }
+                
+                resolver := &DNSResolver{
+                        Address:    endpoint,
+                        Transport:  transport,
+                        Client:     &dns.Client{Timeout: timeout},
+                        httpClient: newDoHClient(timeout, p.proxyDialer),
+                        bandwidth:  p.bandwidth,
+                        inflight:   newInflightLimit(config.PerResolverConc),
+                        queryLog:   config.queryLog,
+                        
+                        refusedCooldown: config.RefusedCooldown,
+                }
+                
+                return resolver
+        }
+        
+        var clientNet string
+        switch transport {
+        case transportUDP:
+                clientNet = "udp"
+        case transportTCP:
+                clientNet = "tcp"
+        case transportTLS:
+                clientNet = "tcp-tls"
+        default:
+                p.logger.Warnf("Unsupported resolver transport %q: %s", transport, address)
+                return nil
+        }
+        
+        // Ensure address has port. An explicit port always wins, then -port,
+        // then the transport's standard port.
         if !strings.Contains(address, ":") {
-                address = address + ":53"
+                address = address + ":" + defaultResolverPort(transport, config)
         }
         
         // Validate address
-        if _, _, err := net.SplitHostPort(address); err != nil {
-                p.logger.Printf("Invalid resolver address: %s", address)
+        host, _, err := net.SplitHostPort(address)
+        if err != nil {
+                p.logger.Warnf("Invalid resolver address: %s", address)
                 return nil
         }
         
         client := &dns.Client{
-                Timeout: time.Duration(timeout) * time.Second,
-                Net:     "udp",
+                Timeout: timeout,
+                Net:     clientNet,
+        }
+        if transport == transportTLS {
+                client.TLSConfig = &tls.Config{ServerName: host}
         }
         
-        // Test the resolver
-        if !p.testResolver(address, client) {
-                p.logger.Printf("Resolver test failed: %s", address)
-                return nil
+        resolver := &DNSResolver{
+                Address:   address,
+                Transport: transport,
+                Client:    client,
+                bandwidth: p.bandwidth,
+                inflight:  newInflightLimit(config.PerResolverConc),
+                queryLog:  config.queryLog,
+                
+                refusedCooldown: config.RefusedCooldown,
+        }
+        if transport != transportUDP {
+                resolver.dialer = p.proxyDialer
         }
         
-        return &DNSResolver{
-                Address: address,
-                Client:  client,
+        return resolver
+}
+
+// Variant returns resolver re-created on the given transport, reusing its
+// host. TLS and HTTPS variants use their standard ports, and DoH resolvers
+// have no variants since they are addressed by URL.
+func (p *ResolverPool) Variant(resolver *DNSResolver, transport string, config *Config) *DNSResolver {
+        if transport == resolver.Transport || resolver.Transport == transportHTTPS {
+                return resolver
         }
+        
+        key := transport + "://" + resolver.Address
+        if variant, ok := p.variants.Load(key); ok {
+                return variant.(*DNSResolver)
+        }
+        
+        host, port, err := net.SplitHostPort(resolver.Address)
+        if err != nil {
+                return resolver
+        }
+        
+        address := net.JoinHostPort(host, port)
+        switch transport {
+        case transportTLS:
+                address = net.JoinHostPort(host, "853")
+        case transportHTTPS:
+                address = net.JoinHostPort(host, "443")
+        }
+        
+        variant := p.createResolver(transport+"://"+address, config)
+        if variant == nil {
+                return resolver
+        }
+        
+        // Another transport to the same server counts toward the same cap
+        variant.inflight = resolver.inflight
+        
+        actual, _ := p.variants.LoadOrStore(key, variant)
+        return actual.(*DNSResolver)
 }
 
-// testResolver performs a basic connectivity test
-func (p *ResolverPool) testResolver(address string, client *dns.Client) bool {
+// createTestedResolver creates a resolver and, unless the user opted out,
+// rejects it when it fails the connectivity test
+func (p *ResolverPool) createTestedResolver(ctx context.Context, address string, config *Config) *DNSResolver {
+        resolver := p.createResolver(address, config)
+        if resolver == nil || config.SkipResolverTest {
+                return resolver
+        }
+        
+        if !p.testResolver(ctx, resolver, config) {
+                // Don't blame the resolver for an interrupted startup
+                if ctx.Err() == nil {
+                        p.logger.Warnf("Resolver test failed: %s (probe %s)", resolver.Address, config.TestDomain)
+                }
+                return nil
+        }
+        
+        return resolver
+}
+
+// testResolver performs a basic connectivity test by resolving the test
+// domain, bounded by the resolver test timeout rather than -timeout
+func (p *ResolverPool) testResolver(ctx context.Context, resolver *DNSResolver, config *Config) bool {
         msg := &dns.Msg{}
-        msg.SetQuestion(dns.Fqdn("google.com"), dns.TypeA)
+        msg.SetQuestion(dns.Fqdn(config.TestDomain), dns.TypeA)
+        
+        testCtx, cancel := context.WithTimeout(ctx, time.Duration(config.ResolverTestTimeout)*time.Second)
+        defer cancel()
         
-        _, _, err := client.Exchange(msg, address)
+        _, _, err := resolver.ExchangeContext(testCtx, msg, resolver.Address)
         return err == nil
 }
 
@@ -125,6 +452,16 @@ func (p *ResolverPool) GetResolver() *DNSResolver {
                 return nil
         }
         
+        // Skip resolvers that keep refusing connections
+        for i := 0; i < len(p.resolvers); i++ {
+                resolver := p.resolvers[p.index]
+                p.index = (p.index + 1) % len(p.resolvers)
+                if resolver.Healthy() {
+                        return resolver
+                }
+        }
+        
+        // Every resolver is unhealthy, keep rotating rather than failing outright
         resolver := p.resolvers[p.index]
         p.index = (p.index + 1) % len(p.resolvers)
         
@@ -140,10 +477,180 @@ func (p *ResolverPool) GetRandomResolver() *DNSResolver {
                 return nil
         }
         
-        index := rand.Intn(len(p.resolvers))
+        index := mathrand.Intn(len(p.resolvers))
         return p.resolvers[index]
 }
 
+// ConnectionCounts returns how many TCP and TLS connections were opened and
+// how many queries reused an idle one, across all resolvers and variants
+func (p *ResolverPool) ConnectionCounts() (opened, reused int64) {
+        add := func(resolver *DNSResolver) {
+                opened += atomic.LoadInt64(&resolver.conns.opened)
+                reused += atomic.LoadInt64(&resolver.conns.reused)
+        }
+        
+        p.mutex.RLock()
+        for _, resolver := range p.resolvers {
+                add(resolver)
+        }
+        p.mutex.RUnlock()
+        
+        p.variants.Range(func(_, variant interface{}) bool {
+                add(variant.(*DNSResolver))
+                return true
+        })
+        
+        for _, route := range p.routes {
+                routeOpened, routeReused := route.pool.ConnectionCounts()
+                opened += routeOpened
+                reused += routeReused
+        }
+        
+        return opened, reused
+}
+
+// BytesReceived returns the total size of the responses received by all
+// resolvers, variants and routes
+func (p *ResolverPool) BytesReceived() int64 {
+        var total int64
+        
+        p.mutex.RLock()
+        for _, resolver := range p.resolvers {
+                total += atomic.LoadInt64(&resolver.bytesReceived)
+        }
+        p.mutex.RUnlock()
+        
+        p.variants.Range(func(_, variant interface{}) bool {
+                total += atomic.LoadInt64(&variant.(*DNSResolver).bytesReceived)
+                return true
+        })
+        
+        for _, route := range p.routes {
+                total += route.pool.BytesReceived()
+        }
+        
+        return total
+}
+
+// Cooldowns returns how many times a burst of REFUSED answers took a
+// resolver, variant or route resolver out of rotation
+func (p *ResolverPool) Cooldowns() int64 {
+        var total int64
+        
+        p.mutex.RLock()
+        for _, resolver := range p.resolvers {
+                total += atomic.LoadInt64(&resolver.cooldowns)
+        }
+        p.mutex.RUnlock()
+        
+        p.variants.Range(func(_, variant interface{}) bool {
+                total += atomic.LoadInt64(&variant.(*DNSResolver).cooldowns)
+                return true
+        })
+        
+        for _, route := range p.routes {
+                total += route.pool.Cooldowns()
+        }
+        
+        return total
+}
+
+// ResolverStats returns the counters of every resolver that was queried,
+// including transport variants, busiest first
+func (p *ResolverPool) ResolverStats() []ResolverStat {
+        var stats []ResolverStat
+        add := func(resolver *DNSResolver) {
+                if stat := resolver.Stat(); stat.Queries > 0 {
+                        stats = append(stats, stat)
+                }
+        }
+        
+        p.mutex.RLock()
+        for _, resolver := range p.resolvers {
+                add(resolver)
+        }
+        p.mutex.RUnlock()
+        
+        p.variants.Range(func(_, variant interface{}) bool {
+                add(variant.(*DNSResolver))
+                return true
+        })
+        
+        for _, route := range p.routes {
+                stats = append(stats, route.pool.ResolverStats()...)
+        }
+        
+        sort.SliceStable(stats, func(i, j int) bool {
+                return stats[i].Queries > stats[j].Queries
+        })
+        
+        return stats
+}
+
+// PrintResolverStats logs a table of per-resolver counters
+func (p *ResolverPool) PrintResolverStats(stats []ResolverStat) {
+        p.logger.Println("=== Resolver Statistics ===")
+        p.logger.Printf("%-40s %10s %10s %10s %12s", "Resolver", "Queries", "Successes", "Errors", "Mean latency")
+        for _, stat := range stats {
+                p.logger.Printf("%-40s %10d %10d %10d %12s", resolverLabel(stat),
+                        stat.Queries, stat.Successes, stat.Errors, stat.MeanLatency.Round(time.Microsecond))
+        }
+}
+
+// WriteResolverStats writes per-resolver counters to a CSV file
+func WriteResolverStats(filename string, stats []ResolverStat) error {
+        file, err := os.Create(filename)
+        if err != nil {
+                return fmt.Errorf("failed to create resolver stats file: %v", err)
+        }
+        defer file.Close()
+        
+        writer := csv.NewWriter(file)
+        writer.Write([]string{"Resolver", "Transport", "Queries", "Successes", "Errors", "MeanLatencyMs"})
+        for _, stat := range stats {
+                writer.Write([]string{
+                        stat.Address,
+                        stat.Transport,
+                        strconv.FormatInt(stat.Queries, 10),
+                        strconv.FormatInt(stat.Successes, 10),
+                        strconv.FormatInt(stat.Errors, 10),
+                        strconv.FormatFloat(float64(stat.MeanLatency)/float64(time.Millisecond), 'f', 3, 64),
+                })
+        }
+        writer.Flush()
+        
+        if err := writer.Error(); err != nil {
+                return err
+        }
+        return file.Close()
+}
+
+// resolverLabel returns the address of a resolver with its transport scheme
+// for anything but plain UDP, as it would be given to -r
+func resolverLabel(stat ResolverStat) string {
+        if stat.Transport == transportUDP || stat.Transport == transportHTTPS {
+                return stat.Address
+        }
+        return stat.Transport + "://" + stat.Address
+}
+
+// Addresses returns the resolvers in rotation, with their transport
+// prefix, followed by those of the -ns-map routes
+func (p *ResolverPool) Addresses() []string {
+        p.mutex.RLock()
+        addresses := make([]string, 0, len(p.resolvers))
+        for _, resolver := range p.resolvers {
+                addresses = append(addresses, resolverLabel(resolver.Stat()))
+        }
+        p.mutex.RUnlock()
+        
+        for _, route := range p.routes {
+                addresses = append(addresses, route.pool.Addresses()...)
+        }
+        
+        return addresses
+}
+
 // GetResolverCount returns the number of available resolvers
 func (p *ResolverPool) GetResolverCount() int {
         p.mutex.RLock()
@@ -154,16 +661,404 @@ func (p *ResolverPool) GetResolverCount() int {
 
 // Close cleans up the resolver pool
 func (p *ResolverPool) Close() {
+        p.closeConnections()
+        p.logger.Println("Resolver pool closed")
+}
+
+// closeConnections closes the idle connections of every resolver, variant
+// and route
+func (p *ResolverPool) closeConnections() {
         p.mutex.Lock()
         defer p.mutex.Unlock()
         
+        for _, route := range p.routes {
+                route.pool.closeConnections()
+        }
+        for _, resolver := range p.resolvers {
+                resolver.conns.close()
+        }
+        p.variants.Range(func(_, variant interface{}) bool {
+                variant.(*DNSResolver).conns.close()
+                return true
+        })
+        
         p.resolvers = nil
-        p.logger.Println("Resolver pool closed")
 }
 
 // ExchangeContext performs a DNS query with context support
 func (r *DNSResolver) ExchangeContext(ctx context.Context, msg *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
-        return r.Client.ExchangeContext(ctx, msg, address)
+        // Hold the query back while responses are over the -max-bps budget
+        if err := r.bandwidth.Wait(ctx); err != nil {
+                return nil, 0, err
+        }
+        
+        response, rtt, err := r.exchange(ctx, msg, address)
+        r.queryLog.Record(r, msg, response, rtt, err)
+        if response != nil {
+                size := response.Len()
+                atomic.AddInt64(&r.bytesReceived, int64(size))
+                r.bandwidth.Record(size)
+        }
+        
+        return response, rtt, err
+}
+
+// exchange sends msg over the resolver's transport
+func (r *DNSResolver) exchange(ctx context.Context, msg *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+        if r.Transport == transportHTTPS {
+                return r.exchangeDoH(ctx, msg, address)
+        }
+        
+        // TCP and TLS connections are kept open between queries
+        if r.Transport != transportUDP {
+                return r.exchangeTCP(ctx, msg, address)
+        }
+        
+        conn, err := r.dial(ctx, address)
+        if err != nil {
+                return nil, 0, err
+        }
+        defer conn.Close()
+        
+        return r.exchangeConn(ctx, msg, conn)
+}
+
+// dial opens a connection to address, through the proxy if one is set
+func (r *DNSResolver) dial(ctx context.Context, address string) (*dns.Conn, error) {
+        if r.dialer != nil {
+                return r.dialProxy(ctx, address)
+        }
+        return r.Client.DialContext(ctx, address)
+}
+
+// exchangeConn performs one exchange on an open connection
+func (r *DNSResolver) exchangeConn(ctx context.Context, msg *dns.Msg, conn *dns.Conn) (*dns.Msg, time.Duration, error) {
+        // The client only honours deadlines, so close the connection to
+        // abort a read in progress when ctx is cancelled. The watcher is
+        // stopped before returning so a reusable connection is left open.
+        done := make(chan struct{})
+        stopped := make(chan struct{})
+        go func() {
+                defer close(stopped)
+                select {
+                case <-ctx.Done():
+                        conn.Close()
+                case <-done:
+                }
+        }()
+        
+        response, rtt, err := r.Client.ExchangeWithConnContext(ctx, msg, conn)
+        close(done)
+        <-stopped
+        
+        // Report the deadline rather than the closed connection it caused,
+        // so the failure is recognised as a timeout
+        if err != nil && ctx.Err() != nil {
+                err = ctx.Err()
+        }
+        
+        return response, rtt, err
+}
+
+// dialProxy opens a connection to address through the SOCKS5 proxy,
+// layering TLS on top for DNS over TLS
+func (r *DNSResolver) dialProxy(ctx context.Context, address string) (*dns.Conn, error) {
+        dialCtx := ctx
+        if r.Client.Timeout > 0 {
+                var cancel context.CancelFunc
+                dialCtx, cancel = context.WithTimeout(ctx, r.Client.Timeout)
+                defer cancel()
+        }
+        
+        raw, err := r.dialer.DialContext(dialCtx, "tcp", address)
+        if err != nil {
+                return nil, fmt.Errorf("proxy dial failed: %v", err)
+        }
+        
+        if r.Transport == transportTLS {
+                tlsConn := tls.Client(raw, r.Client.TLSConfig)
+                if err := tlsConn.HandshakeContext(dialCtx); err != nil {
+                        raw.Close()
+                        return nil, fmt.Errorf("TLS handshake failed: %v", err)
+                }
+                return &dns.Conn{Conn: tlsConn}, nil
+        }
+        
+        return &dns.Conn{Conn: raw}, nil
+}
+
+// ReportSuccess records a query that got a response and its round-trip time
+func (r *DNSResolver) ReportSuccess(rtt time.Duration) {
+        atomic.AddInt64(&r.queries, 1)
+        atomic.AddInt64(&r.latencyTotal, int64(rtt))
+        atomic.StoreInt64(&r.consecutiveRefusals, 0)
+}
+
+// ReportFailure records a query that failed at the transport level
+func (r *DNSResolver) ReportFailure(err error) {
+        atomic.AddInt64(&r.queries, 1)
+        atomic.AddInt64(&r.failures, 1)
+        if isConnectionRefused(err) {
+                atomic.AddInt64(&r.consecutiveRefusals, 1)
+        }
+}
+
+// ReportRcode records the rcode of a response. Resolvers that rate limit
+// often answer REFUSED, so refusedBurst of them in a row start a cooldown
+// during which the resolver is out of rotation. It reports whether this
+// response started one.
+func (r *DNSResolver) ReportRcode(rcode int) bool {
+        if rcode != dns.RcodeRefused {
+                atomic.StoreInt64(&r.consecutiveRefused, 0)
+                return false
+        }
+        
+        if r.refusedCooldown <= 0 || atomic.AddInt64(&r.consecutiveRefused, 1) < refusedBurst {
+                return false
+        }
+        
+        atomic.StoreInt64(&r.consecutiveRefused, 0)
+        atomic.StoreInt64(&r.cooldownUntil, time.Now().Add(r.refusedCooldown).UnixNano())
+        atomic.AddInt64(&r.cooldowns, 1)
+        return true
+}
+
+// Stat returns a snapshot of the resolver's counters
+func (r *DNSResolver) Stat() ResolverStat {
+        queries := atomic.LoadInt64(&r.queries)
+        failures := atomic.LoadInt64(&r.failures)
+        
+        stat := ResolverStat{
+                Address:   r.Address,
+                Transport: r.Transport,
+                Queries:   queries,
+                Successes: queries - failures,
+                Errors:    failures,
+        }
+        if stat.Successes > 0 {
+                stat.MeanLatency = time.Duration(atomic.LoadInt64(&r.latencyTotal) / stat.Successes)
+        }
+        
+        return stat
+}
+
+// Healthy reports whether the resolver should stay in rotation: it is not
+// refusing connections and not cooling down after a burst of REFUSED
+func (r *DNSResolver) Healthy() bool {
+        if atomic.LoadInt64(&r.consecutiveRefusals) >= maxConsecutiveRefusals {
+                return false
+        }
+        return time.Now().UnixNano() >= atomic.LoadInt64(&r.cooldownUntil)
+}
+
+// isConnectionRefused reports whether err means the resolver port is closed
+func isConnectionRefused(err error) bool {
+        if errors.Is(err, syscall.ECONNREFUSED) {
+                return true
+        }
+        return err != nil && strings.Contains(err.Error(), "connection refused")
+}
+
+// isTimeout reports whether err is a network timeout
+func isTimeout(err error) bool {
+        var netErr net.Error
+        return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// AttachCookie adds an EDNS0 cookie option to msg carrying this resolver's
+// client cookie and the last server cookie it returned
+func (r *DNSResolver) AttachCookie(msg *dns.Msg) {
+        r.cookieMutex.Lock()
+        if r.clientCookie == "" {
+                buf := make([]byte, 8)
+                rand.Read(buf)
+                r.clientCookie = hex.EncodeToString(buf)
+        }
+        cookie := r.clientCookie + r.serverCookie
+        r.cookieMutex.Unlock()
+        
+        opt := ednsOPT(msg)
+        opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+                Code:   dns.EDNS0COOKIE,
+                Cookie: cookie,
+        })
+}
+
+// StoreCookie remembers the server cookie from a response that echoes our
+// client cookie, so it can be presented on subsequent queries
+func (r *DNSResolver) StoreCookie(response *dns.Msg) {
+        opt := response.IsEdns0()
+        if opt == nil {
+                return
+        }
+        
+        for _, option := range opt.Option {
+                cookie, ok := option.(*dns.EDNS0_COOKIE)
+                if !ok {
+                        continue
+                }
+                
+                // 8 byte client cookie followed by an 8 to 32 byte server cookie
+                if len(cookie.Cookie) < 32 || len(cookie.Cookie) > 80 {
+                        continue
+                }
+                
+                r.cookieMutex.Lock()
+                if strings.EqualFold(cookie.Cookie[:16], r.clientCookie) {
+                        r.serverCookie = cookie.Cookie[16:]
+                }
+                r.cookieMutex.Unlock()
+        }
+}
+
+// Acquire waits for a free -per-resolver-conc slot, returning the function
+// that releases it. Without a cap it returns at once.
+func (r *DNSResolver) Acquire(ctx context.Context) (func(), error) {
+        if r.inflight == nil {
+                return func() {}, nil
+        }
+        
+        select {
+        case r.inflight <- struct{}{}:
+                return func() { <-r.inflight }, nil
+        case <-ctx.Done():
+                return nil, ctx.Err()
+        }
+}
+
+// newInflightLimit returns a semaphore of n slots, or nil for no limit
+func newInflightLimit(n int) chan struct{} {
+        if n <= 0 {
+                return nil
+        }
+        return make(chan struct{}, n)
+}
+
+// splitTransport separates an optional scheme from a resolver address,
+// defaulting to UDP for bare addresses
+func splitTransport(address string) (string, string) {
+        if idx := strings.Index(address, "://"); idx != -1 {
+                return strings.ToLower(address[:idx]), address[idx+3:]
+        }
+        return transportUDP, address
+}
+
+// newProxyDialer creates a dialer for a socks5:// proxy URL
+func newProxyDialer(proxyURL string) (proxy.ContextDialer, error) {
+        u, err := url.Parse(proxyURL)
+        if err != nil {
+                return nil, fmt.Errorf("invalid proxy URL: %v", err)
+        }
+        
+        if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+                return nil, fmt.Errorf("unsupported proxy scheme %q, only socks5 is supported", u.Scheme)
+        }
+        
+        dialer, err := proxy.FromURL(u, proxy.Direct)
+        if err != nil {
+                return nil, fmt.Errorf("invalid proxy URL: %v", err)
+        }
+        
+        contextDialer, ok := dialer.(proxy.ContextDialer)
+        if !ok {
+                return nil, fmt.Errorf("proxy dialer does not support cancellation")
+        }
+        
+        return contextDialer, nil
+}
+
+// loadSystemResolvers returns the nameservers listed in a resolv.conf file
+// as host:port addresses. Systems without one, such as Windows, get an
+// error and fall back to the other resolver sources.
+func loadSystemResolvers(path string) ([]string, error) {
+        clientConfig, err := dns.ClientConfigFromFile(path)
+        if err != nil {
+                return nil, err
+        }
+        if len(clientConfig.Servers) == 0 {
+                return nil, fmt.Errorf("no nameservers in %s", path)
+        }
+        
+        var resolvers []string
+        for _, server := range clientConfig.Servers {
+                resolvers = append(resolvers, net.JoinHostPort(server, clientConfig.Port))
+        }
+        
+        return resolvers, nil
+}
+
+// defaultResolverPort returns the port used for a resolver address without
+// one: -port when set, otherwise the transport's standard port
+func defaultResolverPort(transport string, config *Config) string {
+        if config.Port > 0 {
+                return strconv.Itoa(config.Port)
+        }
+        if transport == transportTLS {
+                return "853"
+        }
+        return "53"
+}
+
+// normalizeResolverAddress returns the canonical form of a resolver address
+// so the same server given two ways is recognised: the default port is
+// added, names are lowercased, IP addresses are canonicalized (bare IPv6
+// addresses gain brackets) and a udp:// prefix is dropped. DoH URLs get
+// the default path and lose an explicit :443. Addresses that don't parse
+// are returned unchanged for createResolver to reject.
+func normalizeResolverAddress(address string, config *Config) string {
+        transport, rest := splitTransport(strings.TrimSpace(address))
+        
+        if transport == transportHTTPS {
+                endpoint, err := parseDoHAddress(rest)
+                if err != nil {
+                        return address
+                }
+                u, err := url.Parse(endpoint)
+                if err != nil {
+                        return address
+                }
+                u.Host = strings.ToLower(strings.TrimSuffix(u.Host, ":443"))
+                return u.String()
+        }
+        
+        host, port := rest, defaultResolverPort(transport, config)
+        if ip := net.ParseIP(strings.Trim(rest, "[]")); ip != nil {
+                host = ip.String()
+        } else if strings.Contains(rest, ":") {
+                var err error
+                host, port, err = net.SplitHostPort(rest)
+                if err != nil {
+                        return address
+                }
+                if ip := net.ParseIP(host); ip != nil {
+                        host = ip.String()
+                }
+        }
+        
+        normalized := net.JoinHostPort(strings.ToLower(strings.TrimSuffix(host, ".")), port)
+        if transport == transportUDP {
+                return normalized
+        }
+        return transport + "://" + normalized
+}
+
+// dedupResolverAddresses normalizes addresses and drops repeats, keeping
+// the first occurrence. It returns the unique addresses and how many were
+// removed.
+func dedupResolverAddresses(addresses []string, config *Config) ([]string, int) {
+        seen := make(map[string]bool, len(addresses))
+        unique := make([]string, 0, len(addresses))
+        
+        for _, address := range addresses {
+                normalized := normalizeResolverAddress(address, config)
+                if seen[normalized] {
+                        continue
+                }
+                seen[normalized] = true
+                unique = append(unique, normalized)
+        }
+        
+        return unique, len(addresses) - len(unique)
 }
 
 // loadResolversFromFile loads resolver addresses from a file
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testLogger returns a logger that discards everything
+func testLogger() *Logger {
+	return newLogger(log.New(io.Discard, "", 0), levelError, false)
+}
+
+// refusingAddress returns a local TCP address with nothing listening on it,
+// so connections to it are refused
+func refusingAddress(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	return address
+}
+
+// startTestServer runs a UDP DNS server answering every A query with
+// 192.0.2.1 and returns its address
+func startTestServer(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	server := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			reply := &dns.Msg{}
+			reply.SetReply(req)
+			rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 192.0.2.1")
+			reply.Answer = append(reply.Answer, rr)
+			w.WriteMsg(reply)
+		}),
+	}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	return conn.LocalAddr().String()
+}
+
+func TestRefusingResolverExcluded(t *testing.T) {
+	config := &Config{Timeout: 2, Retries: 1}
+	pool := &ResolverPool{logger: testLogger()}
+
+	refusing := pool.createResolver("tcp://"+refusingAddress(t), config)
+	working := pool.createResolver(startTestServer(t), config)
+	pool.resolvers = []*DNSResolver{refusing, working}
+
+	// Every query still gets an answer, moving past the refusing resolver
+	// without spending its retries
+	for i := 0; i < maxConsecutiveRefusals; i++ {
+		result := performDNSQuery(context.Background(), "example.com", dns.TypeA, pool, config, testLogger())
+		if result.Error != nil {
+			t.Fatalf("query %d failed: %v", i, result.Error)
+		}
+		if result.Resolver != working.Address {
+			t.Errorf("query %d answered by %s, want %s", i, result.Resolver, working.Address)
+		}
+	}
+
+	if refusing.Healthy() {
+		t.Fatalf("resolver refusing connections is still healthy after %d refusals", maxConsecutiveRefusals)
+	}
+	if !working.Healthy() {
+		t.Errorf("working resolver marked unhealthy")
+	}
+
+	for i := 0; i < 4; i++ {
+		if resolver := pool.GetResolver(); resolver == refusing {
+			t.Fatalf("GetResolver returned the failed resolver %s", refusing.Address)
+		}
+	}
+}
+
+func TestNormalizeResolverAddress(t *testing.T) {
+	config := &Config{}
+
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"1.1.1.1", "1.1.1.1:53"},
+		{"1.1.1.1:53", "1.1.1.1:53"},
+		{" 1.1.1.1 ", "1.1.1.1:53"},
+		{"udp://1.1.1.1", "1.1.1.1:53"},
+		{"1.1.1.1:5353", "1.1.1.1:5353"},
+		{"tcp://1.1.1.1", "tcp://1.1.1.1:53"},
+		{"tls://1.1.1.1", "tls://1.1.1.1:853"},
+		{"TLS://1.1.1.1:853", "tls://1.1.1.1:853"},
+
+		{"2001:4860:4860::8888", "[2001:4860:4860::8888]:53"},
+		{"[2001:4860:4860::8888]", "[2001:4860:4860::8888]:53"},
+		{"[2001:4860:4860::8888]:53", "[2001:4860:4860::8888]:53"},
+		{"2001:4860:4860:0:0:0:0:8888", "[2001:4860:4860::8888]:53"},
+		{"[2001:4860:4860:0000::8888]:53", "[2001:4860:4860::8888]:53"},
+		{"tls://[2001:4860:4860::8888]", "tls://[2001:4860:4860::8888]:853"},
+
+		{"DNS.Google", "dns.google:53"},
+		{"dns.google.:53", "dns.google:53"},
+
+		{"https://dns.google", "https://dns.google/dns-query"},
+		{"https://dns.google/", "https://dns.google/dns-query"},
+		{"https://dns.google/dns-query", "https://dns.google/dns-query"},
+		{"HTTPS://DNS.Google/dns-query", "https://dns.google/dns-query"},
+		{"https://dns.google:443/dns-query", "https://dns.google/dns-query"},
+		{"https://dns.google:8443/dns-query", "https://dns.google:8443/dns-query"},
+		{"https://cloudflare-dns.com/resolve", "https://cloudflare-dns.com/resolve"},
+
+		// Addresses that don't parse are left for createResolver to reject
+		{"1.1.1.1:53:53", "1.1.1.1:53:53"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeResolverAddress(tt.address, config); got != tt.want {
+			t.Errorf("normalizeResolverAddress(%q) = %q, want %q", tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeResolverAddressDefaultPort(t *testing.T) {
+	config := &Config{Port: 5353}
+
+	if got, want := normalizeResolverAddress("1.1.1.1", config), "1.1.1.1:5353"; got != want {
+		t.Errorf("with -port 5353 got %q, want %q", got, want)
+	}
+	if got, want := normalizeResolverAddress("1.1.1.1:53", config), "1.1.1.1:53"; got != want {
+		t.Errorf("explicit port with -port 5353 got %q, want %q", got, want)
+	}
+}
+
+func TestDedupResolverAddresses(t *testing.T) {
+	addresses := []string{
+		"8.8.8.8",
+		"1.1.1.1:53",
+		"1.1.1.1",
+		"2001:4860:4860::8888",
+		"8.8.8.8:53",
+		"tcp://1.1.1.1",
+		"[2001:4860:4860::8888]:53",
+		"https://dns.google",
+		"https://DNS.google/dns-query",
+		"udp://8.8.8.8",
+	}
+
+	unique, removed := dedupResolverAddresses(addresses, &Config{})
+
+	want := []string{
+		"8.8.8.8:53",
+		"1.1.1.1:53",
+		"[2001:4860:4860::8888]:53",
+		"tcp://1.1.1.1:53",
+		"https://dns.google/dns-query",
+	}
+	if removed != len(addresses)-len(want) {
+		t.Errorf("removed = %d, want %d", removed, len(addresses)-len(want))
+	}
+	if len(unique) != len(want) {
+		t.Fatalf("unique = %q, want %q", unique, want)
+	}
+	for i := range want {
+		if unique[i] != want[i] {
+			t.Fatalf("unique = %q, want %q", unique, want)
+		}
+	}
+}
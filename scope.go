@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// ScopeFilter decides which domains are in scope for querying
+type ScopeFilter struct {
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+// NewScopeFilter creates a scope filter from optional allowlist and denylist files
+func NewScopeFilter(allowFile, denyFile string) (*ScopeFilter, error) {
+	filter := &ScopeFilter{}
+
+	if allowFile != "" {
+		allow, err := loadDomainSet(allowFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load allowlist: %v", err)
+		}
+		filter.allow = allow
+	}
+
+	if denyFile != "" {
+		deny, err := loadDomainSet(denyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load denylist: %v", err)
+		}
+		filter.deny = deny
+	}
+
+	return filter, nil
+}
+
+// InScope reports whether a domain may be queried.
+// Denylist entries always win; when an allowlist is present only
+// domains matching one of its entries are in scope.
+func (f *ScopeFilter) InScope(domain string) bool {
+	if f == nil {
+		return true
+	}
+
+	if f.deny != nil && matchesDomainSet(domain, f.deny) {
+		return false
+	}
+
+	if f.allow != nil {
+		return matchesDomainSet(domain, f.allow)
+	}
+
+	return true
+}
+
+// matchesDomainSet suffix-matches a domain against a set of entries.
+// The domain and each of its parents down to the effective TLD+1 are
+// looked up, so an entry for example.com covers www.example.com but an
+// entry for a public suffix such as co.uk never matches anything.
+func matchesDomainSet(domain string, set map[string]bool) bool {
+	domain = normalizeScopeName(domain)
+
+	base, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		// Not under a known public suffix, only exact matches apply
+		return set[domain]
+	}
+
+	for name := domain; ; {
+		if set[name] {
+			return true
+		}
+		if name == base {
+			return false
+		}
+		idx := strings.Index(name, ".")
+		if idx == -1 {
+			return false
+		}
+		name = name[idx+1:]
+	}
+}
+
+// normalizeScopeName lowercases a name and strips the trailing dot
+func normalizeScopeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+// loadDomainSet loads one domain per line from a file into a set
+func loadDomainSet(filename string) (map[string]bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	set := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Accept "*.example.com" as a synonym for "example.com"
+		line = strings.TrimPrefix(line, "*.")
+		set[normalizeScopeName(line)] = true
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading file: %v", err)
+	}
+
+	return set, nil
+}
@@ -0,0 +1,8 @@
+//go:build windows || plan9
+
+package main
+
+import "os"
+
+// notifyStatsSignal does nothing on platforms without SIGUSR1
+func notifyStatsSignal(ch chan<- os.Signal) {}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// defaultSpillAfter is how many lines the buffered output modes hold in
+// memory before spilling a sorted run to a temp file
+const defaultSpillAfter = 100000
+
+// spillSorter sorts a stream of lines using bounded memory, for the output
+// modes that can only write once the run ends. Lines are held in memory
+// until limit is reached, then sorted and written to a temp file as a run;
+// Each merges the runs with the lines still in memory. Lines must not
+// contain newlines.
+type spillSorter struct {
+	limit int
+	lines []string
+	runs  []*os.File
+}
+
+// newSpillSorter creates a sorter holding up to limit lines in memory
+func newSpillSorter(limit int) *spillSorter {
+	return &spillSorter{limit: limit}
+}
+
+// Add buffers a line, spilling the buffer to a temp file once it is full
+func (s *spillSorter) Add(line string) error {
+	s.lines = append(s.lines, line)
+	if s.limit > 0 && len(s.lines) >= s.limit {
+		return s.spill()
+	}
+	return nil
+}
+
+// spill writes the buffered lines, sorted, to a new temp file
+func (s *spillSorter) spill() error {
+	sort.Strings(s.lines)
+
+	file, err := os.CreateTemp("", "dns-resolver-spill-*")
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, file)
+
+	w := bufio.NewWriter(file)
+	for _, line := range s.lines {
+		w.WriteString(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	s.lines = s.lines[:0]
+	return nil
+}
+
+// Each calls fn for every line in sorted order, stopping at the first
+// error, and empties the sorter
+func (s *spillSorter) Each(fn func(line string) error) error {
+	defer s.Close()
+
+	sort.Strings(s.lines)
+	cursors := &mergeCursors{}
+	if len(s.lines) > 0 {
+		cursors.push(&mergeCursor{line: s.lines[0], memory: s.lines[1:]})
+	}
+	for _, run := range s.runs {
+		if _, err := run.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		cursor := &mergeCursor{reader: bufio.NewReader(run)}
+		ok, err := cursor.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			cursors.push(cursor)
+		}
+	}
+
+	for cursors.Len() > 0 {
+		cursor := (*cursors)[0]
+		if err := fn(cursor.line); err != nil {
+			return err
+		}
+
+		ok, err := cursor.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(cursors, 0)
+		} else {
+			heap.Pop(cursors)
+		}
+	}
+	return nil
+}
+
+// Close discards the buffered lines and temp files
+func (s *spillSorter) Close() {
+	for _, run := range s.runs {
+		run.Close()
+		os.Remove(run.Name())
+	}
+	s.runs = nil
+	s.lines = nil
+}
+
+// mergeCursor is the current line of one sorted run, read from a temp
+// file or from the lines left in memory
+type mergeCursor struct {
+	line   string
+	reader *bufio.Reader
+	memory []string
+}
+
+// next advances to the following line, reporting false at the end
+func (c *mergeCursor) next() (bool, error) {
+	if c.reader == nil {
+		if len(c.memory) == 0 {
+			return false, nil
+		}
+		c.line, c.memory = c.memory[0], c.memory[1:]
+		return true, nil
+	}
+
+	line, err := c.reader.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return false, nil
+	}
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	c.line = strings.TrimSuffix(line, "\n")
+	return true, nil
+}
+
+// mergeCursors is a heap of cursors ordered by their current line
+type mergeCursors []*mergeCursor
+
+func (h mergeCursors) Len() int            { return len(h) }
+func (h mergeCursors) Less(i, j int) bool  { return h[i].line < h[j].line }
+func (h mergeCursors) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeCursors) Push(x interface{}) { *h = append(*h, x.(*mergeCursor)) }
+
+func (h *mergeCursors) Pop() interface{} {
+	old := *h
+	cursor := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return cursor
+}
+
+// push adds a cursor keeping the heap order
+func (h *mergeCursors) push(cursor *mergeCursor) {
+	heap.Push(h, cursor)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSpillSorterOrder(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+
+	var want []string
+	sorter := newSpillSorter(7)
+	for _, n := range rand.Perm(100) {
+		line := fmt.Sprintf("line %03d", n)
+		want = append(want, line)
+		if err := sorter.Add(line); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	sort.Strings(want)
+
+	if runs := len(sorter.runs); runs != 100/7 {
+		t.Errorf("spilled %d runs, want %d", runs, 100/7)
+	}
+
+	var got []string
+	err := sorter.Each(func(line string) error {
+		got = append(got, line)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Each: %v", err)
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("lines out of order:\n%q", got)
+	}
+
+	if left, _ := filepath.Glob(filepath.Join(dir, "dns-resolver-spill-*")); len(left) > 0 {
+		t.Errorf("temp files left behind: %q", left)
+	}
+}
+
+func TestFamilyMergerSpilled(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	merger := newFamilyMerger(3)
+	add := func(domain string, qtype uint16, rrs ...string) {
+		if err := merger.Add(answerResult(t, domain, qtype, rrs...)); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	add("b.example", dns.TypeA, "b.example. 300 IN A 192.0.2.2", "b.example. 60 IN A 192.0.2.1")
+	add("a.example", dns.TypeA, "a.example. 300 IN A 192.0.2.9")
+	add("B.example", dns.TypeAAAA, "b.example. 120 IN AAAA 2001:db8::2")
+	add("b.example", dns.TypeA, "b.example. 300 IN A 192.0.2.2")
+
+	records, err := merger.Drain()
+	if err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	if records.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", records.Len())
+	}
+
+	var got []string
+	err = records.Each(func(record *MergedRecord) {
+		got = append(got, fmt.Sprintf("%s %v %v %d", record.Domain, record.IPv4, record.IPv6, record.TTL))
+	})
+	if err != nil {
+		t.Fatalf("Each: %v", err)
+	}
+
+	// Names keep the order they first appeared in, and addresses their
+	// answer order, however the lines were spilled
+	want := []string{
+		"b.example [192.0.2.2 192.0.2.1] [2001:db8::2] 60",
+		"a.example [192.0.2.9] [] 300",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("merged records:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestAnswerGroupsSpilled(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	groups := newAnswerGroups(2)
+	for _, r := range []struct{ domain, address string }{
+		{"a.example", "192.0.2.1"},
+		{"b.example", "192.0.2.1"},
+		{"c.example", "192.0.2.2"},
+		{"d.example", "192.0.2.2"},
+		{"e.example", "192.0.2.2"},
+		{"d.example", "192.0.2.2"},
+		{"f.example", "192.0.2.3"},
+	} {
+		result := answerResult(t, r.domain, dns.TypeA, r.domain+". 300 IN A "+r.address)
+		if err := groups.Add(result); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	var got []string
+	err := groups.Each(func(group answerGroup) {
+		got = append(got, fmt.Sprintf("%s %s %s", group.Type, strings.Join(group.Addresses, ","), strings.Join(group.Domains, ",")))
+	})
+	if err != nil {
+		t.Fatalf("Each: %v", err)
+	}
+
+	want := []string{
+		"A 192.0.2.2 c.example,d.example,e.example",
+		"A 192.0.2.1 a.example,b.example",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("groups:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -2,9 +2,12 @@ package main
 
 import (
         "context"
+        "encoding/json"
         "fmt"
-        "log"
+        "io"
+        "sort"
         "strings"
+        "sync"
         "sync/atomic"
         "time"
 )
@@ -17,6 +20,22 @@ type Stats struct {
         errorQueries     int64
         noAnswerQueries  int64
         wildcardQueries  int64
+        outOfScopeDomains int64
+        cacheHits        int64
+        negativeCacheHits int64
+        prefilteredDomains int64
+        abandonedDomains int64
+        ednsFallbacks    int64
+        cnameOnlyQueries int64
+        inconsistentAnswers int64
+        resolvedDomains  int64
+        resolvedSet      sync.Map
+        connsOpened      int64
+        connsReused      int64
+        bytesReceived    int64
+        cooldowns        int64
+        edeCounts        map[string]int64
+        edeMutex         sync.Mutex
         startTime       time.Time
 }
 
@@ -57,6 +76,88 @@ func (s *Stats) IncrementWildcards() {
         atomic.AddInt64(&s.wildcardQueries, 1)
 }
 
+// IncrementOutOfScope increments the count of domains skipped by scope rules
+func (s *Stats) IncrementOutOfScope() {
+        atomic.AddInt64(&s.outOfScopeDomains, 1)
+}
+
+// IncrementCacheHits increments the cache hit count, tracking negative hits separately
+func (s *Stats) IncrementCacheHits(negative bool) {
+        atomic.AddInt64(&s.cacheHits, 1)
+        if negative {
+                atomic.AddInt64(&s.negativeCacheHits, 1)
+        }
+}
+
+// IncrementPrefiltered increments the count of domains dropped by the prefilter
+func (s *Stats) IncrementPrefiltered() {
+        atomic.AddInt64(&s.prefilteredDomains, 1)
+}
+
+// IncrementAbandoned increments the count of domains cut short by -domain-deadline
+func (s *Stats) IncrementAbandoned() {
+        atomic.AddInt64(&s.abandonedDomains, 1)
+}
+
+// MarkResolved records that a domain returned at least one answer. Each
+// domain is counted once no matter how many of its query types succeed.
+func (s *Stats) MarkResolved(domain string) {
+        if _, loaded := s.resolvedSet.LoadOrStore(strings.ToLower(domain), struct{}{}); !loaded {
+                atomic.AddInt64(&s.resolvedDomains, 1)
+        }
+}
+
+// IncrementEDE counts a response carrying the given Extended DNS Error
+func (s *Stats) IncrementEDE(code uint16, name string) {
+        s.edeMutex.Lock()
+        defer s.edeMutex.Unlock()
+        
+        if s.edeCounts == nil {
+                s.edeCounts = make(map[string]int64)
+        }
+        s.edeCounts[fmt.Sprintf("%d (%s)", code, name)]++
+}
+
+// GetEDECounts returns a copy of the Extended DNS Error counts by code
+func (s *Stats) GetEDECounts() map[string]int64 {
+        s.edeMutex.Lock()
+        defer s.edeMutex.Unlock()
+        
+        counts := make(map[string]int64, len(s.edeCounts))
+        for code, count := range s.edeCounts {
+                counts[code] = count
+        }
+        return counts
+}
+
+// SetBytesReceived records the total response size gathered from the
+// resolver pool
+func (s *Stats) SetBytesReceived(n int64) {
+        atomic.StoreInt64(&s.bytesReceived, n)
+}
+
+// GetBytesReceived returns the total response size in bytes
+func (s *Stats) GetBytesReceived() int64 {
+        return atomic.LoadInt64(&s.bytesReceived)
+}
+
+// SetCooldowns records how many resolver cooldowns the pool started
+func (s *Stats) SetCooldowns(n int64) {
+        atomic.StoreInt64(&s.cooldowns, n)
+}
+
+// GetCooldowns returns how many times a resolver was put in cooldown
+func (s *Stats) GetCooldowns() int64 {
+        return atomic.LoadInt64(&s.cooldowns)
+}
+
+// SetConnectionCounts records the TCP and TLS connection totals gathered
+// from the resolver pool
+func (s *Stats) SetConnectionCounts(opened, reused int64) {
+        atomic.StoreInt64(&s.connsOpened, opened)
+        atomic.StoreInt64(&s.connsReused, reused)
+}
+
 // GetTotal returns the total domain count
 func (s *Stats) GetTotal() int64 {
         return atomic.LoadInt64(&s.totalDomains)
@@ -87,6 +188,76 @@ func (s *Stats) GetWildcards() int64 {
         return atomic.LoadInt64(&s.wildcardQueries)
 }
 
+// GetOutOfScope returns the count of domains skipped by scope rules
+func (s *Stats) GetOutOfScope() int64 {
+        return atomic.LoadInt64(&s.outOfScopeDomains)
+}
+
+// GetCacheHits returns the count of queries answered from the cache
+func (s *Stats) GetCacheHits() int64 {
+        return atomic.LoadInt64(&s.cacheHits)
+}
+
+// GetNegativeCacheHits returns the count of cache hits on negative answers
+func (s *Stats) GetNegativeCacheHits() int64 {
+        return atomic.LoadInt64(&s.negativeCacheHits)
+}
+
+// GetPrefiltered returns the count of domains dropped by the prefilter
+func (s *Stats) GetPrefiltered() int64 {
+        return atomic.LoadInt64(&s.prefilteredDomains)
+}
+
+// IncrementCNAMEOnly counts a -require-final-type answer that held only aliases
+func (s *Stats) IncrementCNAMEOnly() {
+        atomic.AddInt64(&s.cnameOnlyQueries, 1)
+}
+
+// GetCNAMEOnly returns the count of answers that held only aliases
+func (s *Stats) GetCNAMEOnly() int64 {
+        return atomic.LoadInt64(&s.cnameOnlyQueries)
+}
+
+// IncrementEDNSFallbacks counts a query answered only after retrying without EDNS
+func (s *Stats) IncrementEDNSFallbacks() {
+        atomic.AddInt64(&s.ednsFallbacks, 1)
+}
+
+// GetEDNSFallbacks returns the count of queries answered only after retrying without EDNS
+func (s *Stats) GetEDNSFallbacks() int64 {
+        return atomic.LoadInt64(&s.ednsFallbacks)
+}
+
+// IncrementInconsistent counts an answer that differed from the resolver's previous one
+func (s *Stats) IncrementInconsistent() {
+        atomic.AddInt64(&s.inconsistentAnswers, 1)
+}
+
+// GetInconsistent returns the count of answers that differed from the resolver's previous one
+func (s *Stats) GetInconsistent() int64 {
+        return atomic.LoadInt64(&s.inconsistentAnswers)
+}
+
+// GetAbandoned returns the count of domains cut short by -domain-deadline
+func (s *Stats) GetAbandoned() int64 {
+        return atomic.LoadInt64(&s.abandonedDomains)
+}
+
+// GetResolved returns the number of distinct domains with at least one answer
+func (s *Stats) GetResolved() int64 {
+        return atomic.LoadInt64(&s.resolvedDomains)
+}
+
+// GetConnsOpened returns the number of TCP and TLS connections opened
+func (s *Stats) GetConnsOpened() int64 {
+        return atomic.LoadInt64(&s.connsOpened)
+}
+
+// GetConnsReused returns the number of queries sent on a reused connection
+func (s *Stats) GetConnsReused() int64 {
+        return atomic.LoadInt64(&s.connsReused)
+}
+
 // GetElapsedTime returns the elapsed time since start
 func (s *Stats) GetElapsedTime() time.Duration {
         return time.Since(s.startTime)
@@ -102,7 +273,7 @@ func (s *Stats) GetQueriesPerSecond() float64 {
 }
 
 // PrintCurrentStats prints current statistics
-func (s *Stats) PrintCurrentStats(logger *log.Logger) {
+func (s *Stats) PrintCurrentStats(logger *Logger) {
         total := s.GetTotal()
         processed := s.GetProcessed()
         successful := s.GetSuccessful()
@@ -117,7 +288,7 @@ func (s *Stats) PrintCurrentStats(logger *log.Logger) {
 }
 
 // PrintFinalStats prints final statistics summary
-func (s *Stats) PrintFinalStats(logger *log.Logger) {
+func (s *Stats) PrintFinalStats(logger *Logger) {
         total := s.GetTotal()
         processed := s.GetProcessed()
         successful := s.GetSuccessful()
@@ -129,11 +300,55 @@ func (s *Stats) PrintFinalStats(logger *log.Logger) {
         
         logger.Println("=== Final Statistics ===")
         logger.Printf("Total domains processed: %d", total)
+        resolved := s.GetResolved()
+        logger.Printf("Domains resolved: %d of %d (%.2f%%)", resolved, total, percentage(resolved, total))
         logger.Printf("Total queries sent: %d", processed)
         logger.Printf("Successful queries: %d (%.2f%%)", successful, percentage(successful, processed))
         logger.Printf("Failed queries: %d (%.2f%%)", errors, percentage(errors, processed))
         logger.Printf("No answer queries: %d (%.2f%%)", noAnswer, percentage(noAnswer, processed))
         logger.Printf("Wildcard queries: %d (%.2f%%)", wildcards, percentage(wildcards, processed))
+        if outOfScope := s.GetOutOfScope(); outOfScope > 0 {
+                logger.Printf("Out-of-scope domains skipped: %d", outOfScope)
+        }
+        if prefiltered := s.GetPrefiltered(); prefiltered > 0 {
+                logger.Printf("Domains filtered out by prefilter: %d (%.2f%%)", prefiltered, percentage(prefiltered, total))
+        }
+        if abandoned := s.GetAbandoned(); abandoned > 0 {
+                logger.Printf("Domains abandoned at the per-domain deadline: %d (%.2f%%)", abandoned, percentage(abandoned, total))
+        }
+        if cnameOnly := s.GetCNAMEOnly(); cnameOnly > 0 {
+                logger.Printf("CNAME-only answers counted as no answer: %d", cnameOnly)
+        }
+        if fallbacks := s.GetEDNSFallbacks(); fallbacks > 0 {
+                logger.Printf("Queries retried without EDNS after FORMERR: %d", fallbacks)
+        }
+        if inconsistent := s.GetInconsistent(); inconsistent > 0 {
+                logger.Printf("Answers inconsistent with the same resolver's previous answer: %d", inconsistent)
+        }
+        if cooldowns := s.GetCooldowns(); cooldowns > 0 {
+                logger.Printf("Resolver cooldowns after bursts of REFUSED: %d", cooldowns)
+        }
+        if cacheHits := s.GetCacheHits(); cacheHits > 0 {
+                logger.Printf("Cache hits: %d (%d negative)", cacheHits, s.GetNegativeCacheHits())
+        }
+        if opened, reused := s.GetConnsOpened(), s.GetConnsReused(); opened > 0 {
+                logger.Printf("TCP connections: %d opened, %d queries reused an idle connection", opened, reused)
+        }
+        if edeCounts := s.GetEDECounts(); len(edeCounts) > 0 {
+                codes := make([]string, 0, len(edeCounts))
+                for code := range edeCounts {
+                        codes = append(codes, code)
+                }
+                sort.Strings(codes)
+                
+                logger.Println("Extended DNS errors:")
+                for _, code := range codes {
+                        logger.Printf("  %s: %d", code, edeCounts[code])
+                }
+        }
+        if received := s.GetBytesReceived(); received > 0 {
+                logger.Printf("Response bytes received: %d (%.1f KB/s)", received, float64(received)/1024/elapsed.Seconds())
+        }
         logger.Printf("Total elapsed time: %v", elapsed.Truncate(time.Second))
         logger.Printf("Average queries per second: %.2f", qps)
         
@@ -143,15 +358,49 @@ func (s *Stats) PrintFinalStats(logger *log.Logger) {
         }
 }
 
-// StartReporter starts a goroutine that periodically reports statistics
-func (s *Stats) StartReporter(ctx context.Context, logger *log.Logger, interval time.Duration) {
+// ProgressSnapshot is a machine-readable progress report
+type ProgressSnapshot struct {
+        Processed  int64   `json:"processed"`
+        Total      int64   `json:"total"`
+        Successful int64   `json:"successful"`
+        Errors     int64   `json:"errors"`
+        QPS        float64 `json:"qps"`
+        Elapsed    float64 `json:"elapsed"`
+}
+
+// WriteProgress writes the current progress to w as a single JSON line
+func (s *Stats) WriteProgress(w io.Writer) error {
+        data, err := json.Marshal(ProgressSnapshot{
+                Processed:  s.GetProcessed(),
+                Total:      s.GetTotal(),
+                Successful: s.GetSuccessful(),
+                Errors:     s.GetErrors(),
+                QPS:        s.GetQueriesPerSecond(),
+                Elapsed:    s.GetElapsedTime().Seconds(),
+        })
+        if err != nil {
+                return err
+        }
+        
+        _, err = fmt.Fprintf(w, "%s\n", data)
+        return err
+}
+
+// StartReporter periodically reports statistics to the logger and, as JSON
+// snapshots, to the progress writer. Either may be nil.
+func (s *Stats) StartReporter(ctx context.Context, logger *Logger, progress io.Writer, interval time.Duration) {
         ticker := time.NewTicker(interval)
         defer ticker.Stop()
         
         for {
                 select {
                 case <-ticker.C:
-                        s.PrintCurrentStats(logger)
+                        if logger != nil {
+                                s.PrintCurrentStats(logger)
+                        }
+                        if progress != nil {
+                                s.WriteProgress(progress)
+                        }
                 case <-ctx.Done():
                         return
                 }
@@ -161,14 +410,28 @@ func (s *Stats) StartReporter(ctx context.Context, logger *log.Logger, interval
 // GetSummary returns a summary of statistics as a map
 func (s *Stats) GetSummary() map[string]interface{} {
         return map[string]interface{}{
-                "total_domains":      s.GetTotal(),
-                "processed_queries":  s.GetProcessed(),
-                "successful_queries": s.GetSuccessful(),
-                "error_queries":      s.GetErrors(),
-                "no_answer_queries":  s.GetNoAnswer(),
-                "wildcard_queries":   s.GetWildcards(),
-                "elapsed_time":       s.GetElapsedTime().Seconds(),
-                "queries_per_second": s.GetQueriesPerSecond(),
+                "total_domains":        s.GetTotal(),
+                "resolved_domains":     s.GetResolved(),
+                "processed_queries":    s.GetProcessed(),
+                "successful_queries":   s.GetSuccessful(),
+                "error_queries":        s.GetErrors(),
+                "no_answer_queries":    s.GetNoAnswer(),
+                "wildcard_queries":     s.GetWildcards(),
+                "out_of_scope":         s.GetOutOfScope(),
+                "cache_hits":           s.GetCacheHits(),
+                "negative_cache_hits":  s.GetNegativeCacheHits(),
+                "prefiltered_domains":  s.GetPrefiltered(),
+                "abandoned_domains":    s.GetAbandoned(),
+                "edns_fallbacks":       s.GetEDNSFallbacks(),
+                "cname_only_queries":   s.GetCNAMEOnly(),
+                "inconsistent_answers": s.GetInconsistent(),
+                "connections_opened":   s.GetConnsOpened(),
+                "connections_reused":   s.GetConnsReused(),
+                "bytes_received":       s.GetBytesReceived(),
+                "resolver_cooldowns":   s.GetCooldowns(),
+                "extended_errors":      s.GetEDECounts(),
+                "elapsed_time":         s.GetElapsedTime().Seconds(),
+                "queries_per_second":   s.GetQueriesPerSecond(),
         }
 }
 
@@ -180,6 +443,26 @@ func (s *Stats) Reset() {
         atomic.StoreInt64(&s.errorQueries, 0)
         atomic.StoreInt64(&s.noAnswerQueries, 0)
         atomic.StoreInt64(&s.wildcardQueries, 0)
+        atomic.StoreInt64(&s.outOfScopeDomains, 0)
+        atomic.StoreInt64(&s.cacheHits, 0)
+        atomic.StoreInt64(&s.negativeCacheHits, 0)
+        atomic.StoreInt64(&s.prefilteredDomains, 0)
+        atomic.StoreInt64(&s.abandonedDomains, 0)
+        atomic.StoreInt64(&s.ednsFallbacks, 0)
+        atomic.StoreInt64(&s.cnameOnlyQueries, 0)
+        atomic.StoreInt64(&s.inconsistentAnswers, 0)
+        atomic.StoreInt64(&s.resolvedDomains, 0)
+        atomic.StoreInt64(&s.connsOpened, 0)
+        atomic.StoreInt64(&s.connsReused, 0)
+        atomic.StoreInt64(&s.bytesReceived, 0)
+        atomic.StoreInt64(&s.cooldowns, 0)
+        s.edeMutex.Lock()
+        s.edeCounts = nil
+        s.edeMutex.Unlock()
+        s.resolvedSet.Range(func(key, _ interface{}) bool {
+                s.resolvedSet.Delete(key)
+                return true
+        })
         s.startTime = time.Now()
 }
 
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// warmupInterval is the pause between -warmup probe rounds
+const warmupInterval = time.Second
+
+// warmupTally counts the probes one resolver answered during warmup
+type warmupTally struct {
+	sent     int64
+	answered int64
+	latency  int64
+}
+
+// Warmup probes every resolver with the test domain in rounds until
+// duration has passed, recording each outcome in the resolver's health
+// and latency stats. Resolvers that answered none of their probes are then
+// dropped from rotation, unless that would leave none. Probes go through
+// the rate limiter, so warmup traffic stays within -qps.
+func (p *ResolverPool) Warmup(ctx context.Context, duration time.Duration, rateLimiter *RateLimiter, config *Config) {
+	p.mutex.RLock()
+	resolvers := append([]*DNSResolver(nil), p.resolvers...)
+	p.mutex.RUnlock()
+	if len(resolvers) == 0 {
+		return
+	}
+
+	warmCtx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	tallies := make([]warmupTally, len(resolvers))
+	for warmCtx.Err() == nil {
+		p.warmupRound(warmCtx, resolvers, tallies, rateLimiter, config)
+
+		select {
+		case <-time.After(warmupInterval):
+		case <-warmCtx.Done():
+		}
+	}
+
+	// An interrupted warmup says nothing about the resolvers
+	if ctx.Err() != nil {
+		return
+	}
+
+	var sent, answered, latency int64
+	var dead []*DNSResolver
+	for i, tally := range tallies {
+		sent += tally.sent
+		answered += tally.answered
+		latency += tally.latency
+		if tally.sent > 0 && tally.answered == 0 {
+			dead = append(dead, resolvers[i])
+		}
+	}
+
+	var mean time.Duration
+	if answered > 0 {
+		mean = time.Duration(latency / answered)
+	}
+	p.logger.Printf("Warmup: %d of %d probes to %d resolvers answered, mean latency %v",
+		answered, sent, len(resolvers), mean.Round(time.Microsecond))
+
+	if len(dead) == len(resolvers) {
+		p.logger.Warnf("Warmup: no resolver answered, keeping all of them")
+		return
+	}
+	for _, resolver := range dead {
+		p.logger.Warnf("Warmup: dropping %s, which answered none of its probes", resolver.Address)
+	}
+	p.remove(dead)
+}
+
+// warmupRound sends one probe to each resolver, a bounded number at a time
+func (p *ResolverPool) warmupRound(ctx context.Context, resolvers []*DNSResolver, tallies []warmupTally,
+	rateLimiter *RateLimiter, config *Config) {
+
+	workers := maxResolverTestWorkers
+	if len(resolvers) < workers {
+		workers = len(resolvers)
+	}
+
+	indexChan := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexChan {
+				if err := rateLimiter.Wait(ctx); err != nil {
+					continue
+				}
+				p.warmupProbe(ctx, resolvers[idx], &tallies[idx], config)
+			}
+		}()
+	}
+
+	for idx := range resolvers {
+		indexChan <- idx
+	}
+	close(indexChan)
+	wg.Wait()
+}
+
+// warmupProbe sends one probe and records its outcome. A probe cut off
+// by the end of the warmup isn't counted.
+func (p *ResolverPool) warmupProbe(ctx context.Context, resolver *DNSResolver, tally *warmupTally, config *Config) {
+	msg := &dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(config.TestDomain), dns.TypeA)
+
+	probeCtx, cancel := context.WithTimeout(ctx, time.Duration(config.ResolverTestTimeout)*time.Second)
+	defer cancel()
+
+	_, rtt, err := resolver.ExchangeContext(probeCtx, msg, resolver.Address)
+	if ctx.Err() != nil {
+		return
+	}
+
+	atomic.AddInt64(&tally.sent, 1)
+	if err != nil {
+		resolver.ReportFailure(err)
+		return
+	}
+	resolver.ReportSuccess(rtt)
+	atomic.AddInt64(&tally.answered, 1)
+	atomic.AddInt64(&tally.latency, int64(rtt))
+}
+
+// remove takes resolvers out of rotation
+func (p *ResolverPool) remove(resolvers []*DNSResolver) {
+	drop := make(map[*DNSResolver]bool, len(resolvers))
+	for _, resolver := range resolvers {
+		drop[resolver] = true
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	kept := p.resolvers[:0]
+	for _, resolver := range p.resolvers {
+		if drop[resolver] {
+			resolver.conns.close()
+			continue
+		}
+		kept = append(kept, resolver)
+	}
+	p.resolvers = kept
+	if p.index >= len(p.resolvers) {
+		p.index = 0
+	}
+}
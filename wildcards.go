@@ -1,8 +1,8 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"math/rand"
 	"strings"
 	"sync"
@@ -15,9 +15,14 @@ import (
 // WildcardDetector detects DNS wildcard responses
 type WildcardDetector struct {
 	resolverPool *ResolverPool
+	rateLimiter  *RateLimiter
 	cache        map[string]bool
 	cacheMutex   sync.RWMutex
-	logger       *log.Logger
+	logger       *Logger
+	
+	// strict requires the random subdomains to return identical answers;
+	// otherwise any answer for all of them marks a wildcard
+	strict bool
 }
 
 // WildcardInfo contains information about a wildcard domain
@@ -27,17 +32,21 @@ type WildcardInfo struct {
 	IsWildcard bool
 }
 
-// NewWildcardDetector creates a new wildcard detector
-func NewWildcardDetector(resolverPool *ResolverPool, logger *log.Logger) *WildcardDetector {
+// NewWildcardDetector creates a new wildcard detector. With strict unset,
+// zones whose wildcard hands out different addresses per name are caught
+// too, at the cost of flagging zones that happen to answer every name.
+func NewWildcardDetector(resolverPool *ResolverPool, rateLimiter *RateLimiter, strict bool, logger *Logger) *WildcardDetector {
 	return &WildcardDetector{
 		resolverPool: resolverPool,
+		rateLimiter:  rateLimiter,
 		cache:        make(map[string]bool),
 		logger:       logger,
+		strict:       strict,
 	}
 }
 
 // IsWildcard checks if a DNS result is from a wildcard domain
-func (w *WildcardDetector) IsWildcard(result *DNSResult) bool {
+func (w *WildcardDetector) IsWildcard(ctx context.Context, result *DNSResult) bool {
 	if result.Response == nil || len(result.Response.Answer) == 0 {
 		return false
 	}
@@ -61,7 +70,12 @@ func (w *WildcardDetector) IsWildcard(result *DNSResult) bool {
 	w.cacheMutex.RUnlock()
 	
 	// Perform wildcard detection
-	isWildcard := w.detectWildcard(baseDomain, result.Type)
+	isWildcard := w.detectWildcard(ctx, baseDomain, result.Type)
+	
+	// Don't cache a verdict reached while shutting down
+	if ctx.Err() != nil {
+		return isWildcard
+	}
 	
 	// Cache the result
 	w.cacheMutex.Lock()
@@ -76,7 +90,7 @@ func (w *WildcardDetector) IsWildcard(result *DNSResult) bool {
 }
 
 // detectWildcard performs the actual wildcard detection
-func (w *WildcardDetector) detectWildcard(baseDomain string, qtype uint16) bool {
+func (w *WildcardDetector) detectWildcard(ctx context.Context, baseDomain string, qtype uint16) bool {
 	// Generate random subdomains for testing
 	testSubdomains := w.generateRandomSubdomains(baseDomain, 3)
 	
@@ -84,7 +98,7 @@ func (w *WildcardDetector) detectWildcard(baseDomain string, qtype uint16) bool
 	consistentResponses := true
 	
 	for _, testDomain := range testSubdomains {
-		answers := w.queryDomain(testDomain, qtype)
+		answers := w.queryDomain(ctx, testDomain, qtype)
 		responses = append(responses, answers)
 		
 		// If any query returns no results, it's likely not a wildcard
@@ -98,6 +112,11 @@ func (w *WildcardDetector) detectWildcard(baseDomain string, qtype uint16) bool
 		return false
 	}
 	
+	// Randomized wildcards answer every name, just not identically
+	if !w.strict {
+		return true
+	}
+	
 	firstResponse := responses[0]
 	for i := 1; i < len(responses); i++ {
 		if !sliceEqual(firstResponse, responses[i]) {
@@ -137,17 +156,24 @@ func (w *WildcardDetector) generateRandomString(length int) string {
 }
 
 // queryDomain performs a DNS query and returns the answer records
-func (w *WildcardDetector) queryDomain(domain string, qtype uint16) []string {
-	resolver := w.resolverPool.GetRandomResolver()
+func (w *WildcardDetector) queryDomain(ctx context.Context, domain string, qtype uint16) []string {
+	resolver := w.resolverPool.ForDomain(domain).GetRandomResolver()
 	if resolver == nil {
 		return nil
 	}
 	
+	// Test queries share the global query budget with regular lookups
+	if w.rateLimiter != nil {
+		if err := w.rateLimiter.Wait(ctx); err != nil {
+			return nil
+		}
+	}
+	
 	msg := &dns.Msg{}
 	msg.SetQuestion(dns.Fqdn(domain), qtype)
 	msg.RecursionDesired = true
 	
-	response, _, err := resolver.Client.Exchange(msg, resolver.Address)
+	response, _, err := resolver.ExchangeContext(ctx, msg, resolver.Address)
 	if err != nil || response == nil {
 		return nil
 	}